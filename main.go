@@ -1,5 +1,75 @@
+// Command dtp dissects captured DTP datagrams: a pcap or pcapng file, e.g. written by the capture
+// package, or a dump with one datagram per line in hex or raw. It prints a timeline with the
+// message codes, frame ranges and payload sizes of the datagrams and why the others failed to decode.
+//
+//	dtp [-format auto|pcap|hex|raw] [-json] [-session id,...] [file ...]
+//
+// Without files it reads stdin.
 package main
 
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/dissect"
+)
+
 func main() {
+	formatName := flag.String("format", "auto", "input format: auto, pcap, hex or raw")
+	asJSON := flag.Bool("json", false, "print JSON lines instead of a table")
+	sessions := flag.String("session", "", "comma separated session ids to show, all if empty")
+	flag.Parse()
+
+	if err := run(*formatName, *asJSON, *sessions, flag.Args(), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "dtp:", err)
+		os.Exit(1)
+	}
+}
+
+func run(formatName string, asJSON bool, sessions string, files []string, out io.Writer) error {
+	format, err := dissect.ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for _, s := range strings.Split(sessions, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("session id %q: %w", s, err)
+		}
+		ids = append(ids, id)
+	}
+
+	var records []capture.Record
+	if len(files) == 0 {
+		if records, err = dissect.Read(os.Stdin, format); err != nil {
+			return err
+		}
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		read, err := dissect.Read(f, format)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		records = append(records, read...)
+	}
 
+	frames := dissect.FilterSessions(dissect.Dissect(records), ids...)
+	if asJSON {
+		return dissect.WriteJSON(out, frames)
+	}
+	return dissect.WriteText(out, frames)
 }
@@ -0,0 +1,52 @@
+package dtp
+
+import (
+	"net"
+	"strconv"
+)
+
+// RejectReason tells a client why its REQ was refused. It travels in the payload of the ERR answer.
+type RejectReason int
+
+const (
+	RejectNone RejectReason = iota
+	RejectTooManySessions
+	RejectRateLimited
+	RejectForbidden
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectNone:
+		return "none"
+	case RejectTooManySessions:
+		return "too many sessions"
+	case RejectRateLimited:
+		return "rate limited"
+	case RejectForbidden:
+		return "forbidden"
+	}
+	return "reason " + strconv.Itoa(int(r))
+}
+
+// AdmissionRequest describes a REQ that is about to create a session.
+type AdmissionRequest struct {
+	// SessionID is the random initial id the client picked, the session gets its own id once admitted.
+	SessionID  int
+	RemoteAddr net.Addr
+	// Sessions is the number of sessions the server currently holds.
+	Sessions int
+}
+
+// AdmissionPolicy decides whether a REQ may create a session. Returning RejectNone admits it,
+// every other reason is sent back to the client.
+type AdmissionPolicy interface {
+	Admit(req AdmissionRequest) RejectReason
+}
+
+// AdmissionFunc adapts an ordinary function to an AdmissionPolicy.
+type AdmissionFunc func(req AdmissionRequest) RejectReason
+
+func (f AdmissionFunc) Admit(req AdmissionRequest) RejectReason {
+	return f(req)
+}
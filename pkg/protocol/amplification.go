@@ -0,0 +1,84 @@
+package dtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxUnvalidatedAddrs bounds the memory a flood of spoofed source addresses can bind.
+// Addresses beyond the limit get no budget and therefore no answer.
+const maxUnvalidatedAddrs = 65536
+
+// amplificationLimiter keeps the anti-amplification budget of every remote address that has not
+// been validated yet: the server never sends more than factor times the bytes it received from it.
+// An address is validated by a retry token or by completing the handshake, from then on the
+// session is no longer limited and the budget is forgotten.
+type amplificationLimiter struct {
+	factor   int
+	lifetime time.Duration
+	budgets  map[string]*addrBudget
+	now      func() time.Time
+	mux      sync.Mutex
+}
+
+type addrBudget struct {
+	received int
+	sent     int
+	lastSeen time.Time
+}
+
+func newAmplificationLimiter(factor int, lifetime time.Duration, now func() time.Time) *amplificationLimiter {
+	return &amplificationLimiter{factor: factor, lifetime: lifetime, budgets: map[string]*addrBudget{}, now: now}
+}
+
+// received credits n received bytes to the budget of addr.
+func (al *amplificationLimiter) received(addr net.Addr, n int) {
+	defer al.mux.Unlock()
+	al.mux.Lock()
+
+	now := al.now()
+	key := addr.String()
+	budget, ok := al.budgets[key]
+	if !ok {
+		if len(al.budgets) >= maxUnvalidatedAddrs {
+			al.prune(now)
+			if len(al.budgets) >= maxUnvalidatedAddrs {
+				return
+			}
+		}
+		budget = &addrBudget{}
+		al.budgets[key] = budget
+	}
+	budget.received += n
+	budget.lastSeen = now
+}
+
+// allow reports whether n more bytes may be sent to addr and charges them if so.
+func (al *amplificationLimiter) allow(addr net.Addr, n int) bool {
+	defer al.mux.Unlock()
+	al.mux.Lock()
+
+	budget, ok := al.budgets[addr.String()]
+	if !ok || budget.sent+n > al.factor*budget.received {
+		return false
+	}
+	budget.sent += n
+	return true
+}
+
+// validate lifts the limit for addr.
+func (al *amplificationLimiter) validate(addr net.Addr) {
+	defer al.mux.Unlock()
+	al.mux.Lock()
+	delete(al.budgets, addr.String())
+}
+
+// prune drops the budgets of addresses that have been quiet for longer than the lifetime.
+func (al *amplificationLimiter) prune(now time.Time) {
+	for key, budget := range al.budgets {
+		if now.Sub(budget.lastSeen) > al.lifetime {
+			delete(al.budgets, key)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package dtp
+
+import "sync"
+
+// AttrKey identifies a session attribute of type T. Keys are compared by identity, so two keys
+// with the same name are still different; create every key once, usually in a package variable:
+//
+//	var userKey = dtp.NewAttrKey[*User]("user", nil)
+//
+//	dtp.SetAttr(conn, userKey, user)
+//	user, ok := dtp.GetAttr(msg, userKey)
+type AttrKey[T any] struct {
+	name    string
+	cleanup func(T)
+}
+
+// NewAttrKey creates a key. cleanup, if not nil, is called with the value when it is deleted or
+// replaced and when the session is closed.
+func NewAttrKey[T any](name string, cleanup func(T)) *AttrKey[T] {
+	return &AttrKey[T]{name: name, cleanup: cleanup}
+}
+
+func (k *AttrKey[T]) String() string {
+	return k.name
+}
+
+// Attributes holds the attributes of a session. It is safe for concurrent use.
+type Attributes struct {
+	values map[any]attr
+	// closed is set once the session is closed, no values are stored from then on.
+	closed bool
+	mux    sync.Mutex
+}
+
+type attr struct {
+	value   any
+	cleanup func()
+}
+
+// AttrHolder is anything that gives access to the attributes of a session: the Session itself,
+// its DTPConnection and the messages read from it.
+type AttrHolder interface {
+	Attributes() *Attributes
+}
+
+func (a *Attributes) Attributes() *Attributes {
+	return a
+}
+
+// SetAttr stores value under key and runs the cleanup of the value it replaces. The session of a
+// closed connection keeps nothing, value is cleaned up at once.
+func SetAttr[T any](h AttrHolder, key *AttrKey[T], value T) {
+	a := h.Attributes()
+	if a == nil {
+		return
+	}
+	var cleanup func()
+	if key.cleanup != nil {
+		cleanup = func() { key.cleanup(value) }
+	}
+	a.mux.Lock()
+	if a.closed {
+		a.mux.Unlock()
+		if cleanup != nil {
+			cleanup()
+		}
+		return
+	}
+	if a.values == nil {
+		a.values = map[any]attr{}
+	}
+	old, ok := a.values[key]
+	a.values[key] = attr{value: value, cleanup: cleanup}
+	a.mux.Unlock()
+	if ok && old.cleanup != nil {
+		old.cleanup()
+	}
+}
+
+// GetAttr returns the value stored under key.
+func GetAttr[T any](h AttrHolder, key *AttrKey[T]) (T, bool) {
+	var zero T
+	a := h.Attributes()
+	if a == nil {
+		return zero, false
+	}
+	defer a.mux.Unlock()
+	a.mux.Lock()
+	v, ok := a.values[key]
+	if !ok {
+		return zero, false
+	}
+	return v.value.(T), true
+}
+
+// DeleteAttr removes the value stored under key and runs the cleanup of the key.
+func DeleteAttr[T any](h AttrHolder, key *AttrKey[T]) {
+	a := h.Attributes()
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	v, ok := a.values[key]
+	delete(a.values, key)
+	a.mux.Unlock()
+	if ok && v.cleanup != nil {
+		v.cleanup()
+	}
+}
+
+// clear removes all values and runs their cleanups, outside of the lock. Nothing is stored afterwards.
+func (a *Attributes) clear() {
+	a.mux.Lock()
+	values := a.values
+	a.values = nil
+	a.closed = true
+	a.mux.Unlock()
+	for _, v := range values {
+		if v.cleanup != nil {
+			v.cleanup()
+		}
+	}
+}
+
+// Attributes returns the attributes of the session, they are cleared once it is closed.
+func (sh *Session) Attributes() *Attributes {
+	return &sh.attrs
+}
+
+// Attributes returns the attributes of the session of the connection.
+func (c *DTPConnection) Attributes() *Attributes {
+	return c.session.Attributes()
+}
+
+// Attributes returns the attributes of the session the message was read from, nil for messages
+// that were not read from a connection.
+func (m *Message) Attributes() *Attributes {
+	return m.attrs
+}
@@ -0,0 +1,104 @@
+package dtp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	name string
+}
+
+func TestAttributes(t *testing.T) {
+	userKey := NewAttrKey[*user]("user", nil)
+	otherUserKey := NewAttrKey[*user]("user", nil)
+	hopsKey := NewAttrKey[int]("hops", nil)
+	session := NewSession(1)
+
+	SetAttr(session, userKey, &user{name: "alice"})
+	SetAttr(session, hopsKey, 3)
+
+	tests := []struct {
+		name  string
+		get   func() (any, bool)
+		value any
+		ok    bool
+	}{
+		{name: "pointer value", get: func() (any, bool) { return GetAttr(session, userKey) }, value: &user{name: "alice"}, ok: true},
+		{name: "plain value", get: func() (any, bool) { return GetAttr(session, hopsKey) }, value: 3, ok: true},
+		{name: "same name, other key", get: func() (any, bool) { return GetAttr(session, otherUserKey) }, value: (*user)(nil)},
+	}
+
+	for _, subTest := range tests {
+		value, ok := subTest.get()
+		assert.Equal(t, subTest.ok, ok, subTest.name)
+		assert.Equal(t, subTest.value, value, subTest.name)
+	}
+}
+
+func TestAttributesCleanup(t *testing.T) {
+	var released []string
+	key := NewAttrKey("lease", func(lease string) { released = append(released, lease) })
+	session := NewSession(1)
+
+	SetAttr(session, key, "first")
+	DeleteAttr(session, key)
+	assert.Equal(t, []string{"first"}, released)
+	DeleteAttr(session, key)
+	assert.Equal(t, []string{"first"}, released, "nothing to clean up twice")
+
+	SetAttr(session, key, "second")
+	SetAttr(session, key, "third")
+	assert.Equal(t, []string{"first", "second"}, released, "the replaced value is cleaned up")
+	assert.Nil(t, session.transition(HSK))
+	assert.Nil(t, session.transition(CLD))
+	assert.Equal(t, []string{"first", "second", "third"}, released)
+	_, ok := GetAttr(session, key)
+	assert.False(t, ok, "attributes are cleared on close")
+
+	SetAttr(session, key, "late")
+	assert.Equal(t, []string{"first", "second", "third", "late"}, released, "a closed session keeps nothing")
+	_, ok = GetAttr(session, key)
+	assert.False(t, ok, "nothing stored after close")
+}
+
+func TestAttributesConcurrent(t *testing.T) {
+	key := NewAttrKey[int]("counter", nil)
+	session := NewSession(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				SetAttr(session, key, i)
+				GetAttr(session, key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	_, ok := GetAttr(session, key)
+	assert.True(t, ok)
+}
+
+func TestAttributesFromConn(t *testing.T) {
+	userKey := NewAttrKey[*user]("user", nil)
+	server := startServer(t, Options{})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	SetAttr(accepted, userKey, &user{name: "bob"})
+	assert.Nil(t, client.WriteMessage(&Message{Data: []byte("hi")}))
+	msg, err := accepted.ReadMessage()
+	assert.Nil(t, err)
+	u, ok := GetAttr(msg, userKey)
+	assert.True(t, ok, "handlers see the attributes through the message")
+	assert.Equal(t, "bob", u.name)
+
+	_, ok = GetAttr(&Message{}, userKey)
+	assert.False(t, ok)
+}
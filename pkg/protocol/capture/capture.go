@@ -0,0 +1,96 @@
+// Package capture records the datagrams of a simulated network or a real socket and writes them as
+// pcap or pcapng files with synthetic IP and UDP headers, so the traces open in Wireshark.
+package capture
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Record is one datagram on the wire.
+type Record struct {
+	// Time is the time the datagram was sent.
+	Time time.Time
+	Src  netip.AddrPort
+	Dst  netip.AddrPort
+	Data []byte
+	// Dropped is set if the datagram never arrived: lost on the link, filtered on the way or not
+	// read by anybody.
+	Dropped bool
+	// Delay is the time the datagram was on its way, zero if it arrived at once or was dropped.
+	Delay time.Duration
+}
+
+// Delayed reports whether the datagram arrived later than it was sent.
+func (r Record) Delayed() bool {
+	return !r.Dropped && r.Delay > 0
+}
+
+// Hook is called with every captured datagram. It may be called from several goroutines at once and
+// must not keep Data beyond the call unless it copies it.
+type Hook func(Record)
+
+// Recorder keeps the records in memory, e.g. to write them to a file once a test failed.
+type Recorder struct {
+	records []Record
+	mux     sync.Mutex
+}
+
+// Hook returns the hook that adds to the recorder.
+func (r *Recorder) Hook() Hook {
+	return func(rec Record) {
+		rec.Data = append([]byte(nil), rec.Data...)
+		defer r.mux.Unlock()
+		r.mux.Lock()
+		r.records = append(r.records, rec)
+	}
+}
+
+// Records returns the records so far in the order they were captured.
+func (r *Recorder) Records() []Record {
+	defer r.mux.Unlock()
+	r.mux.Lock()
+	return append([]Record(nil), r.records...)
+}
+
+// Conn is a net.PacketConn that passes every datagram it sends or receives to a hook.
+type Conn struct {
+	net.PacketConn
+	hook Hook
+}
+
+// Wrap captures the datagrams of conn, e.g. a *net.UDPConn handed to dtp.Dial or dtp.NewServer. Sent
+// datagrams the socket refused are recorded as dropped.
+func Wrap(conn net.PacketConn, hook Hook) *Conn {
+	return &Conn{PacketConn: conn, hook: hook}
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.hook(Record{Time: time.Now(), Src: addrPort(addr), Dst: addrPort(c.LocalAddr()), Data: b[:n]})
+	}
+	return n, addr, err
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	now := time.Now()
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.hook(Record{Time: now, Src: addrPort(c.LocalAddr()), Dst: addrPort(addr), Data: b, Dropped: err != nil})
+	return n, err
+}
+
+// addrPort converts a UDP address, other addresses are parsed from their string.
+func addrPort(addr net.Addr) netip.AddrPort {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		ap := udp.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	if addr == nil {
+		return netip.AddrPort{}
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
@@ -0,0 +1,152 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacket(t *testing.T) {
+	tests := []struct {
+		name      string
+		src, dst  netip.AddrPort
+		data      []byte
+		headerLen int
+		version   byte
+	}{
+		{name: "ipv4", src: netip.MustParseAddrPort("10.0.0.1:4000"), dst: netip.MustParseAddrPort("10.0.0.2:53"), data: []byte("Sid:1|Uid:2"), headerLen: ipv4HeaderLen, version: 4},
+		{name: "ipv4 odd payload", src: netip.MustParseAddrPort("10.0.0.1:4000"), dst: netip.MustParseAddrPort("10.0.0.2:53"), data: []byte("abc"), headerLen: ipv4HeaderLen, version: 4},
+		{name: "ipv4-mapped is ipv4", src: netip.MustParseAddrPort("[::ffff:10.0.0.1]:4000"), dst: netip.MustParseAddrPort("10.0.0.2:53"), data: []byte("abc"), headerLen: ipv4HeaderLen, version: 4},
+		{name: "ipv6", src: netip.MustParseAddrPort("[2001:db8::1]:4000"), dst: netip.MustParseAddrPort("[2001:db8::2]:53"), data: []byte("abcd"), headerLen: ipv6HeaderLen, version: 6},
+		{name: "mixed is ipv6", src: netip.MustParseAddrPort("10.0.0.1:4000"), dst: netip.MustParseAddrPort("[2001:db8::2]:53"), data: []byte{}, headerLen: ipv6HeaderLen, version: 6},
+	}
+
+	for _, subTest := range tests {
+		pkt := packet(subTest.src, subTest.dst, subTest.data, 7)
+		assert.Len(t, pkt, subTest.headerLen+udpHeaderLen+len(subTest.data), subTest.name)
+		assert.Equal(t, subTest.version, pkt[0]>>4, subTest.name)
+		udp := pkt[subTest.headerLen:]
+		assert.Equal(t, subTest.src.Port(), binary.BigEndian.Uint16(udp[0:]), subTest.name)
+		assert.Equal(t, subTest.dst.Port(), binary.BigEndian.Uint16(udp[2:]), subTest.name)
+		assert.Equal(t, subTest.data, []byte(udp[udpHeaderLen:]), subTest.name)
+
+		// A valid checksum sums up to zero together with the data it covers.
+		var pseudo []byte
+		if subTest.version == 4 {
+			assert.Equal(t, uint16(0), checksum(pkt[:ipv4HeaderLen]), subTest.name)
+			pseudo = append(append([]byte(nil), pkt[12:20]...), 0, protoUDP, 0, byte(len(udp)))
+		} else {
+			pseudo = append(append([]byte(nil), pkt[8:40]...), 0, 0, 0, byte(len(udp)), 0, 0, 0, protoUDP)
+		}
+		assert.Equal(t, uint16(0), checksum(pseudo, udp), subTest.name)
+	}
+}
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	at := time.Unix(100, 42)
+	src, dst := netip.MustParseAddrPort("10.0.0.1:4000"), netip.MustParseAddrPort("10.0.0.2:53")
+	hook := w.Hook()
+	hook(Record{Time: at, Src: src, Dst: dst, Data: []byte("ping")})
+	hook(Record{Time: at, Src: src, Dst: dst, Data: []byte("lost"), Dropped: true})
+	assert.Nil(t, w.Err())
+
+	b := buf.Bytes()
+	if !assert.Len(t, b, 24+16+ipv4HeaderLen+udpHeaderLen+4) {
+		return
+	}
+	assert.Equal(t, uint32(pcapMagicNano), binary.LittleEndian.Uint32(b[0:]))
+	assert.Equal(t, uint32(linkTypeRaw), binary.LittleEndian.Uint32(b[20:]))
+	assert.Equal(t, uint32(100), binary.LittleEndian.Uint32(b[24:]))
+	assert.Equal(t, uint32(42), binary.LittleEndian.Uint32(b[28:]))
+	assert.Equal(t, uint32(32), binary.LittleEndian.Uint32(b[32:]))
+	assert.Equal(t, []byte("ping"), b[len(b)-4:])
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	src, dst := netip.MustParseAddrPort("10.0.0.1:4000"), netip.MustParseAddrPort("10.0.0.2:53")
+	assert.Nil(t, w.WriteRecord(Record{Time: time.Unix(1, 0), Src: src, Dst: dst, Data: []byte("ping")}))
+	assert.Nil(t, w.WriteRecord(Record{Time: time.Unix(2, 0), Src: src, Dst: dst, Data: []byte("late"), Delay: 30 * time.Millisecond}))
+	assert.Nil(t, w.WriteRecord(Record{Time: time.Unix(3, 0), Src: src, Dst: dst, Data: []byte("lost"), Dropped: true}))
+
+	// Walk the blocks by their lengths, the trailing length has to match the leading one.
+	var types []uint32
+	var comments []string
+	b := buf.Bytes()
+	for len(b) > 0 {
+		if !assert.GreaterOrEqual(t, len(b), 12) {
+			return
+		}
+		blockType, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if !assert.Zero(t, length%4) || !assert.LessOrEqual(t, int(length), len(b)) {
+			return
+		}
+		assert.Equal(t, length, binary.LittleEndian.Uint32(b[length-4:]))
+		types = append(types, blockType)
+		if blockType == pcapngEnhancedPacket {
+			captured := binary.LittleEndian.Uint32(b[20:])
+			opts := b[28+(captured+3)/4*4 : length-4]
+			comment := ""
+			if len(opts) > 4 && binary.LittleEndian.Uint16(opts) == optComment {
+				comment = string(opts[4 : 4+binary.LittleEndian.Uint16(opts[2:])])
+			}
+			comments = append(comments, comment)
+		}
+		b = b[length:]
+	}
+	assert.Equal(t, []uint32{pcapngSectionHeader, pcapngInterface, pcapngEnhancedPacket, pcapngEnhancedPacket, pcapngEnhancedPacket}, types)
+	assert.Equal(t, []string{"", "delayed 30ms", "dropped"}, comments)
+}
+
+func TestWrap(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	defer client.Close()
+
+	var recorder Recorder
+	conn := Wrap(client, recorder.Hook())
+	_, err = conn.WriteTo([]byte("ping"), server.LocalAddr())
+	assert.Nil(t, err)
+	buf := make([]byte, 16)
+	n, from, err := server.ReadFromUDP(buf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = server.WriteToUDP(buf[:n], from)
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadFrom(buf)
+	assert.Nil(t, err)
+
+	records := recorder.Records()
+	if assert.Len(t, records, 2) {
+		serverAddr, clientAddr := server.LocalAddr().(*net.UDPAddr).AddrPort(), client.LocalAddr().(*net.UDPAddr).AddrPort()
+		assert.Equal(t, clientAddr, records[0].Src)
+		assert.Equal(t, serverAddr, records[0].Dst)
+		assert.Equal(t, serverAddr, records[1].Src)
+		assert.Equal(t, clientAddr, records[1].Dst)
+		assert.Equal(t, []byte("ping"), records[1].Data)
+		assert.False(t, records[0].Dropped)
+	}
+}
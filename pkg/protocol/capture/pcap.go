@@ -0,0 +1,272 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+)
+
+const (
+	// linkTypeRaw is LINKTYPE_RAW: every packet starts with its IPv4 or IPv6 header.
+	linkTypeRaw = 101
+	snapLen     = 65535
+	// pcapMagicNano is the magic of pcap files with nanosecond timestamps.
+	pcapMagicNano = 0xa1b23c4d
+
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	optEnd               = 0
+	optComment           = 1
+	optTsResol           = 9
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	protoUDP      = 17
+	ttl           = 64
+)
+
+// RecordWriter writes records to a capture file.
+type RecordWriter interface {
+	WriteRecord(r Record) error
+}
+
+// writer is the part the pcap and pcapng writers share. It keeps the first error of Hook.
+type writer struct {
+	w    io.Writer
+	ipID uint16
+	err  error
+	mux  sync.Mutex
+}
+
+// PcapWriter writes records as a classic pcap file with nanosecond timestamps. The format has no room
+// for the flags of a record, so dropped datagrams are left out, see PcapngWriter.
+type PcapWriter struct {
+	writer
+}
+
+// NewPcapWriter writes the file header to w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagicNano)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], snapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{writer{w: w}}, nil
+}
+
+// WriteRecord writes the datagram with synthetic IP and UDP headers, timestamped with its send time.
+func (pw *PcapWriter) WriteRecord(r Record) error {
+	if r.Dropped {
+		return nil
+	}
+	defer pw.mux.Unlock()
+	pw.mux.Lock()
+	pkt := pw.packet(r)
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(r.Time.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(r.Time.Nanosecond()))
+	binary.LittleEndian.PutUint32(header[8:], uint32(min(len(pkt), snapLen)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(pkt)))
+	if _, err := pw.w.Write(header); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(pkt[:min(len(pkt), snapLen)])
+	return err
+}
+
+// Hook returns a hook that writes to the file, see Err for its errors.
+func (pw *PcapWriter) Hook() Hook {
+	return pw.hook(pw.WriteRecord)
+}
+
+// PcapngWriter writes records as a pcapng file. Dropped and delayed datagrams carry a packet comment,
+// in Wireshark they can be found with the filter frame.comment.
+type PcapngWriter struct {
+	writer
+}
+
+// NewPcapngWriter writes the section header and the description of the single interface to w.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	// The length of the section is unknown.
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	if err := writeBlock(w, pcapngSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], snapLen)
+	// Timestamps in nanoseconds.
+	idb = appendOption(idb, optTsResol, []byte{9})
+	idb = appendOption(idb, optEnd, nil)
+	if err := writeBlock(w, pcapngInterface, idb); err != nil {
+		return nil, err
+	}
+	return &PcapngWriter{writer{w: w}}, nil
+}
+
+// WriteRecord writes the datagram with synthetic IP and UDP headers, timestamped with its send time.
+func (pw *PcapngWriter) WriteRecord(r Record) error {
+	defer pw.mux.Unlock()
+	pw.mux.Lock()
+	pkt := pw.packet(r)
+	ts := uint64(r.Time.UnixNano())
+	body := make([]byte, 20, 20+len(pkt)+64)
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	body = append(body, pad(pkt)...)
+	if comment := r.comment(); comment != "" {
+		body = appendOption(body, optComment, []byte(comment))
+		body = appendOption(body, optEnd, nil)
+	}
+	return writeBlock(pw.w, pcapngEnhancedPacket, body)
+}
+
+// Hook returns a hook that writes to the file, see Err for its errors.
+func (pw *PcapngWriter) Hook() Hook {
+	return pw.hook(pw.WriteRecord)
+}
+
+func (r Record) comment() string {
+	switch {
+	case r.Dropped:
+		return "dropped"
+	case r.Delay > 0:
+		return fmt.Sprintf("delayed %s", r.Delay)
+	}
+	return ""
+}
+
+func (w *writer) hook(write func(Record) error) Hook {
+	return func(r Record) {
+		if err := write(r); err != nil {
+			defer w.mux.Unlock()
+			w.mux.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+		}
+	}
+}
+
+// Err returns the first error a hook of the writer ran into.
+func (w *writer) Err() error {
+	defer w.mux.Unlock()
+	w.mux.Lock()
+	return w.err
+}
+
+// packet builds the IP packet of a record, the caller holds the lock.
+func (w *writer) packet(r Record) []byte {
+	w.ipID++
+	return packet(r.Src, r.Dst, r.Data, w.ipID)
+}
+
+// packet puts an IPv4 header in front of data if both addresses are IPv4, otherwise an IPv6 header.
+// Both carry a valid UDP checksum.
+func packet(src, dst netip.AddrPort, data []byte, id uint16) []byte {
+	udpLen := udpHeaderLen + len(data)
+	var pkt, pseudo []byte
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if !srcIP.IsValid() {
+		srcIP = netip.IPv4Unspecified()
+	}
+	if !dstIP.IsValid() {
+		dstIP = netip.IPv4Unspecified()
+	}
+	if srcIP.Is4() && dstIP.Is4() {
+		pkt = make([]byte, ipv4HeaderLen+udpLen)
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:], id)
+		pkt[8] = ttl
+		pkt[9] = protoUDP
+		s, d := srcIP.As4(), dstIP.As4()
+		copy(pkt[12:], s[:])
+		copy(pkt[16:], d[:])
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:ipv4HeaderLen]))
+		pseudo = append(append(append([]byte(nil), s[:]...), d[:]...), 0, protoUDP, byte(udpLen>>8), byte(udpLen))
+	} else {
+		pkt = make([]byte, ipv6HeaderLen+udpLen)
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(udpLen))
+		pkt[6] = protoUDP
+		pkt[7] = ttl
+		s, d := srcIP.As16(), dstIP.As16()
+		copy(pkt[8:], s[:])
+		copy(pkt[24:], d[:])
+		pseudo = append(append(append([]byte(nil), s[:]...), d[:]...), 0, 0, byte(udpLen>>8), byte(udpLen), 0, 0, 0, protoUDP)
+	}
+
+	udp := pkt[len(pkt)-udpLen:]
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHeaderLen:], data)
+	sum := checksum(pseudo, udp)
+	// A zero checksum means none in UDP, the one's complement of zero is sent instead.
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return pkt
+}
+
+// checksum returns the internet checksum over the parts, all but the last have an even length.
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range parts {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// writeBlock writes a pcapng block with its type and length in front of and its length behind body.
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	body = pad(body)
+	block := make([]byte, 8, len(body)+12)
+	length := uint32(len(body) + 12)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, err := w.Write(block)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, pad(value)...)
+}
+
+// pad fills b up to a multiple of 4 bytes.
+func pad(b []byte) []byte {
+	if len(b)%4 == 0 {
+		return b
+	}
+	return append(b, make([]byte, 4-len(b)%4)...)
+}
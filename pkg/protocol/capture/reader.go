@@ -0,0 +1,346 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	pcapMagicMicro     = 0xa1b2c3d4
+	pcapngSimplePacket = 0x00000003
+
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeLoop     = 108
+	linkTypeSLL      = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+)
+
+var (
+	ErrFormat = errors.New("capture: neither a pcap nor a pcapng file")
+	// ErrTruncated is returned for a file that ends within a packet or block.
+	ErrTruncated = errors.New("capture: truncated file")
+)
+
+// Reader reads the UDP datagrams of a pcap or pcapng file, as written by PcapWriter and
+// PcapngWriter or by tcpdump and Wireshark. Packets that are no UDP datagrams are skipped.
+type Reader struct {
+	r     *bufio.Reader
+	ng    bool
+	order binary.ByteOrder
+	// linkType and resolution describe the packets of a pcap file, interfaces those of a pcapng section.
+	linkType   uint32
+	resolution time.Duration
+	interfaces []iface
+}
+
+type iface struct {
+	linkType uint32
+	// units is the number of timestamp units per second.
+	units uint64
+}
+
+// NewReader reads the file header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	reader := &Reader{r: br}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		reader.ng = true
+		return reader, nil
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrFormat
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header) {
+		case pcapMagicMicro:
+			reader.resolution = time.Microsecond
+		case pcapMagicNano:
+			reader.resolution = time.Nanosecond
+		default:
+			continue
+		}
+		reader.order = order
+		// The upper bits carry the FCS length of some link types.
+		reader.linkType = order.Uint32(header[20:]) & 0xffff
+		return reader, nil
+	}
+	return nil, ErrFormat
+}
+
+// Next returns the next UDP datagram, io.EOF at the end of the file.
+func (r *Reader) Next() (Record, error) {
+	for {
+		var rec Record
+		var ok bool
+		var err error
+		if r.ng {
+			rec, ok, err = r.nextBlock()
+		} else {
+			rec, ok, err = r.nextPacket()
+		}
+		if err != nil || ok {
+			return rec, err
+		}
+	}
+}
+
+// ReadAll returns all UDP datagrams of the file.
+func (r *Reader) ReadAll() ([]Record, error) {
+	var records []Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func (r *Reader) nextPacket() (Record, bool, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.EOF {
+			return Record{}, false, io.EOF
+		}
+		return Record{}, false, ErrTruncated
+	}
+	captured := r.order.Uint32(header[8:])
+	if captured > 1<<24 {
+		return Record{}, false, fmt.Errorf("capture: packet of %d bytes", captured)
+	}
+	data := make([]byte, captured)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Record{}, false, ErrTruncated
+	}
+	at := time.Unix(int64(r.order.Uint32(header)), int64(r.order.Uint32(header[4:]))*int64(r.resolution))
+	rec, ok := datagram(r.linkType, data)
+	rec.Time = at
+	return rec, ok, nil
+}
+
+func (r *Reader) nextBlock() (Record, bool, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.EOF {
+			return Record{}, false, io.EOF
+		}
+		return Record{}, false, ErrTruncated
+	}
+	blockType := binary.LittleEndian.Uint32(header)
+	if blockType == pcapngSectionHeader {
+		// Every section has its own byte order and interfaces.
+		magic, err := r.r.Peek(4)
+		if err != nil {
+			return Record{}, false, ErrTruncated
+		}
+		r.order = binary.LittleEndian
+		if binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic {
+			r.order = binary.BigEndian
+		}
+		r.interfaces = nil
+	} else if r.order == nil {
+		return Record{}, false, ErrFormat
+	}
+	blockType = r.order.Uint32(header)
+	length := r.order.Uint32(header[4:])
+	if length < 12 || length%4 != 0 || length > 1<<24 {
+		return Record{}, false, fmt.Errorf("capture: invalid block length %d", length)
+	}
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return Record{}, false, ErrTruncated
+	}
+	body = body[:len(body)-4]
+
+	switch blockType {
+	case pcapngInterface:
+		if len(body) < 8 {
+			return Record{}, false, ErrTruncated
+		}
+		in := iface{linkType: uint32(r.order.Uint16(body)), units: 1e6}
+		for _, opt := range options(r.order, body[8:]) {
+			if opt.code == optTsResol && len(opt.value) > 0 {
+				in.units = resolution(opt.value[0])
+			}
+		}
+		r.interfaces = append(r.interfaces, in)
+	case pcapngEnhancedPacket:
+		if len(body) < 20 {
+			return Record{}, false, ErrTruncated
+		}
+		id, captured := r.order.Uint32(body), r.order.Uint32(body[12:])
+		if int(id) >= len(r.interfaces) || uint64(captured) > uint64(len(body)-20) {
+			return Record{}, false, ErrTruncated
+		}
+		in := r.interfaces[id]
+		rec, ok := datagram(in.linkType, body[20:20+captured])
+		ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+		rec.Time = timestamp(ts, in.units)
+		for _, opt := range options(r.order, body[min(len(body), 20+int(captured+3)/4*4):]) {
+			if opt.code == optComment {
+				rec.parseComment(string(opt.value))
+			}
+		}
+		return rec, ok, nil
+	case pcapngSimplePacket:
+		if len(body) < 4 || len(r.interfaces) == 0 {
+			return Record{}, false, ErrTruncated
+		}
+		captured := min(r.order.Uint32(body), uint32(len(body)-4))
+		rec, ok := datagram(r.interfaces[0].linkType, body[4:4+captured])
+		return rec, ok, nil
+	}
+	return Record{}, false, nil
+}
+
+type option struct {
+	code  uint16
+	value []byte
+}
+
+// options parses the options at the end of a pcapng block.
+func options(order binary.ByteOrder, b []byte) []option {
+	var opts []option
+	for len(b) >= 4 {
+		code, length := order.Uint16(b), int(order.Uint16(b[2:]))
+		if code == optEnd || 4+length > len(b) {
+			break
+		}
+		opts = append(opts, option{code: code, value: b[4 : 4+length]})
+		b = b[min(len(b), 4+(length+3)/4*4):]
+	}
+	return opts
+}
+
+// resolution returns the units per second of an if_tsresol value: a power of 10, or of 2 with the
+// high bit set.
+func resolution(v byte) uint64 {
+	if v&0x80 != 0 {
+		return 1 << min(v&0x7f, 63)
+	}
+	return uint64(math.Pow10(int(min(v, 19))))
+}
+
+func timestamp(ts, units uint64) time.Time {
+	// frac is less than units, so is the product divided by units less than a second.
+	hi, lo := bits.Mul64(ts%units, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, units)
+	return time.Unix(int64(ts/units), int64(nsec))
+}
+
+func (r *Record) parseComment(comment string) {
+	switch {
+	case comment == "dropped":
+		r.Dropped = true
+	case strings.HasPrefix(comment, "delayed "):
+		if d, err := time.ParseDuration(strings.TrimPrefix(comment, "delayed ")); err == nil {
+			r.Delay = d
+		}
+	}
+}
+
+// datagram takes the UDP datagram out of a packet of the link type.
+func datagram(linkType uint32, data []byte) (Record, bool) {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return ipDatagram(data)
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return Record{}, false
+		}
+		return ipDatagram(data[4:])
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return Record{}, false
+		}
+		etherType, payload := binary.BigEndian.Uint16(data[12:]), data[14:]
+		for etherType == etherTypeVLAN && len(payload) >= 4 {
+			etherType, payload = binary.BigEndian.Uint16(payload[2:]), payload[4:]
+		}
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return Record{}, false
+		}
+		return ipDatagram(payload)
+	case linkTypeSLL:
+		if len(data) < 16 {
+			return Record{}, false
+		}
+		return ipDatagram(data[16:])
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return Record{}, false
+		}
+		return ipDatagram(data[20:])
+	}
+	return Record{}, false
+}
+
+// ipDatagram parses the IP and UDP headers in front of a datagram. Fragments and IPv6 extension
+// headers are not followed.
+func ipDatagram(pkt []byte) (Record, bool) {
+	if len(pkt) < 1 {
+		return Record{}, false
+	}
+	var src, dst netip.Addr
+	var udp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		headerLen := int(pkt[0]&0x0f) * 4
+		if headerLen < ipv4HeaderLen || len(pkt) < headerLen || pkt[9] != protoUDP {
+			return Record{}, false
+		}
+		// Only the first fragment has the UDP header.
+		if binary.BigEndian.Uint16(pkt[6:])&0x1fff != 0 {
+			return Record{}, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20]))
+		if total := int(binary.BigEndian.Uint16(pkt[2:])); total >= headerLen && total < len(pkt) {
+			pkt = pkt[:total]
+		}
+		udp = pkt[headerLen:]
+	case 6:
+		if len(pkt) < ipv6HeaderLen || pkt[6] != protoUDP {
+			return Record{}, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40]))
+		udp = pkt[ipv6HeaderLen:]
+	default:
+		return Record{}, false
+	}
+	if len(udp) < udpHeaderLen {
+		return Record{}, false
+	}
+	end := len(udp)
+	if length := int(binary.BigEndian.Uint16(udp[4:])); length >= udpHeaderLen && length < end {
+		end = length
+	}
+	return Record{
+		Src:  netip.AddrPortFrom(src, binary.BigEndian.Uint16(udp[0:])),
+		Dst:  netip.AddrPortFrom(dst, binary.BigEndian.Uint16(udp[2:])),
+		Data: udp[udpHeaderLen:end],
+	}, true
+}
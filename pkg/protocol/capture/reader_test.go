@@ -0,0 +1,143 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func records() []Record {
+	v4src, v4dst := netip.MustParseAddrPort("10.0.0.2:49152"), netip.MustParseAddrPort("10.0.0.1:9000")
+	v6src, v6dst := netip.MustParseAddrPort("[2001:db8::2]:49152"), netip.MustParseAddrPort("[2001:db8::1]:9000")
+	return []Record{
+		{Time: time.Unix(10, 1), Src: v4src, Dst: v4dst, Data: []byte("Sid:1|Uid:0|Msg:0")},
+		{Time: time.Unix(10, 500), Src: v4dst, Dst: v4src, Data: []byte("late"), Delay: 25 * time.Millisecond},
+		{Time: time.Unix(11, 0), Src: v6src, Dst: v6dst, Data: []byte("lost"), Dropped: true},
+		{Time: time.Unix(12, 999999999), Src: v6dst, Dst: v6src, Data: []byte{}},
+	}
+}
+
+func TestReadBack(t *testing.T) {
+	tests := []struct {
+		name   string
+		writer func(b *bytes.Buffer) RecordWriter
+		// dropped tells whether the format keeps dropped datagrams and the flags.
+		dropped bool
+	}{
+		{name: "pcap", writer: func(b *bytes.Buffer) RecordWriter { w, _ := NewPcapWriter(b); return w }},
+		{name: "pcapng", writer: func(b *bytes.Buffer) RecordWriter { w, _ := NewPcapngWriter(b); return w }, dropped: true},
+	}
+
+	for _, subTest := range tests {
+		var buf bytes.Buffer
+		w := subTest.writer(&buf)
+		var want []Record
+		for _, r := range records() {
+			assert.Nil(t, w.WriteRecord(r), subTest.name)
+			if !subTest.dropped {
+				if r.Dropped {
+					continue
+				}
+				r.Delay = 0
+			}
+			want = append(want, r)
+		}
+
+		reader, err := NewReader(&buf)
+		if !assert.Nil(t, err, subTest.name) {
+			continue
+		}
+		got, err := reader.ReadAll()
+		assert.Nil(t, err, subTest.name)
+		if assert.Len(t, got, len(want), subTest.name) {
+			for i := range want {
+				assert.True(t, want[i].Time.Equal(got[i].Time), subTest.name)
+				got[i].Time = want[i].Time
+			}
+			assert.Equal(t, want, got, subTest.name)
+		}
+	}
+}
+
+func TestReadLinkTypes(t *testing.T) {
+	ip := packet(netip.MustParseAddrPort("10.0.0.2:4000"), netip.MustParseAddrPort("10.0.0.1:53"), []byte("ping"), 1)
+	ethernet := append(make([]byte, 12), 0x08, 0x00)
+	vlan := append(make([]byte, 12), 0x81, 0x00, 0, 1, 0x08, 0x00)
+	arp := append(make([]byte, 12), 0x08, 0x06)
+	tests := []struct {
+		name     string
+		linkType uint32
+		order    binary.ByteOrder
+		micro    bool
+		frame    []byte
+		found    bool
+	}{
+		{name: "raw", linkType: linkTypeRaw, order: binary.LittleEndian, frame: ip, found: true},
+		{name: "big endian microseconds", linkType: linkTypeRaw, order: binary.BigEndian, micro: true, frame: ip, found: true},
+		{name: "ethernet", linkType: linkTypeEthernet, order: binary.LittleEndian, frame: append(ethernet, ip...), found: true},
+		{name: "ethernet vlan", linkType: linkTypeEthernet, order: binary.LittleEndian, frame: append(vlan, ip...), found: true},
+		{name: "ethernet arp", linkType: linkTypeEthernet, order: binary.LittleEndian, frame: append(arp, ip...)},
+		{name: "loopback", linkType: linkTypeNull, order: binary.LittleEndian, frame: append([]byte{2, 0, 0, 0}, ip...), found: true},
+		{name: "linux cooked", linkType: linkTypeSLL, order: binary.LittleEndian, frame: append(make([]byte, 16), ip...), found: true},
+		{name: "unknown link type", linkType: 147, order: binary.LittleEndian, frame: ip},
+		{name: "truncated ip", linkType: linkTypeRaw, order: binary.LittleEndian, frame: ip[:24]},
+	}
+
+	for _, subTest := range tests {
+		var buf bytes.Buffer
+		header := make([]byte, 24)
+		magic := uint32(pcapMagicNano)
+		if subTest.micro {
+			magic = pcapMagicMicro
+		}
+		subTest.order.PutUint32(header, magic)
+		subTest.order.PutUint32(header[20:], subTest.linkType)
+		buf.Write(header)
+		rec := make([]byte, 16)
+		subTest.order.PutUint32(rec, 5)
+		subTest.order.PutUint32(rec[4:], 7)
+		subTest.order.PutUint32(rec[8:], uint32(len(subTest.frame)))
+		subTest.order.PutUint32(rec[12:], uint32(len(subTest.frame)))
+		buf.Write(rec)
+		buf.Write(subTest.frame)
+
+		reader, err := NewReader(&buf)
+		if !assert.Nil(t, err, subTest.name) {
+			continue
+		}
+		got, err := reader.ReadAll()
+		assert.Nil(t, err, subTest.name)
+		if !subTest.found {
+			assert.Empty(t, got, subTest.name)
+			continue
+		}
+		if assert.Len(t, got, 1, subTest.name) {
+			assert.Equal(t, []byte("ping"), got[0].Data, subTest.name)
+			assert.Equal(t, netip.MustParseAddrPort("10.0.0.2:4000"), got[0].Src, subTest.name)
+			nsec := 7
+			if subTest.micro {
+				nsec = 7000
+			}
+			assert.Equal(t, time.Unix(5, int64(nsec)), got[0].Time, subTest.name)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewPcapWriter(&buf)
+	w.WriteRecord(records()[0])
+	complete := buf.Bytes()
+
+	_, err := NewReader(bytes.NewReader([]byte("Sid:1|Uid:0|Msg:0|PId:0")))
+	assert.ErrorIs(t, err, ErrFormat)
+	reader, err := NewReader(bytes.NewReader(complete[:len(complete)-3]))
+	if assert.Nil(t, err) {
+		_, err = reader.Next()
+		assert.ErrorIs(t, err, ErrTruncated)
+	}
+}
@@ -1 +1,182 @@
 package dtp
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+)
+
+// maxRetries bounds the number of RTY answers a client follows during one handshake.
+const maxRetries = 3
+
+// Dial runs the client side of the handshake (REQ → OPN → ACK → ALI) over conn and agrees the
+// session keys with the server. The REQ carries a random initial id, the session takes the id the
+// server issues in its answer. A RTY answer is followed transparently by repeating the
+// REQ with the received token, a proof-of-work challenge in the RTY is solved within opts.PowTimeBudget.
+//
+// With opts.ResumeTicket the REQ carries the ticket and opts.EarlyData, and a server accepting the
+// ticket answers with ALI right away (REQ → ALI).
+func Dial(conn net.PacketConn, raddr net.Addr, opts Options) (*DTPConnection, error) {
+	opts = opts.withDefaults()
+	initialID, err := NewConnectionID(opts.ConnectionIDLength)
+	if err != nil {
+		return nil, err
+	}
+	session := newSession(initialID, opts.Clock)
+	session.initialID = initialID
+	session.remoteAddr = raddr
+	if opts.OnStateChange != nil {
+		session.OnStateChange(opts.OnStateChange)
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	session.keyShare = private.PublicKey().Bytes()
+
+	hello := handshakeParams{KeyShare: session.keyShare}
+	ticket := opts.ResumeTicket
+	if ticket != nil && opts.Clock.Now().After(ticket.ExpiresAt) {
+		ticket = nil
+	}
+	if ticket != nil {
+		hello.Ticket = ticket.Ticket
+		if len(opts.EarlyData) > 0 {
+			hello.EarlyData, err = sealEarlyData(ticket.Secret, initialID, session.keyShare, opts.EarlyData)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	request := hello.encode()
+	next := Package{SessionID: initialID, MSgCode: codec.REQ, Payload: request, PayloadLength: len(request)}
+	attempts, retries := 0, 0
+	buf := make([]byte, maxPackageSize)
+	session.transition(HSK)
+	for {
+		if _, err := conn.WriteTo(codec.Encode(next), raddr); err != nil {
+			return nil, err
+		}
+		session.lastSend = opts.Clock.Now()
+
+		p, err := readHandshakePackage(conn, buf, raddr, session.id, opts.Clock.Now().Add(opts.HandshakeTimeout))
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				attempts++
+				if attempts > opts.HandshakeRetries {
+					return nil, ErrHandshakeTimeout
+				}
+				continue
+			}
+			return nil, err
+		}
+		session.touch(opts.Clock.Now())
+		if p.MSgCode == codec.OPN || p.MSgCode == codec.ALI {
+			session.sampleRTT(opts.Clock.Now().Sub(session.lastSend))
+		}
+
+		switch p.MSgCode {
+		case codec.RTY:
+			retries++
+			if retries > maxRetries {
+				return nil, ErrHandshakeTimeout
+			}
+			params, err := decodeHandshakeParams(p.Payload)
+			if err != nil {
+				return nil, err
+			}
+			echo := hello
+			echo.Token = params.Token
+			if params.Difficulty > 0 {
+				if params.Difficulty > opts.MaxPowDifficulty {
+					return nil, &PowError{Difficulty: params.Difficulty}
+				}
+				// The budget is CPU time, it is taken from the wall clock even in a simulation.
+				solution, ok := solvePow(powChallenge(params.Token, initialID, hello.KeyShare), params.Difficulty, time.Now().Add(opts.PowTimeBudget))
+				if !ok {
+					return nil, &PowError{Difficulty: params.Difficulty, TimedOut: true}
+				}
+				echo.Solution = solution
+			}
+			next.Payload = echo.encode()
+			next.PayloadLength = len(next.Payload)
+		case codec.OPN:
+			if session.keys != nil {
+				continue
+			}
+			params, err := decodeHandshakeParams(p.Payload)
+			if err != nil {
+				return nil, err
+			}
+			if len(params.KeyShare) == 0 {
+				return nil, ErrNoKeys
+			}
+			session.keys, err = agreeSessionKeys(private, params.KeyShare, initialID, true, opts, nil)
+			if err != nil {
+				return nil, err
+			}
+			session.assignID(params.ConnectionID)
+			session.transition(OPN)
+			next = Package{SessionID: session.id, MSgCode: codec.ACK}
+		case codec.ALI:
+			if session.keys == nil {
+				// Only a resumption is answered with ALI before the keys are agreed.
+				params, err := decodeHandshakeParams(p.Payload)
+				if ticket == nil || err != nil || len(params.KeyShare) == 0 {
+					continue
+				}
+				session.keys, err = agreeSessionKeys(private, params.KeyShare, initialID, true, opts, ticket.Secret)
+				if err != nil {
+					return nil, err
+				}
+				session.assignID(params.ConnectionID)
+				session.resumedFrom = ticket.SessionID
+				session.resumed = true
+			}
+			session.transition(ALI)
+			conn.SetReadDeadline(time.Time{})
+			c := newClientConnection(conn, session)
+			if ticket != nil && !session.resumed && len(opts.EarlyData) > 0 {
+				// The server fell back to the full handshake and never saw the early data.
+				if err := c.WriteMessage(&Message{Data: opts.EarlyData}); err != nil {
+					return nil, err
+				}
+			}
+			return c, nil
+		case codec.ERR:
+			session.transition(ERR)
+			params, err := decodeHandshakeParams(p.Payload)
+			if err != nil {
+				return nil, ErrConnectionRefused
+			}
+			return nil, &RejectError{Reason: params.Reason}
+		}
+	}
+}
+
+// readHandshakePackage waits for the next package of the session from raddr, everything else is dropped.
+func readHandshakePackage(conn net.PacketConn, buf []byte, raddr net.Addr, sessionId int, deadline time.Time) (Package, error) {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return Package{}, err
+	}
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return Package{}, err
+		}
+		if !sameAddr(addr, raddr) {
+			continue
+		}
+		p, err := codec.Decode(buf[:n])
+		if err != nil || p.SessionID != sessionId {
+			continue
+		}
+		return p, nil
+	}
+}
@@ -0,0 +1,34 @@
+package dtp
+
+import "time"
+
+// Clock is the time source of servers, clients and their sessions: timestamps, idle timeouts,
+// handshake deadlines and the reaper run on it. A simulation passes a virtual clock, such as the
+// udpsim.VirtualClock of its network, so that its timeouts pass without waiting.
+//
+// Read deadlines are set on the net.PacketConn in the time of the clock, the connection has to run on
+// the same clock.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f once d has passed, f may run in any goroutine and must not block. stop
+	// cancels the call and reports whether it was still pending.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// nowFunc returns the Now of clock, time.Now if it is nil.
+func nowFunc(clock Clock) func() time.Time {
+	if clock == nil {
+		return time.Now
+	}
+	return clock.Now
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
@@ -36,18 +36,6 @@ const (
 	numFields
 )
 
-const (
-	REQ State = iota
-	OPN
-	ALI
-	CLD
-	ACK
-	RTY
-	ERR
-)
-
-type State int
-
 type Package struct {
 	SessionID     int
 	UserID        int
@@ -116,6 +104,9 @@ func Decode(b []byte) (Package, error) {
 			if err != nil {
 				return out, fmt.Errorf("Msg: %w", err)
 			}
+			if !State(n).valid() {
+				return out, fmt.Errorf("Msg: %d is no message code", n)
+			}
 			out.MSgCode = State(n)
 		case fieldPId:
 			n, err := strconv.Atoi(raw)
@@ -0,0 +1,38 @@
+package codec
+
+import "fmt"
+
+// State is the message code of a package. The states of a session are a type of their own in the
+// dtp package.
+type State int
+
+const (
+	REQ State = iota
+	OPN
+	ALI
+	CLD
+	ACK
+	RTY
+	ERR
+	TKT
+	PCH
+	PRS
+)
+
+var stateNames = [...]string{REQ: "REQ", OPN: "OPN", ALI: "ALI", CLD: "CLD", ACK: "ACK", RTY: "RTY", ERR: "ERR", TKT: "TKT", PCH: "PCH", PRS: "PRS"}
+
+func (s State) String() string {
+	if s.valid() {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// valid reports whether s is a known message code.
+func (s State) valid() bool {
+	return s >= REQ && s <= PRS
+}
@@ -0,0 +1,50 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		err   bool
+	}{
+		{name: "request", state: REQ},
+		{name: "path response", state: PRS},
+		{name: "past the last code", state: PRS + 1, err: true},
+		{name: "unknown", state: 42, err: true},
+		{name: "negative", state: -1, err: true},
+	}
+
+	for _, subTest := range tests {
+		p, err := Decode(Encode(Package{SessionID: 7, MSgCode: subTest.state}))
+		if subTest.err {
+			assert.Error(t, err, subTest.name)
+			continue
+		}
+		assert.NoError(t, err, subTest.name)
+		assert.Equal(t, subTest.state, p.MSgCode, subTest.name)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		want  string
+	}{
+		{name: "wire code", state: ALI, want: "ALI"},
+		{name: "last code", state: PRS, want: "PRS"},
+		{name: "unknown", state: 42, want: "State(42)"},
+	}
+
+	for _, subTest := range tests {
+		assert.Equal(t, subTest.want, subTest.state.String(), subTest.name)
+		text, err := subTest.state.MarshalText()
+		assert.NoError(t, err, subTest.name)
+		assert.Equal(t, subTest.want, string(text), subTest.name)
+	}
+}
@@ -1,6 +1,20 @@
 package dtp
 
-import "net"
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+)
+
+// maxMessageSize is the largest message that is sent in a single package.
+const maxMessageSize = 1024
+
+// inboxSize is the number of packages a server side connection buffers for ReadMessage.
+const inboxSize = 64
 
 type Conn interface {
 	ReadMessage() (*Message, error)
@@ -8,10 +22,22 @@ type Conn interface {
 	Close() error
 }
 
+// DTPConnection is one end of an established session. On the client it owns the reading side of the
+// packet connection passed to Dial, on the server it is fed by the Server that accepted it.
 type DTPConnection struct {
-	conn           *net.UDPConn
-	dtpReader      Reader
-	sessionHandler SessionHandler
+	conn    net.PacketConn
+	connMux sync.Mutex
+	session *Session
+	server  *Server
+	inbox   chan Package
+	// pending holds messages that arrived before the connection existed, the early data of a resumption.
+	pending   []*Message
+	ticket    *SessionTicket
+	ticketMux sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+	// closeErr is returned by ReadMessage once closed, see terminate.
+	closeErr error
 }
 
 func NewDTP() (Conn, error) {
@@ -19,29 +45,233 @@ func NewDTP() (Conn, error) {
 	return &DTPConnection{}, nil
 }
 
-func (c DTPConnection) ReadMessage() (*Message, error) {
+func newClientConnection(conn net.PacketConn, session *Session) *DTPConnection {
+	c := &DTPConnection{conn: conn, session: session, closed: make(chan struct{}), closeErr: ErrClosed}
+	session.setConn(c)
+	return c
+}
 
-	var msg *Message
-	for !c.dtpReader.Done() {
-		buffer := make([]byte, 1024)
-		n, err := c.conn.Read(buffer)
+func newServerConnection(server *Server, session *Session) *DTPConnection {
+	c := &DTPConnection{session: session, server: server, inbox: make(chan Package, inboxSize), closed: make(chan struct{}), closeErr: ErrClosed}
+	session.setConn(c)
+	return c
+}
+
+// Session returns the session the connection belongs to.
+func (c *DTPConnection) Session() *Session {
+	return c.session
+}
+
+// Ticket returns the latest session ticket the server issued, or nil. It can be passed to Dial in
+// Options.ResumeTicket to resume the session later. Tickets are processed by ReadMessage.
+func (c *DTPConnection) Ticket() *SessionTicket {
+	defer c.ticketMux.Unlock()
+	c.ticketMux.Lock()
+	return c.ticket
+}
+
+// ReadMessage blocks until the next message of the peer arrives. It returns io.EOF once the peer closed the session.
+func (c *DTPConnection) ReadMessage() (*Message, error) {
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		msg.attrs = c.session.Attributes()
+		return msg, nil
+	}
+	for {
+		p, err := c.receive()
 		if err != nil {
 			return nil, err
 		}
+		switch p.MSgCode {
+		case codec.ALI:
+			// An empty ALI repeats the handshake or keeps the session alive.
+			if len(p.Payload) == 0 || c.session.keys == nil {
+				continue
+			}
+			// On the server the Server opened the payload already, a package is only opened once.
+			data := p.Payload
+			if c.server == nil {
+				pn := uint64(p.PackedID)
+				var err error
+				if data, err = c.session.keys.open(pn, dataAAD(p.SessionID, pn), p.Payload); err != nil {
+					continue
+				}
+			}
+			msg := &Message{Session: p.SessionID, DataLength: len(data), Data: data, attrs: c.session.Attributes()}
+			if udpAddr, ok := c.session.RemoteAddr().(*net.UDPAddr); ok {
+				msg.Ip = udpAddr
+			}
+			return msg, nil
+		case codec.PCH:
+			// The server validates our new address, answer from it.
+			if c.server == nil {
+				if data, ok := authenticated(c.session, p); ok {
+					if res, err := sealPath(c.session, codec.PRS, data); err == nil {
+						c.send(res)
+					}
+				}
+			}
+		case codec.TKT:
+			if c.server == nil && c.session.keys != nil {
+				c.storeTicket(p)
+			}
+		case codec.CLD:
+			// On the server the Server already closed the session when it delivered the CLD.
+			if c.server == nil {
+				c.session.transition(CLD)
+			}
+			return nil, io.EOF
+		}
+	}
+}
 
-		msg, err = c.dtpReader.Read(buffer[:n])
-		if err != nil {
-			return nil, err
+// WriteMessage seals the data of msg with the session keys and sends it in a single package.
+func (c *DTPConnection) WriteMessage(msg *Message) error {
+	if len(msg.Data) > maxMessageSize {
+		return ErrMessageTooLarge
+	}
+	if c.session.keys == nil {
+		return ErrNoKeys
+	}
+	pn := c.session.sendSeq.Add(1) - 1
+	sealed, err := c.session.keys.seal(pn, dataAAD(c.session.id, pn), msg.Data)
+	if err != nil {
+		return err
+	}
+	return c.send(Package{SessionID: c.session.id, MSgCode: codec.ALI, PackedID: int(pn), PayloadLength: len(sealed), Payload: sealed})
+}
+
+// UpdateKeys moves the session to the next key phase. The peer follows with the first package it
+// receives. It fails with ErrKeyUpdatePending until the peer confirmed the previous update.
+func (c *DTPConnection) UpdateKeys() error {
+	if c.session.keys == nil {
+		return ErrNoKeys
+	}
+	return c.session.keys.update()
+}
+
+// Close announces the end of the session to the peer. On the client the packet connection itself
+// stays open, it belongs to the caller of Dial.
+func (c *DTPConnection) Close() error {
+	if c.session == nil {
+		return nil
+	}
+	var err error
+	c.closeOnce.Do(func() {
+		// A session the peer closed already is not announced again.
+		if c.session.transition(CLS) == nil {
+			if c.server != nil {
+				c.server.issueTicket(c.session)
+			}
+			err = c.send(Package{SessionID: c.session.id, MSgCode: codec.CLD})
+			c.session.transition(CLD)
 		}
+		if c.server != nil {
+			c.server.sessions.RemoveSession(c.session.id)
+		}
+		close(c.closed)
+	})
+	return err
+}
+
+// terminate closes the connection of a session the server evicted and tells the peer about it.
+// ReadMessage returns err from then on.
+func (c *DTPConnection) terminate(err error) {
+	c.closeOnce.Do(func() {
+		c.closeErr = err
+		c.send(Package{SessionID: c.session.id, MSgCode: codec.CLD})
+		close(c.closed)
+	})
+}
+
+func (c *DTPConnection) storeTicket(p Package) {
+	pn := uint64(p.PackedID)
+	payload, err := c.session.keys.open(pn, dataAAD(p.SessionID, pn), p.Payload)
+	if err != nil {
+		return
+	}
+	params, err := decodeHandshakeParams(payload)
+	if err != nil || len(params.Ticket) == 0 {
+		return
 	}
+	ticket := &SessionTicket{
+		SessionID: c.session.id,
+		Ticket:    params.Ticket,
+		Secret:    c.session.keys.resumption,
+		ExpiresAt: c.session.now().Add(time.Duration(params.Lifetime) * time.Second),
+	}
+	defer c.ticketMux.Unlock()
+	c.ticketMux.Lock()
+	c.ticket = ticket
+}
+
+func (c *DTPConnection) send(p Package) error {
+	if c.server != nil {
+		return c.server.send(c.session, p, c.session.RemoteAddr())
+	}
+	n, err := c.packetConn().WriteTo(codec.Encode(p), c.session.RemoteAddr())
+	if err == nil {
+		c.session.sent(n)
+	}
+	return err
+}
 
-	return msg, nil
+func (c *DTPConnection) packetConn() net.PacketConn {
+	defer c.connMux.Unlock()
+	c.connMux.Lock()
+	return c.conn
 }
 
-func (c DTPConnection) WriteMessage(*Message) error {
-	return nil
+// deliver hands a package received by the server to the connection. Packages are dropped if
+// nobody reads them.
+func (c *DTPConnection) deliver(p Package) {
+	select {
+	case c.inbox <- p:
+	default:
+	}
+}
+
+// receive returns the next package of the session.
+func (c *DTPConnection) receive() (Package, error) {
+	if c.inbox != nil {
+		select {
+		case p := <-c.inbox:
+			return p, nil
+		case <-c.closed:
+			return Package{}, c.closeErr
+		}
+	}
+
+	buf := make([]byte, maxPackageSize)
+	for {
+		select {
+		case <-c.closed:
+			return Package{}, c.closeErr
+		default:
+		}
+		conn := c.packetConn()
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if conn != c.packetConn() {
+				// Migrate switched the packet connection under us.
+				continue
+			}
+			return Package{}, err
+		}
+		if !sameAddr(addr, c.session.RemoteAddr()) {
+			continue
+		}
+		p, err := codec.Decode(buf[:n])
+		if err != nil || p.SessionID != c.session.id {
+			continue
+		}
+		c.session.received(n)
+		return p, nil
+	}
 }
 
-func (dtpC DTPConnection) Close() error {
-	return nil
+// dataAAD authenticates the header fields of a data package along with its payload.
+func dataAAD(sessionId int, pn uint64) []byte {
+	return []byte(strconv.Itoa(sessionId) + "|" + strconv.FormatUint(pn, 10))
 }
@@ -0,0 +1,119 @@
+package dtp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// Session ids are connection ids chosen by the server. The REQ carries a random initial id picked by
+// the client, the server answers with the id of the new session in the OPN (or in the ALI of a
+// resumption) and all later packages use it. Ids are drawn from crypto/rand, so an off-path attacker
+// cannot guess the id of a session to inject packages into it; packages for ids the server does not
+// know are dropped and counted in Stats.UnknownSessions.
+//
+// An id is Length bytes long, at most 8 with the top bit cleared so that it fits a positive int.
+// Zero is never issued.
+const (
+	minConnectionIDLength     = 4
+	maxConnectionIDLength     = 8
+	defaultConnectionIDLength = 8
+	// maxIDAttempts bounds the search for an id that is not in use yet.
+	maxIDAttempts = 16
+)
+
+// errIDSpaceExhausted is returned by Server.newID if every id it drew was in use.
+var errIDSpaceExhausted = errors.New("dtp: no free session id")
+
+// IDGenerator issues the ids of new sessions on the server.
+type IDGenerator interface {
+	NewID() (int, error)
+}
+
+// RandomIDs issues random ids of Length bytes, the default length if zero.
+type RandomIDs struct {
+	Length int
+}
+
+func (r RandomIDs) NewID() (int, error) {
+	return NewConnectionID(r.Length)
+}
+
+// RoutingIDs issues random ids that carry the number of the backend in their upper BackendBits bits,
+// so that a load balancer in front of several servers can route every package by its id alone, see
+// BackendOf. The backend number is not encrypted, an observer learns it as well.
+type RoutingIDs struct {
+	Backend     int
+	BackendBits int
+	Length      int
+}
+
+func (r RoutingIDs) NewID() (int, error) {
+	width, err := idWidth(r.Length)
+	if err != nil {
+		return 0, err
+	}
+	if r.BackendBits <= 0 || r.BackendBits >= width || r.Backend < 0 || r.Backend >= 1<<r.BackendBits {
+		return 0, ErrConnectionIDLength
+	}
+	shift := width - r.BackendBits
+	for {
+		random, err := NewConnectionID(r.Length)
+		if err != nil {
+			return 0, err
+		}
+		if id := r.Backend<<shift | random&(1<<shift-1); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// BackendOf returns the backend an id issued by RoutingIDs with the same length and bits belongs to.
+func (r RoutingIDs) BackendOf(id int) int {
+	width, err := idWidth(r.Length)
+	if err != nil || r.BackendBits <= 0 || r.BackendBits >= width {
+		return 0
+	}
+	return id >> (width - r.BackendBits) & (1<<r.BackendBits - 1)
+}
+
+// NewConnectionID returns a random, non-zero id of length bytes, the default length if zero.
+func NewConnectionID(length int) (int, error) {
+	if length == 0 {
+		length = defaultConnectionIDLength
+	}
+	if _, err := idWidth(length); err != nil {
+		return 0, err
+	}
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[8-length:]); err != nil {
+			return 0, err
+		}
+		b[0] &= 0x7f
+		if id := int(binary.BigEndian.Uint64(b[:])); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// idWidth returns the number of usable bits of an id of length bytes.
+func idWidth(length int) (int, error) {
+	if length == 0 {
+		length = defaultConnectionIDLength
+	}
+	if length < minConnectionIDLength || length > maxConnectionIDLength {
+		return 0, ErrConnectionIDLength
+	}
+	if length == maxConnectionIDLength {
+		return 8*length - 1, nil
+	}
+	return 8 * length, nil
+}
+
+// assignID switches a client session to the id the server issued, servers that issue none keep the initial id.
+func (sh *Session) assignID(id int) {
+	if id != 0 {
+		sh.id = id
+	}
+}
@@ -0,0 +1,110 @@
+package dtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConnectionID(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		max    int
+		err    error
+	}{
+		{name: "default length", length: 0, max: 1<<63 - 1},
+		{name: "shortest", length: 4, max: 1<<32 - 1},
+		{name: "six bytes", length: 6, max: 1<<48 - 1},
+		{name: "longest", length: 8, max: 1<<63 - 1},
+		{name: "too short", length: 3, err: ErrConnectionIDLength},
+		{name: "too long", length: 9, err: ErrConnectionIDLength},
+	}
+
+	for _, subTest := range tests {
+		seen := map[int]bool{}
+		for i := 0; i < 100; i++ {
+			id, err := NewConnectionID(subTest.length)
+			if subTest.err != nil {
+				assert.ErrorIs(t, err, subTest.err, subTest.name)
+				break
+			}
+			assert.Nil(t, err, subTest.name)
+			assert.Greater(t, id, 0, subTest.name)
+			assert.LessOrEqual(t, id, subTest.max, subTest.name)
+			seen[id] = true
+		}
+		if subTest.err == nil {
+			assert.Len(t, seen, 100, "no collisions: "+subTest.name)
+		}
+	}
+}
+
+func TestRoutingIDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator RoutingIDs
+		err       error
+	}{
+		{name: "first backend", generator: RoutingIDs{Backend: 0, BackendBits: 4}},
+		{name: "last backend", generator: RoutingIDs{Backend: 15, BackendBits: 4}},
+		{name: "short ids", generator: RoutingIDs{Backend: 200, BackendBits: 8, Length: 4}},
+		{name: "backend does not fit", generator: RoutingIDs{Backend: 16, BackendBits: 4}, err: ErrConnectionIDLength},
+		{name: "no random bits left", generator: RoutingIDs{Backend: 1, BackendBits: 32, Length: 4}, err: ErrConnectionIDLength},
+	}
+
+	for _, subTest := range tests {
+		for i := 0; i < 20; i++ {
+			id, err := subTest.generator.NewID()
+			if subTest.err != nil {
+				assert.ErrorIs(t, err, subTest.err, subTest.name)
+				break
+			}
+			assert.Nil(t, err, subTest.name)
+			assert.Greater(t, id, 0, subTest.name)
+			assert.Equal(t, subTest.generator.Backend, subTest.generator.BackendOf(id), subTest.name)
+		}
+	}
+}
+
+// fixedID issues the same id over and over.
+type fixedID int
+
+func (f fixedID) NewID() (int, error) {
+	return int(f), nil
+}
+
+func TestIDSpaceExhausted(t *testing.T) {
+	server := startServer(t, Options{IDGenerator: fixedID(42)})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 42, client.Session().ID())
+
+	_, err = Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	var rejectErr *RejectError
+	if assert.ErrorAs(t, err, &rejectErr) {
+		assert.Equal(t, RejectTooManySessions, rejectErr.Reason)
+	}
+	assert.Equal(t, uint64(1), server.Stats().SessionsRejected)
+	assert.Equal(t, 1, server.Sessions().Size())
+}
+
+func TestGuessedSessionID(t *testing.T) {
+	server := startServer(t, Options{IDGenerator: RoutingIDs{Backend: 3, BackendBits: 2}})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	id := client.Session().ID()
+	assert.NotEqual(t, client.Session().initialID, id, "the server issued its own id")
+	assert.Equal(t, 3, RoutingIDs{BackendBits: 2}.BackendOf(id))
+
+	attacker := listenClient(t)
+	for guess := 1; guess <= 10; guess++ {
+		cld := codec.Encode(codec.Package{SessionID: guess, MSgCode: codec.CLD})
+		_, err := attacker.WriteTo(cld, server.conn.LocalAddr())
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool { return server.Stats().UnknownSessions == 10 }, time.Second, 10*time.Millisecond)
+	assert.True(t, server.Sessions().HasSession(id))
+}
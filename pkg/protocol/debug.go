@@ -0,0 +1,63 @@
+package dtp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// NewDebugHandler serves the sessions of sh as JSON:
+//
+//	GET    /sessions       all sessions
+//	GET    /sessions/{id}  a single session
+//	DELETE /sessions/{id}  closes the session
+//
+// It has no authentication of its own and can close any session, mount it on a local or otherwise
+// protected listener only, e.g. under a prefix with http.StripPrefix.
+func NewDebugHandler(sh *SessionHandler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sh.List())
+	})
+	mux.HandleFunc("GET /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		info, ok := sh.Info(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, ErrUnknownSession)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := sh.CloseSession(id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrUnknownSession) {
+				status = http.StatusNotFound
+			}
+			writeJSONError(w, status, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+
+	dtp "github.com/WhilecodingDoLearn/dtp/pkg/protocol"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+)
+
+// frameBufferSize is the most data a session of a ConnectionHandler may announce in its REQ.
+const frameBufferSize = 1024
+
+// FrameBuffer collects the frames of the data of a session.
+type FrameBuffer interface {
+	Read(p codec.Package) error
+	Flush()
+	Size() int
+}
+
+// frameBuffer places every frame at its offset, frames may arrive in any order and more than once.
+type frameBuffer struct {
+	frames   [frameBufferSize]byte
+	received int
+}
+
+// NewFrameBuffer returns an empty buffer for frameBufferSize bytes.
+func NewFrameBuffer() FrameBuffer {
+	return &frameBuffer{}
+}
+
+// Read copies the payload of p to the bytes FrameBegin to FrameEnd, both included.
+func (b *frameBuffer) Read(p codec.Package) error {
+	if p.FrameBegin < 0 || p.FrameBegin >= len(b.frames) {
+		return fmt.Errorf("frame begin index %d out of range [0:%d]", p.FrameBegin, len(b.frames)-1)
+	}
+	if p.FrameEnd < 0 || p.FrameEnd >= len(b.frames) {
+		return fmt.Errorf("frame end index %d out of range [0:%d]", p.FrameEnd, len(b.frames)-1)
+	}
+	if p.FrameBegin > p.FrameEnd {
+		return fmt.Errorf("invalid frame range: begin %d > end %d", p.FrameBegin, p.FrameEnd)
+	}
+	expected := p.FrameEnd - p.FrameBegin + 1
+	if len(p.Payload) != expected {
+		return fmt.Errorf("payload length mismatch: got %d bytes, expected %d", len(p.Payload), expected)
+	}
+	copy(b.frames[p.FrameBegin:p.FrameEnd+1], p.Payload)
+	b.received += expected
+	return nil
+}
+
+// Flush drops what the buffer holds.
+func (b *frameBuffer) Flush() {
+	b.frames = [frameBufferSize]byte{}
+	b.received = 0
+}
+
+func (b *frameBuffer) Size() int {
+	return len(b.frames)
+}
+
+// ConnectionHandler is the server side of a single session of the dev server as a state machine
+// without I/O: Handle takes the packages of the client and returns the answers. It runs a plain
+// handshake, REQ → OPN, ACK → ALI, without keys, and treats ALI as frames of plain data; dtp.Server
+// runs the real protocol.
+//
+// The REQ announces the length of the data in PayloadLength, the ALI packages carry it in frames that
+// the server acknowledges with an ACK each.
+type ConnectionHandler struct {
+	state    dtp.State
+	buffer   FrameBuffer
+	dataSize int
+}
+
+// NewConnectionHandler handles the packages of a new session.
+func NewConnectionHandler() *ConnectionHandler {
+	return &ConnectionHandler{state: dtp.REQ}
+}
+
+func (ch *ConnectionHandler) State() dtp.State {
+	return ch.state
+}
+
+// DataSize returns the length of the data the REQ announced.
+func (ch *ConnectionHandler) DataSize() int {
+	return ch.dataSize
+}
+
+// Buffer returns the frames received so far, nil until the session is established.
+func (ch *ConnectionHandler) Buffer() FrameBuffer {
+	return ch.buffer
+}
+
+// Handle moves the session on with the package p of the client. It returns the answer and whether it
+// has to be sent:
+//
+//   - REQ opens the session with OPN, or fails it with ERR if the announced data does not fit into a
+//     frame buffer. A repeated REQ repeats the answer, whose first copy may have been lost. A failed
+//     session stays failed, ERR only leads to CLD; the client starts over with a new session.
+//   - ACK establishes an opened session with ALI, a repeated ACK repeats the ALI.
+//   - ALI carries a frame of the data, it is acknowledged with ACK. A frame outside of the announced
+//     data fails the session with ERR.
+//   - ERR fails the session and CLD closes it, neither is answered.
+//
+// Packages that do not fit the state of the session are dropped.
+func (ch *ConnectionHandler) Handle(p codec.Package) (codec.Package, bool) {
+	res := codec.Package{SessionID: p.SessionID, UserID: p.UserID, PackedID: p.PackedID, FrameBegin: p.FrameBegin, FrameEnd: p.FrameEnd, PayloadLength: p.PayloadLength, Payload: []byte{}}
+	switch p.MSgCode {
+	case codec.REQ:
+		switch ch.state {
+		case dtp.REQ:
+			if p.PayloadLength < 0 || p.PayloadLength >= frameBufferSize {
+				return ch.fail(res)
+			}
+			ch.dataSize = p.PayloadLength
+			ch.state = dtp.OPN
+			res.MSgCode = codec.OPN
+			return res, true
+		case dtp.OPN:
+			res.MSgCode = codec.OPN
+			return res, true
+		case dtp.ERR:
+			res.MSgCode = codec.ERR
+			return res, true
+		}
+	case codec.ACK:
+		switch ch.state {
+		case dtp.OPN:
+			ch.buffer = NewFrameBuffer()
+			ch.state = dtp.ALI
+			fallthrough
+		case dtp.ALI:
+			res.MSgCode = codec.ALI
+			return res, true
+		}
+	case codec.ALI:
+		if ch.state != dtp.ALI {
+			break
+		}
+		if p.FrameEnd >= ch.dataSize || ch.buffer.Read(p) != nil {
+			return ch.fail(res)
+		}
+		res.MSgCode = codec.ACK
+		return res, true
+	case codec.ERR:
+		if ch.state != dtp.CLD {
+			ch.state = dtp.ERR
+		}
+		ch.close()
+	case codec.CLD:
+		ch.close()
+	}
+	return codec.Package{SessionID: p.SessionID}, false
+}
+
+// fail moves the session to ERR and answers with ERR.
+func (ch *ConnectionHandler) fail(res codec.Package) (codec.Package, bool) {
+	ch.state = dtp.ERR
+	res.MSgCode = codec.ERR
+	return res, true
+}
+
+// close moves the session to CLD and drops its data.
+func (ch *ConnectionHandler) close() {
+	ch.state = dtp.CLD
+	if ch.buffer != nil {
+		ch.buffer.Flush()
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	dtp "github.com/WhilecodingDoLearn/dtp/pkg/protocol"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandle(t *testing.T) {
+	var (
+		req     = codec.Package{SessionID: 1234, UserID: 111, MSgCode: codec.REQ, PayloadLength: 8}
+		ack     = codec.Package{SessionID: 1234, UserID: 111, MSgCode: codec.ACK}
+		data    = codec.Package{SessionID: 1234, UserID: 111, MSgCode: codec.ALI, FrameBegin: 2, FrameEnd: 5, PayloadLength: 4, Payload: []byte("ABCD")}
+		opened  = []codec.Package{req}
+		alive   = []codec.Package{req, ack}
+		bigData = codec.Package{SessionID: 1234, UserID: 111, MSgCode: codec.REQ, PayloadLength: 2028}
+	)
+	tests := []struct {
+		name string
+		// path are the packages handled before p.
+		path            []codec.Package
+		p               codec.Package
+		expCode         codec.State
+		expSend         bool
+		expHandlerState dtp.State
+		expDatasize     int
+	}{
+		{name: "REQ too large payload -> ERR", p: bigData, expCode: codec.ERR, expHandlerState: dtp.ERR, expSend: true},
+		{name: "REQ connection request -> OPN", p: req, expCode: codec.OPN, expHandlerState: dtp.OPN, expSend: true, expDatasize: 8},
+		{name: "REQ repeated while open -> OPN again", path: opened, p: req, expCode: codec.OPN, expHandlerState: dtp.OPN, expSend: true, expDatasize: 8},
+		// Unlike the first version of this handler a failed session does not recover to OPN.
+		{name: "REQ after failed request -> ERR again, no recovery", path: []codec.Package{bigData}, p: req, expCode: codec.ERR, expHandlerState: dtp.ERR, expSend: true},
+		{name: "REQ while alive is dropped", path: alive, p: req, expHandlerState: dtp.ALI, expDatasize: 8},
+		{name: "ACK while open -> ALI", path: opened, p: ack, expCode: codec.ALI, expHandlerState: dtp.ALI, expSend: true, expDatasize: 8},
+		{name: "ACK repeated while alive -> ALI again", path: alive, p: ack, expCode: codec.ALI, expHandlerState: dtp.ALI, expSend: true, expDatasize: 8},
+		{name: "ACK before REQ is dropped", p: ack, expHandlerState: dtp.REQ},
+		{name: "ALI frame while alive -> ACK", path: alive, p: data, expCode: codec.ACK, expHandlerState: dtp.ALI, expSend: true, expDatasize: 8},
+		{name: "ALI frame beyond announced data -> ERR", path: alive, p: codec.Package{SessionID: 1234, MSgCode: codec.ALI, FrameBegin: 6, FrameEnd: 9, Payload: []byte("ABCD")}, expCode: codec.ERR, expHandlerState: dtp.ERR, expSend: true, expDatasize: 8},
+		{name: "ALI frame with wrong payload length -> ERR", path: alive, p: codec.Package{SessionID: 1234, MSgCode: codec.ALI, FrameBegin: 0, FrameEnd: 3, Payload: []byte("ABC")}, expCode: codec.ERR, expHandlerState: dtp.ERR, expSend: true, expDatasize: 8},
+		{name: "ALI frame while open is dropped", path: opened, p: data, expHandlerState: dtp.OPN, expDatasize: 8},
+		{name: "ERR from client fails and closes", path: alive, p: codec.Package{SessionID: 1234, MSgCode: codec.ERR}, expHandlerState: dtp.CLD, expDatasize: 8},
+		{name: "ERR after failure closes", path: []codec.Package{bigData}, p: codec.Package{SessionID: 1234, MSgCode: codec.ERR}, expHandlerState: dtp.CLD},
+		{name: "CLD closes", path: alive, p: codec.Package{SessionID: 1234, MSgCode: codec.CLD}, expHandlerState: dtp.CLD, expDatasize: 8},
+		{name: "REQ after close is dropped", path: []codec.Package{req, ack, {SessionID: 1234, MSgCode: codec.CLD}}, p: req, expHandlerState: dtp.CLD, expDatasize: 8},
+		{name: "unknown code is dropped", path: alive, p: codec.Package{SessionID: 1234, MSgCode: codec.TKT}, expHandlerState: dtp.ALI, expDatasize: 8},
+	}
+
+	for _, subTest := range tests {
+		connHandler := NewConnectionHandler()
+		for _, p := range subTest.path {
+			connHandler.Handle(p)
+		}
+		res, send := connHandler.Handle(subTest.p)
+		assert.Equal(t, subTest.expSend, send, fmt.Sprintf("name:%v - %v \n", subTest.name, "test if message should be send"))
+		if send {
+			assert.Equal(t, subTest.expCode, res.MSgCode, fmt.Sprintf("name:%v - %v \n", subTest.name, "test response code of message"))
+			assert.Equal(t, subTest.p.SessionID, res.SessionID, fmt.Sprintf("name:%v - %v \n", subTest.name, "test session of message"))
+		}
+		assert.Equal(t, subTest.expHandlerState, connHandler.State(), fmt.Sprintf("name:%v - %v \n", subTest.name, "test state of connectionHandler"))
+		assert.Equal(t, subTest.expDatasize, connHandler.DataSize(), fmt.Sprintf("name:%v - %v \n", subTest.name, "test announced data size"))
+	}
+}
+
+// TestHandleStates walks a session through the whole handshake and checks the state after every package.
+func TestHandleStates(t *testing.T) {
+	connHandler := NewConnectionHandler()
+	var states []dtp.State
+	for _, code := range []codec.State{codec.REQ, codec.ACK, codec.ALI, codec.CLD} {
+		connHandler.Handle(codec.Package{SessionID: 7, MSgCode: code, PayloadLength: 4, FrameEnd: 3, Payload: []byte("ABCD")})
+		states = append(states, connHandler.State())
+	}
+	assert.Equal(t, []dtp.State{dtp.OPN, dtp.ALI, dtp.ALI, dtp.CLD}, states)
+}
+
+func TestBuffer(t *testing.T) {
+	b := frameBuffer{}
+	payload := []byte("ABCD")
+	p := codec.Package{SessionID: 122, PackedID: 0, FrameBegin: 2, FrameEnd: 1 + len(payload), PayloadLength: len(payload), Payload: payload}
+	err := b.Read(p)
+	assert.Nil(t, err, "test for error")
+	// FrameEnd is the index of the last byte of the frame.
+	assert.Equal(t, []byte("ABCD"), b.frames[p.FrameBegin:p.FrameEnd+1])
+	assert.Equal(t, len(payload), b.received)
+
+	tests := []struct {
+		name string
+		p    codec.Package
+	}{
+		{name: "begin out of range", p: codec.Package{FrameBegin: -1, FrameEnd: 2, Payload: payload}},
+		{name: "end out of range", p: codec.Package{FrameBegin: 1021, FrameEnd: 1024, Payload: payload}},
+		{name: "begin after end", p: codec.Package{FrameBegin: 5, FrameEnd: 2, Payload: payload}},
+		{name: "payload too short", p: codec.Package{FrameBegin: 0, FrameEnd: 4, Payload: payload}},
+	}
+	for _, subTest := range tests {
+		assert.Error(t, b.Read(subTest.p), subTest.name)
+	}
+
+	b.Flush()
+	assert.Equal(t, make([]byte, 4), b.frames[2:6])
+	assert.Equal(t, 0, b.received)
+	assert.Equal(t, frameBufferSize, b.Size())
+}
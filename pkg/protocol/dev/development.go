@@ -5,139 +5,30 @@ import (
 	"net"
 	"time"
 
+	dtp "github.com/WhilecodingDoLearn/dtp/pkg/protocol"
 	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
 	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
 )
 
-const BufferSize = 1024
-
-type Buffer struct {
-	frames   [BufferSize]byte
-	size     int
-	received int
-}
-
-type FrameBuffer interface {
-	Read(b codec.Package) error
-	Flush()
-	Size() int
-}
-
-func (b *Buffer) Read(p codec.Package) error {
-	const bufferSize = len(b.frames) // 1024
-
-	if p.FrameBegin < 0 || p.FrameBegin >= bufferSize {
-		return fmt.Errorf("frame begin index %d out of range [0:%d]", p.FrameBegin, bufferSize-1)
-	}
-	if p.FrameEnd < 0 || p.FrameEnd >= bufferSize {
-		return fmt.Errorf("frame end index %d out of range [0:%d]", p.FrameEnd, bufferSize-1)
-	}
-
-	if p.FrameBegin > p.FrameEnd {
-		return fmt.Errorf("invalid frame range: begin %d > end %d", p.FrameBegin, p.FrameEnd)
-	}
-
-	expected := p.FrameEnd - p.FrameBegin + 1
-	if len(p.Payload) != expected {
-		return fmt.Errorf("payload length mismatch: got %d bytes, expected %d", len(p.Payload), expected)
-	}
-
-	// 4. Daten kopieren
-	copy(b.frames[p.FrameBegin:p.FrameEnd+1], p.Payload)
-	return nil
-}
-
-func (b *Buffer) Flush() {
-
-}
-
-func (b *Buffer) Size() int {
-	return len(b.frames)
-}
-
-func NewBuffer() FrameBuffer {
-	return &Buffer{frames: [1024]byte{}}
-}
-
-type ConnectionHandler struct {
-	state    codec.State
-	buffer   FrameBuffer
-	dataSize int
-}
-
-func handle(p codec.Package, connHandler *ConnectionHandler) (codec.Package, bool) {
-	res := codec.Package{SessionID: p.SessionID, UserID: p.UserID, PackedID: p.PackedID, FrameBegin: p.FrameBegin, FrameEnd: p.FrameEnd, PayloadLength: p.PayloadLength, Payload: []byte{}, Rma: nil}
-	send := false
-	switch p.MSgCode {
-	case codec.REQ:
-		if connHandler.state == codec.ERR {
-			res.MSgCode = codec.ERR
-			if p.PayloadLength < 1024 {
-				connHandler.dataSize = p.PayloadLength
-				res.MSgCode = codec.OPN
-				connHandler.state = codec.OPN
-			}
-			return res, true
-		}
-		if connHandler.state == codec.REQ {
-			if p.PayloadLength < 1024 {
-				connHandler.dataSize = p.PayloadLength
-				res.MSgCode = codec.OPN
-				connHandler.state = codec.OPN
-			} else {
-				res.MSgCode = codec.ERR
-				connHandler.state = codec.ERR
-			}
-			return res, true
-		}
-		if connHandler.state == codec.OPN {
-			return res, false
-		}
-	case codec.ACK:
-		if connHandler.state == codec.OPN {
-			connHandler.buffer = NewBuffer()
-			connHandler.state = codec.ALI
-			res.MSgCode = codec.ALI
-			return res, true
-		}
-	case codec.ALI:
-		if connHandler.state == codec.ALI {
-			if connHandler.buffer.Size() > 0 {
-				if connHandler.dataSize != p.PayloadLength {
-					res.MSgCode = codec.ERR
-					return res, true
-				}
-
-			}
-		}
-	case codec.ERR:
-
-	default:
-		{
-			res = codec.Package{SessionID: p.SessionID}
-		}
-	}
-
-	return res, send
-}
-
 func main() {
 	// Simulation konfigurieren
-	udpsim.Config.LossRate = 0.1 // 10% Pakete verworfen
-	udpsim.Config.MinDelay = 10 * time.Millisecond
-	udpsim.Config.MaxDelay = 100 * time.Millisecond
-	udpsim.Config.ReorderRate = 0.2 // 20% zusätzliche Verzögerung
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{
+		LossRate:    0.1, // 10% Pakete verworfen
+		MinDelay:    10 * time.Millisecond,
+		MaxDelay:    100 * time.Millisecond,
+		ReorderRate: 0.2, // 20% zusätzliche Verzögerung
+	}})
 
 	// Server starten
 	serverAddr := &udpsim.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9999}
-	server, err := udpsim.ListenUDP(serverAddr)
+	server, err := network.ListenUDP(serverAddr)
 	if err != nil {
 		panic(err)
 	}
 	defer server.Close()
 
 	go func() {
-		connHandler := ConnectionHandler{}
+		connHandlers := map[int]*ConnectionHandler{}
 
 		for {
 			readBuf := make([]byte, 1024)
@@ -153,7 +44,12 @@ func main() {
 				continue
 			}
 
-			res, send := handle(p, &connHandler)
+			connHandler, ok := connHandlers[p.SessionID]
+			if !ok {
+				connHandler = NewConnectionHandler()
+				connHandlers[p.SessionID] = connHandler
+			}
+			res, send := connHandler.Handle(p)
 
 			if send {
 				data := codec.Encode(res)
@@ -165,14 +61,18 @@ func main() {
 
 	// Client initialisieren
 	clientAddr := &udpsim.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}
-	client, err := udpsim.DialUDP(clientAddr, serverAddr)
+	client, err := network.DialUDP(clientAddr, serverAddr)
 	if err != nil {
 		panic(err)
 	}
 	defer client.Close()
 
 	// Nachricht senden und Antwort lesen
-	msg := codec.Encode(codec.Package{SessionID: 123, UserID: 222, MSgCode: codec.REQ, PackedID: 0, FrameBegin: 0, FrameEnd: 3, PayloadLength: 0, Payload: []byte{}, Rma: nil})
+	sessionId, err := dtp.NewConnectionID(0)
+	if err != nil {
+		panic(err)
+	}
+	msg := codec.Encode(codec.Package{SessionID: sessionId, UserID: 222, MSgCode: codec.REQ, PackedID: 0, FrameBegin: 0, FrameEnd: 3, PayloadLength: 0, Payload: []byte{}, Rma: nil})
 	client.Write(msg)
 	client.SetReadDeadline(time.Now().Add(10 * time.Second))
 
@@ -0,0 +1,419 @@
+package scenario
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dtp "github.com/WhilecodingDoLearn/dtp/pkg/protocol"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+)
+
+// handshakeTimeout is the virtual time the clients get to finish their handshakes.
+const handshakeTimeout = 30 * time.Second
+
+// RunOptions configure Run.
+type RunOptions struct {
+	// Capture records every datagram of the run, e.g. the hook of a capture.PcapngWriter.
+	Capture capture.Hook
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	Scenario string
+	Seed     int64
+	// Sent counts the messages the clients sent, Delivered the ones that arrived at least once.
+	Sent      int
+	Delivered int
+	// SendErrors counts messages WriteMessage refused.
+	SendErrors int
+	// Latencies are the one-way latencies of the delivered messages, in order.
+	Latencies []time.Duration
+	Sessions  []SessionResult
+	// Failures are the expectations the run did not meet.
+	Failures []string
+}
+
+// SessionResult is the fate of the session of a client.
+type SessionResult struct {
+	Client string
+	// Err is the reason the handshake failed, or why the session ended.
+	Err error
+	// Survived is set if the session was established on both ends at the end of the run.
+	Survived bool
+}
+
+// Passed reports whether the run met all expectations.
+func (r *Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// DeliveryRatio returns the share of the sent messages that arrived.
+func (r *Result) DeliveryRatio() float64 {
+	if r.Sent == 0 {
+		return 1
+	}
+	return float64(r.Delivered) / float64(r.Sent)
+}
+
+// Percentile returns the latency percentile p, 50 for the median.
+func (r *Result) Percentile(p float64) time.Duration {
+	return percentile(r.Latencies, p)
+}
+
+func (r *Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (seed %d): %d/%d delivered, p50 %s, p99 %s", r.Scenario, r.Seed, r.Delivered, r.Sent, r.Percentile(50), r.Percentile(99))
+	for _, s := range r.Sessions {
+		fmt.Fprintf(&b, "\n  session %s: survived %t", s.Client, s.Survived)
+		if s.Err != nil {
+			fmt.Fprintf(&b, ", %v", s.Err)
+		}
+	}
+	for _, f := range r.Failures {
+		fmt.Fprintf(&b, "\n  FAIL %s", f)
+	}
+	return b.String()
+}
+
+// Run runs the scenario on a fresh network with a virtual clock. It returns an error if the scenario
+// cannot be set up; expectations that are not met end up in Result.Failures.
+func Run(s Scenario, opts RunOptions) (*Result, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Link: s.Link.Profile(), Seed: s.Seed, Clock: clock, Capture: opts.Capture})
+	r := &runner{scenario: s, network: network, clock: clock, links: map[[2]string]udpsim.LinkProfile{}, frozen: map[string]*udpsim.Fault{}, defaultLink: s.Link.Profile(), sent: map[string]time.Time{}, arrived: map[string]time.Time{}}
+	r.result = &Result{Scenario: s.Name, Seed: network.Seed()}
+	defer r.close()
+
+	if err := r.startServer(); err != nil {
+		return nil, err
+	}
+	r.dial()
+	start := clock.Now()
+	for _, e := range s.Timeline {
+		clock.AfterFunc(time.Duration(e.At), func() { r.apply(e) })
+	}
+	for _, w := range s.Workload {
+		r.schedule(w)
+	}
+	duration := time.Duration(s.Duration)
+	if duration <= 0 {
+		duration = s.end() + time.Second
+	}
+	network.Run(start.Add(duration).Sub(clock.Now()))
+	r.evaluate()
+	return r.result, nil
+}
+
+type runner struct {
+	scenario Scenario
+	network  *udpsim.Network
+	clock    *udpsim.VirtualClock
+	server   *dtp.Server
+	conns    []*udpsim.UDPConn
+	clients  map[string]*client
+	// links are the profiles the timeline gave single directions, defaultLink the one of all others.
+	links       map[[2]string]udpsim.LinkProfile
+	defaultLink udpsim.LinkProfile
+	// partition are the faults of the current partition, frozen the freezes of the hosts.
+	partition []*udpsim.Fault
+	frozen    map[string]*udpsim.Fault
+	result    *Result
+	// sent and arrived map the messages to the time they were sent and first arrived.
+	sent    map[string]time.Time
+	arrived map[string]time.Time
+	mux     sync.Mutex
+}
+
+type client struct {
+	name   string
+	socket *udpsim.UDPConn
+	conn   *dtp.DTPConnection
+	err    error
+	// closed is closed once the reader of the client returned.
+	closed chan struct{}
+}
+
+func (r *runner) listen(host string, port int) (*udpsim.UDPConn, error) {
+	conn, err := r.network.ListenUDP(&udpsim.UDPAddr{IP: r.scenario.Hosts[host].AsSlice(), Port: port})
+	if err != nil {
+		return nil, err
+	}
+	r.conns = append(r.conns, conn)
+	return conn, nil
+}
+
+func (r *runner) startServer() error {
+	conn, err := r.listen(r.scenario.Server.Host, r.scenario.Server.Port)
+	if err != nil {
+		return err
+	}
+	r.server, err = dtp.NewServer(conn, dtp.Options{
+		Clock:       r.clock,
+		IdleTimeout: time.Duration(r.scenario.Server.IdleTimeout),
+		MaxLifetime: time.Duration(r.scenario.Server.MaxLifetime),
+	})
+	if err != nil {
+		return err
+	}
+	go r.server.Serve()
+	go func() {
+		for {
+			c, err := r.server.Accept()
+			if err != nil {
+				return
+			}
+			go r.receive(c)
+		}
+	}()
+	return nil
+}
+
+// receive notes the arrival of every message of a session on the server.
+func (r *runner) receive(c *dtp.DTPConnection) {
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		id, _, _ := strings.Cut(string(msg.Data), " ")
+		r.arrive(id)
+	}
+}
+
+func (r *runner) arrive(id string) {
+	defer r.mux.Unlock()
+	r.mux.Lock()
+	if _, ok := r.arrived[id]; !ok {
+		r.arrived[id] = r.clock.Now()
+	}
+}
+
+// done notes the end of the handshake or of the session of a client.
+func (r *runner) done(c *client, conn *dtp.DTPConnection, err error) {
+	defer r.mux.Unlock()
+	r.mux.Lock()
+	if conn != nil {
+		c.conn = conn
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		c.err = err
+	}
+}
+
+// dial runs the handshakes of all clients at once.
+func (r *runner) dial() {
+	r.clients = map[string]*client{}
+	raddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(r.scenario.Hosts[r.scenario.Server.Host], uint16(r.scenario.Server.Port)))
+	dialed := make(chan struct{}, len(r.scenario.Clients))
+	for _, cs := range r.scenario.Clients {
+		c := &client{name: cs.Name, closed: make(chan struct{})}
+		r.clients[cs.Name] = c
+		conn, err := r.listen(cs.Host, 0)
+		if err != nil {
+			c.err = err
+			close(c.closed)
+			dialed <- struct{}{}
+			continue
+		}
+		c.socket = conn
+		go func() {
+			defer close(c.closed)
+			dc, err := dtp.Dial(conn, raddr, dtp.Options{Clock: r.clock})
+			r.done(c, dc, err)
+			dialed <- struct{}{}
+			if err != nil {
+				return
+			}
+			// The client reads to take part in path validations and to learn about the close.
+			for {
+				if _, err := dc.ReadMessage(); err != nil {
+					r.done(c, nil, err)
+					return
+				}
+			}
+		}()
+	}
+	pending := len(r.scenario.Clients)
+	r.network.RunUntil(func() bool {
+		for {
+			select {
+			case <-dialed:
+				pending--
+			default:
+				return pending == 0
+			}
+		}
+	}, handshakeTimeout)
+}
+
+// schedule sends the messages of a workload on the clock.
+func (r *runner) schedule(w Workload) {
+	c := r.clients[w.Client]
+	for i := 0; i < w.Count; i++ {
+		r.clock.AfterFunc(time.Duration(w.Start)+time.Duration(i)*time.Duration(w.Interval), func() {
+			id := w.Client + "/" + strconv.Itoa(i)
+			data := []byte(id + " ")
+			if len(data) < w.Size {
+				data = append(data, make([]byte, w.Size-len(data))...)
+			}
+			defer r.mux.Unlock()
+			r.mux.Lock()
+			r.result.Sent++
+			if c.conn == nil || c.conn.WriteMessage(&dtp.Message{Data: data}) != nil {
+				r.result.SendErrors++
+				return
+			}
+			r.sent[id] = r.clock.Now()
+		})
+	}
+}
+
+// apply carries out an event of the timeline.
+func (r *runner) apply(e Event) {
+	switch {
+	case e.Link != nil && e.From == "":
+		r.defaultLink = e.Link.Profile()
+		r.network.SetDefaultLink(r.defaultLink)
+	case e.Link != nil:
+		r.links[[2]string{e.From, e.To}] = e.Link.Profile()
+		if e.Both {
+			r.links[[2]string{e.To, e.From}] = e.Link.Profile()
+		}
+	case e.Reset:
+		delete(r.links, [2]string{e.From, e.To})
+		if e.Both {
+			delete(r.links, [2]string{e.To, e.From})
+		}
+	case e.Partition != nil:
+		for _, f := range r.partition {
+			f.Heal()
+		}
+		r.partition = nil
+		for i, a := range e.Partition {
+			for _, b := range e.Partition[i+1:] {
+				r.partition = append(r.partition, r.network.Partition(r.addrs(a), r.addrs(b)))
+			}
+		}
+	case e.Blackhole:
+		r.network.Blackhole(r.scenario.Hosts[e.From], r.scenario.Hosts[e.To])
+		if e.Both {
+			r.network.Blackhole(r.scenario.Hosts[e.To], r.scenario.Hosts[e.From])
+		}
+	case e.Freeze != "":
+		if r.frozen[e.Freeze] == nil {
+			r.frozen[e.Freeze] = r.network.Freeze(r.scenario.Hosts[e.Freeze])
+		}
+	case e.Thaw != "":
+		if f := r.frozen[e.Thaw]; f != nil {
+			delete(r.frozen, e.Thaw)
+			f.Heal()
+		}
+	case e.Kill != "":
+		if socket := r.clients[e.Kill].socket; socket != nil {
+			socket.Kill()
+		}
+	case e.Heal:
+		r.partition = nil
+		r.frozen = map[string]*udpsim.Fault{}
+		r.network.HealAll()
+	}
+	r.updateLinks()
+}
+
+func (r *runner) addrs(hosts []string) []netip.Addr {
+	addrs := make([]netip.Addr, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = r.scenario.Hosts[host]
+	}
+	return addrs
+}
+
+// updateLinks sets the profiles of all directions between the hosts.
+func (r *runner) updateLinks() {
+	for from, fromIP := range r.scenario.Hosts {
+		for to, toIP := range r.scenario.Hosts {
+			if from == to {
+				continue
+			}
+			profile, custom := r.links[[2]string{from, to}]
+			switch {
+			case custom:
+				r.network.SetLink(fromIP.AsSlice(), toIP.AsSlice(), profile)
+			default:
+				r.network.ResetLink(fromIP.AsSlice(), toIP.AsSlice())
+			}
+		}
+	}
+}
+
+// evaluate fills the result and checks the expectations.
+func (r *runner) evaluate() {
+	defer r.mux.Unlock()
+	r.mux.Lock()
+	res, expect := r.result, r.scenario.Expect
+	for id, sent := range r.sent {
+		if arrived, ok := r.arrived[id]; ok {
+			res.Delivered++
+			res.Latencies = append(res.Latencies, arrived.Sub(sent))
+		}
+	}
+	sort.Slice(res.Latencies, func(i, j int) bool { return res.Latencies[i] < res.Latencies[j] })
+
+	for _, cs := range r.scenario.Clients {
+		c := r.clients[cs.Name]
+		sr := SessionResult{Client: c.name, Err: c.err}
+		// A client whose reader failed, e.g. on a killed socket, is gone whatever its session says.
+		if c.conn != nil && c.err == nil && c.conn.Session().State() == dtp.ALI {
+			session, ok := r.server.Sessions().GetSession(c.conn.Session().ID())
+			sr.Survived = ok && session.State() == dtp.ALI
+		}
+		if sr.Err == nil && !sr.Survived {
+			sr.Err = errors.New("session closed")
+		}
+		res.Sessions = append(res.Sessions, sr)
+		if expect.SessionsSurvive && !sr.Survived {
+			res.Failures = append(res.Failures, fmt.Sprintf("session of %s did not survive: %v", c.name, sr.Err))
+		}
+	}
+
+	if expect.Delivery > 0 && res.DeliveryRatio() < expect.Delivery {
+		res.Failures = append(res.Failures, fmt.Sprintf("delivered %d of %d messages (%.3f), expected at least %.3f", res.Delivered, res.Sent, res.DeliveryRatio(), expect.Delivery))
+	}
+	for _, name := range sortedKeys(expect.Latency) {
+		p, _ := parsePercentile(name)
+		limit := time.Duration(expect.Latency[name])
+		if got := res.Percentile(p); got > limit {
+			res.Failures = append(res.Failures, fmt.Sprintf("latency %s is %s, expected at most %s", name, got, limit))
+		}
+	}
+}
+
+func (r *runner) close() {
+	r.mux.Lock()
+	for _, c := range r.clients {
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}
+	r.mux.Unlock()
+	if r.server != nil {
+		r.server.Close()
+	}
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	for _, c := range r.clients {
+		<-c.closed
+	}
+}
@@ -0,0 +1,334 @@
+// Package scenario runs declarative network scenarios against the real protocol stack on udpsim: a
+// topology of hosts, link profiles that change over time and a workload of messages, followed by
+// assertions on delivery, latency and the survival of the sessions.
+//
+// A scenario is YAML, or JSON which is read the same way:
+//
+//	name: lossy then partitioned
+//	seed: 42
+//	hosts: {server: 10.0.0.1, client: 10.0.0.2}
+//	link: {delay: 10ms}
+//	server: {host: server, port: 9000}
+//	clients: [{name: c1, host: client}]
+//	timeline:
+//	  - {at: 0s, link: {delay: 10ms, loss: 0.05}}
+//	  - {at: 10s, partition: [[client], [server]]}
+//	  - {at: 13s, heal: true}
+//	workload:
+//	  - {client: c1, count: 200, interval: 100ms}
+//	expect:
+//	  delivery: 0.8
+//	  latency: {p50: 20ms, p99: 100ms}
+//	  sessions_survive: true
+//
+// All times of the timeline and the workload count from the moment every client finished its
+// handshake. The scenario runs on a virtual clock, a minute of it takes milliseconds.
+package scenario
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes a run, see the package documentation.
+type Scenario struct {
+	Name string `yaml:"name"`
+	// Seed seeds the network, zero picks a random one. Result.Seed tells which.
+	Seed int64 `yaml:"seed"`
+	// Hosts names the IP addresses of the topology.
+	Hosts map[string]netip.Addr `yaml:"hosts"`
+	// Link is the profile of all links from the start on, the handshakes run on it.
+	Link    Link     `yaml:"link"`
+	Server  Server   `yaml:"server"`
+	Clients []Client `yaml:"clients"`
+	// Timeline changes the links while the workload runs.
+	Timeline []Event    `yaml:"timeline"`
+	Workload []Workload `yaml:"workload"`
+	// Duration is the time the scenario runs after the handshakes, by default until a second after
+	// the last event or message.
+	Duration Duration `yaml:"duration"`
+	Expect   Expect   `yaml:"expect"`
+}
+
+// Server is the dtp server of the scenario.
+type Server struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// IdleTimeout and MaxLifetime are the dtp options of the same names.
+	IdleTimeout Duration `yaml:"idle_timeout"`
+	MaxLifetime Duration `yaml:"max_lifetime"`
+}
+
+// Client dials the server from a host, several clients can share one.
+type Client struct {
+	Name string `yaml:"name"`
+	Host string `yaml:"host"`
+}
+
+// Link is a udpsim.LinkProfile with names for the scenario files.
+type Link struct {
+	Loss      float64  `yaml:"loss"`
+	Burst     *Burst   `yaml:"burst"`
+	Delay     Duration `yaml:"delay"`
+	MaxDelay  Duration `yaml:"max_delay"`
+	Reorder   float64  `yaml:"reorder"`
+	Bandwidth int64    `yaml:"bandwidth"`
+	Queue     int      `yaml:"queue"`
+	Duplicate float64  `yaml:"duplicate"`
+	Corrupt   float64  `yaml:"corrupt"`
+	MTU       int      `yaml:"mtu"`
+}
+
+// Burst is the Gilbert-Elliott model of bursty loss, see udpsim.GilbertElliott.
+type Burst struct {
+	P        float64 `yaml:"p"`
+	R        float64 `yaml:"r"`
+	LossGood float64 `yaml:"loss_good"`
+	LossBad  float64 `yaml:"loss_bad"`
+}
+
+// Profile returns the link as udpsim.LinkProfile.
+func (l Link) Profile() udpsim.LinkProfile {
+	p := udpsim.LinkProfile{
+		LossRate:      l.Loss,
+		MinDelay:      time.Duration(l.Delay),
+		MaxDelay:      time.Duration(l.MaxDelay),
+		ReorderRate:   l.Reorder,
+		Bandwidth:     l.Bandwidth,
+		QueueLimit:    l.Queue,
+		DuplicateRate: l.Duplicate,
+		CorruptRate:   l.Corrupt,
+		MTU:           l.MTU,
+	}
+	if l.Burst != nil {
+		p.GilbertElliott = &udpsim.GilbertElliott{P: l.Burst.P, R: l.Burst.R, LossGood: l.Burst.LossGood, LossBad: l.Burst.LossBad}
+	}
+	return p
+}
+
+// Event changes the network at a point of the timeline. It does exactly one of:
+//
+//   - link: gives the links from From to To this profile, in both directions with Both. Without From
+//     and To it replaces the default profile of all links.
+//   - reset: makes the links from From to To follow the default profile again.
+//   - partition: cuts the groups of hosts off each other, hosts of a group still reach each other. It
+//     replaces an earlier partition.
+//   - blackhole: drops everything from From to To, the other direction keeps working.
+//   - freeze: holds back what the host sends and receives until it thaws.
+//   - thaw: releases a frozen host.
+//   - kill: kills the socket of a client, its session ends without a word.
+//   - heal: ends the partition, the blackholes and the freezes.
+type Event struct {
+	At        Duration   `yaml:"at"`
+	From      string     `yaml:"from"`
+	To        string     `yaml:"to"`
+	Both      bool       `yaml:"both"`
+	Link      *Link      `yaml:"link"`
+	Reset     bool       `yaml:"reset"`
+	Partition [][]string `yaml:"partition"`
+	Blackhole bool       `yaml:"blackhole"`
+	Freeze    string     `yaml:"freeze"`
+	Thaw      string     `yaml:"thaw"`
+	Kill      string     `yaml:"kill"`
+	Heal      bool       `yaml:"heal"`
+}
+
+// Workload makes a client send Count messages of Size bytes to the server, one every Interval from
+// Start on.
+type Workload struct {
+	Client   string   `yaml:"client"`
+	Start    Duration `yaml:"start"`
+	Count    int      `yaml:"count"`
+	Interval Duration `yaml:"interval"`
+	Size     int      `yaml:"size"`
+}
+
+// Expect are the assertions on the outcome. Zero values are not checked.
+type Expect struct {
+	// Delivery is the minimum share of the sent messages that has to arrive, 1 for all of them.
+	Delivery float64 `yaml:"delivery"`
+	// Latency maps percentiles like p50, p99.9 or max to the latency they must not exceed.
+	Latency map[string]Duration `yaml:"latency"`
+	// SessionsSurvive requires every session to be established on both ends at the end.
+	SessionsSurvive bool `yaml:"sessions_survive"`
+}
+
+// Duration is a time.Duration written like "1.5s" in scenario files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Load reads a scenario file.
+func Load(path string) (Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	defer f.Close()
+	s, err := Parse(f)
+	if err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Parse reads a scenario in YAML or JSON and validates it. Unknown fields are errors.
+func Parse(r io.Reader) (Scenario, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Scenario{}, err
+	}
+	var s Scenario
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&s); err != nil {
+		return s, err
+	}
+	return s, s.Validate()
+}
+
+// Validate checks that the scenario only refers to hosts and clients it defines.
+func (s Scenario) Validate() error {
+	var errs []error
+	if len(s.Clients) == 0 {
+		errs = append(errs, errors.New("no clients"))
+	}
+	if _, ok := s.Hosts[s.Server.Host]; !ok {
+		errs = append(errs, fmt.Errorf("server: unknown host %q", s.Server.Host))
+	}
+	if s.Server.Port <= 0 || s.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server: invalid port %d", s.Server.Port))
+	}
+	clients := map[string]bool{}
+	for _, c := range s.Clients {
+		if _, ok := s.Hosts[c.Host]; !ok {
+			errs = append(errs, fmt.Errorf("client %q: unknown host %q", c.Name, c.Host))
+		}
+		if c.Name == "" || clients[c.Name] {
+			errs = append(errs, fmt.Errorf("client %q: name missing or used twice", c.Name))
+		}
+		clients[c.Name] = true
+	}
+	for i, e := range s.Timeline {
+		if err := s.validateEvent(e); err != nil {
+			errs = append(errs, fmt.Errorf("timeline %d: %w", i, err))
+		}
+	}
+	for i, w := range s.Workload {
+		if !clients[w.Client] {
+			errs = append(errs, fmt.Errorf("workload %d: unknown client %q", i, w.Client))
+		}
+		if w.Count > 1 && w.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("workload %d: interval missing", i))
+		}
+	}
+	for name := range s.Expect.Latency {
+		if _, err := parsePercentile(name); err != nil {
+			errs = append(errs, fmt.Errorf("expect: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s Scenario) validateEvent(e Event) error {
+	actions := 0
+	for _, set := range []bool{e.Link != nil, e.Reset, e.Partition != nil, e.Blackhole, e.Freeze != "", e.Thaw != "", e.Kill != "", e.Heal} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New("needs exactly one of link, reset, partition, blackhole, freeze, thaw, kill and heal")
+	}
+	if (e.From == "") != (e.To == "") || ((e.Reset || e.Blackhole) && e.From == "") {
+		return errors.New("from and to go together")
+	}
+	for _, host := range append([]string{e.From, e.To, e.Freeze, e.Thaw}, flatten(e.Partition)...) {
+		if _, ok := s.Hosts[host]; host != "" && !ok {
+			return fmt.Errorf("unknown host %q", host)
+		}
+	}
+	if e.Kill != "" && !slices.ContainsFunc(s.Clients, func(c Client) bool { return c.Name == e.Kill }) {
+		return fmt.Errorf("unknown client %q", e.Kill)
+	}
+	return nil
+}
+
+func flatten(groups [][]string) []string {
+	var hosts []string
+	for _, g := range groups {
+		hosts = append(hosts, g...)
+	}
+	return hosts
+}
+
+// end returns the time of the last event or message.
+func (s Scenario) end() time.Duration {
+	var end time.Duration
+	for _, e := range s.Timeline {
+		end = max(end, time.Duration(e.At))
+	}
+	for _, w := range s.Workload {
+		end = max(end, time.Duration(w.Start)+time.Duration(max(w.Count-1, 0))*time.Duration(w.Interval))
+	}
+	return end
+}
+
+// parsePercentile parses p50, p99.9 or max.
+func parsePercentile(name string) (float64, error) {
+	if name == "max" {
+		return 100, nil
+	}
+	p, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+	if err != nil || !strings.HasPrefix(name, "p") || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentile %q, expected p50, p99.9 or max", name)
+	}
+	return p, nil
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// sortedKeys returns the keys of m in order, for stable failure messages.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,125 @@
+package scenario
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob("testdata/*")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			t.Parallel()
+			s, err := Load(file)
+			if !assert.Nil(t, err) {
+				return
+			}
+			started := time.Now()
+			res, err := Run(s, RunOptions{})
+			if !assert.Nil(t, err) {
+				return
+			}
+			t.Log(res)
+			assert.True(t, res.Passed(), res.String())
+			assert.Less(t, time.Since(started), 10*time.Second)
+		})
+	}
+}
+
+// TestIdleSessionDies checks that the runner notices a session the server reaped.
+func TestIdleSessionDies(t *testing.T) {
+	s, err := Load("testdata/idle.json")
+	if !assert.Nil(t, err) {
+		return
+	}
+	s.Expect.SessionsSurvive = true
+	res, err := Run(s, RunOptions{})
+	assert.Nil(t, err)
+	assert.False(t, res.Passed())
+	if assert.Len(t, res.Sessions, 1) {
+		assert.False(t, res.Sessions[0].Survived)
+	}
+	assert.Less(t, res.Delivered, res.Sent)
+}
+
+// TestKilledClient kills the socket of a client mid-run, its session must not count as survived.
+func TestKilledClient(t *testing.T) {
+	s, err := Load("testdata/clean.yaml")
+	if !assert.Nil(t, err) {
+		return
+	}
+	s.Timeline = []Event{{At: Duration(500 * time.Millisecond), Kill: "c1"}}
+	res, err := Run(s, RunOptions{})
+	assert.Nil(t, err)
+	assert.False(t, res.Passed())
+	if assert.Len(t, res.Sessions, 2) {
+		assert.False(t, res.Sessions[0].Survived)
+		assert.ErrorIs(t, res.Sessions[0].Err, udpsim.ErrKilled)
+		assert.True(t, res.Sessions[1].Survived)
+	}
+	assert.Less(t, res.Delivered, res.Sent)
+}
+
+func TestParse(t *testing.T) {
+	const valid = `
+hosts: {a: 10.0.0.1, b: 10.0.0.2}
+server: {host: a, port: 9000}
+clients: [{name: c, host: b}]
+`
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{name: "valid", yaml: valid},
+		{name: "unknown field", yaml: valid + "loss: 0.1\n", err: "field loss not found"},
+		{name: "invalid duration", yaml: valid + "duration: soon\n", err: "invalid duration"},
+		{name: "unknown server host", yaml: strings.Replace(valid, "{host: a,", "{host: x,", 1), err: `unknown host "x"`},
+		{name: "unknown client", yaml: valid + "workload: [{client: d, count: 1}]\n", err: `unknown client "d"`},
+		{name: "event without action", yaml: valid + "timeline: [{at: 1s}]\n", err: "exactly one"},
+		{name: "event with two actions", yaml: valid + "timeline: [{at: 1s, heal: true, link: {loss: 1}}]\n", err: "exactly one"},
+		{name: "link without to", yaml: valid + "timeline: [{at: 1s, from: a, link: {loss: 1}}]\n", err: "from and to"},
+		{name: "partition of unknown host", yaml: valid + "timeline: [{at: 1s, partition: [[a], [z]]}]\n", err: `unknown host "z"`},
+		{name: "blackhole without from", yaml: valid + "timeline: [{at: 1s, blackhole: true}]\n", err: "from and to"},
+		{name: "freeze of unknown host", yaml: valid + "timeline: [{at: 1s, freeze: z}]\n", err: `unknown host "z"`},
+		{name: "kill of unknown client", yaml: valid + "timeline: [{at: 1s, kill: d}]\n", err: `unknown client "d"`},
+		{name: "invalid percentile", yaml: valid + "expect: {latency: {median: 1s}}\n", err: "invalid percentile"},
+	}
+
+	for _, subTest := range tests {
+		_, err := Parse(strings.NewReader(subTest.yaml))
+		if subTest.err == "" {
+			assert.Nil(t, err, subTest.name)
+			continue
+		}
+		if assert.Error(t, err, subTest.name) {
+			assert.Contains(t, err.Error(), subTest.err, subTest.name)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		name string
+		p    float64
+		want time.Duration
+	}{
+		{name: "median", p: 50, want: 5},
+		{name: "p90", p: 90, want: 9},
+		{name: "p99", p: 99, want: 10},
+		{name: "max", p: 100, want: 10},
+		{name: "smallest", p: 1, want: 1},
+	}
+	for _, subTest := range tests {
+		assert.Equal(t, subTest.want, percentile(latencies, subTest.p), subTest.name)
+	}
+	assert.Zero(t, percentile(nil, 50))
+}
@@ -0,0 +1,150 @@
+package udpsim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a network: delays and read deadlines run on it. It has the methods of
+// dtp.Clock, so the clock of a network can be handed to the protocol stack running on top of it.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f once d has passed. stop cancels the call and reports whether it was still
+	// pending.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// VirtualClock is a Clock that only moves when it is advanced. Timers fire in the order of their
+// deadlines, timers with the same deadline in the order they were set, all in the goroutine that
+// advances the clock.
+type VirtualClock struct {
+	now    time.Time
+	timers timerHeap
+	seq    uint64
+	mux    sync.Mutex
+}
+
+type virtualTimer struct {
+	at  time.Time
+	seq uint64
+	f   func()
+	// index is the position in the heap, -1 once the timer fired or was stopped.
+	index int
+}
+
+// NewVirtualClock creates a clock that shows start until it is advanced.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	defer c.mux.Unlock()
+	c.mux.Lock()
+	return c.now
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) func() bool {
+	defer c.mux.Unlock()
+	c.mux.Lock()
+	t := &virtualTimer{at: c.now.Add(max(d, 0)), seq: c.seq, f: f}
+	c.seq++
+	heap.Push(&c.timers, t)
+	return func() bool {
+		defer c.mux.Unlock()
+		c.mux.Lock()
+		if t.index < 0 {
+			return false
+		}
+		heap.Remove(&c.timers, t.index)
+		return true
+	}
+}
+
+// Next returns the deadline of the earliest pending timer.
+func (c *VirtualClock) Next() (time.Time, bool) {
+	defer c.mux.Unlock()
+	c.mux.Lock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].at, true
+}
+
+// Advance moves the clock forward by d and fires every timer due on the way, also the ones set by
+// the timers themselves.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+// AdvanceTo moves the clock forward to t like Advance. A t in the past only fires the due timers.
+func (c *VirtualClock) AdvanceTo(t time.Time) {
+	for c.fireNext(t) {
+	}
+	defer c.mux.Unlock()
+	c.mux.Lock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// fireNext moves the clock to the earliest timer due at or before t and fires it. It reports false
+// if there is none.
+func (c *VirtualClock) fireNext(t time.Time) bool {
+	c.mux.Lock()
+	if len(c.timers) == 0 || c.timers[0].at.After(t) {
+		c.mux.Unlock()
+		return false
+	}
+	timer := heap.Pop(&c.timers).(*virtualTimer)
+	if timer.at.After(c.now) {
+		c.now = timer.at
+	}
+	c.mux.Unlock()
+	timer.f()
+	return true
+}
+
+type timerHeap []*virtualTimer
+
+func (h timerHeap) Len() int {
+	return len(h)
+}
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	t := x.(*virtualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
@@ -0,0 +1,67 @@
+package udpsim_test
+
+import (
+	"testing"
+	"time"
+
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name    string
+		timers  []time.Duration
+		stopped []int
+		advance time.Duration
+		fired   []int
+	}{
+		{name: "in order of deadline", timers: []time.Duration{3, 1, 2}, advance: 3, fired: []int{1, 2, 0}},
+		{name: "same deadline in order of setting", timers: []time.Duration{1, 1, 1}, advance: 1, fired: []int{0, 1, 2}},
+		{name: "only due timers", timers: []time.Duration{1, 5}, advance: 4, fired: []int{0}},
+		{name: "stopped timers", timers: []time.Duration{1, 2}, stopped: []int{0}, advance: 2, fired: []int{1}},
+		{name: "negative duration fires at once", timers: []time.Duration{-1}, advance: 0, fired: []int{0}},
+	}
+
+	for _, subTest := range tests {
+		clock := udpsim.NewVirtualClock(start)
+		var fired []int
+		var at []time.Time
+		stops := make([]func() bool, len(subTest.timers))
+		for i, d := range subTest.timers {
+			stops[i] = clock.AfterFunc(d, func() {
+				fired = append(fired, i)
+				at = append(at, clock.Now())
+			})
+		}
+		for _, i := range subTest.stopped {
+			assert.True(t, stops[i](), subTest.name)
+			assert.False(t, stops[i](), subTest.name)
+		}
+
+		clock.Advance(subTest.advance)
+		assert.Equal(t, subTest.fired, fired, subTest.name)
+		for j, i := range fired {
+			assert.Equal(t, start.Add(max(subTest.timers[i], 0)), at[j], subTest.name)
+		}
+		assert.Equal(t, start.Add(subTest.advance), clock.Now(), subTest.name)
+	}
+}
+
+func TestVirtualClockTimerSetByTimer(t *testing.T) {
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	ticks := 0
+	var tick func()
+	tick = func() {
+		ticks++
+		clock.AfterFunc(time.Second, tick)
+	}
+	clock.AfterFunc(time.Second, tick)
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, 60, ticks)
+	next, ok := clock.Next()
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(61, 0), next)
+}
@@ -0,0 +1,146 @@
+package udpsim
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// ErrKilled is the error of the reads and writes of a killed socket, see UDPConn.Kill.
+var ErrKilled = errors.New("udpsim: socket killed")
+
+// Fault is a fault injected into a network. It lasts until it is healed.
+type Fault struct {
+	net *Network
+	// drops reports whether the fault drops a datagram from one host to another.
+	drops func(from, to netip.Addr) bool
+	// frozen is the host of a freeze, queued are the sends and deliveries it holds back.
+	frozen netip.Addr
+	queued []func()
+	healed bool
+}
+
+// Partition cuts the hosts of a off the hosts of b in both directions, from the next datagram that
+// arrives on. Datagrams already on their way are dropped as well. Hosts within a and within b still
+// reach each other.
+func (n *Network) Partition(a, b []netip.Addr) *Fault {
+	inA, inB := hostSet(a), hostSet(b)
+	return n.inject(&Fault{drops: func(from, to netip.Addr) bool {
+		return inA[from] && inB[to] || inB[from] && inA[to]
+	}})
+}
+
+// Blackhole drops every datagram from one host to another, the other direction keeps working.
+func (n *Network) Blackhole(from, to netip.Addr) *Fault {
+	from, to = from.Unmap(), to.Unmap()
+	return n.inject(&Fault{drops: func(f, t netip.Addr) bool {
+		return f == from && t == to
+	}})
+}
+
+// Freeze holds the host like a paused machine: what its sockets send and what arrives for them waits
+// until the fault is healed, then it is sent and delivered in its order.
+func (n *Network) Freeze(host netip.Addr) *Fault {
+	return n.inject(&Fault{frozen: host.Unmap()})
+}
+
+// Kill kills the socket bound to addr, see UDPConn.Kill.
+func (n *Network) Kill(addr netip.AddrPort) error {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	n.mux.Lock()
+	c, ok := n.conns[addr]
+	n.mux.Unlock()
+	if !ok {
+		return ErrUnreachable
+	}
+	c.Kill()
+	return nil
+}
+
+// Faults returns the faults that are not healed.
+func (n *Network) Faults() []*Fault {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	return append([]*Fault(nil), n.faults...)
+}
+
+// HealAll heals every fault of the network.
+func (n *Network) HealAll() {
+	for _, f := range n.Faults() {
+		f.Heal()
+	}
+}
+
+// Heal ends the fault. A frozen host sends and receives what it held back.
+func (f *Fault) Heal() {
+	n := f.net
+	n.mux.Lock()
+	if f.healed {
+		n.mux.Unlock()
+		return
+	}
+	f.healed = true
+	for i, other := range n.faults {
+		if other == f {
+			n.faults = append(n.faults[:i], n.faults[i+1:]...)
+			break
+		}
+	}
+	queued := f.queued
+	f.queued = nil
+	n.mux.Unlock()
+
+	n.activity.Add(1)
+	for _, release := range queued {
+		release()
+	}
+}
+
+// Healed reports whether the fault was healed.
+func (f *Fault) Healed() bool {
+	defer f.net.mux.Unlock()
+	f.net.mux.Lock()
+	return f.healed
+}
+
+func (n *Network) inject(f *Fault) *Fault {
+	f.net = n
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	n.faults = append(n.faults, f)
+	return f
+}
+
+// cut reports whether a fault drops datagrams from one host to another, the caller holds the lock.
+func (n *Network) cut(from, to netip.Addr) bool {
+	for _, f := range n.faults {
+		if f.drops != nil && f.drops(from, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// hold queues release if host is frozen and reports whether it did.
+func (n *Network) hold(host netip.Addr, release func()) bool {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	return n.holdLocked(host, release)
+}
+
+func (n *Network) holdLocked(host netip.Addr, release func()) bool {
+	for _, f := range n.faults {
+		if f.frozen.IsValid() && f.frozen == host {
+			f.queued = append(f.queued, release)
+			return true
+		}
+	}
+	return false
+}
+
+func hostSet(hosts []netip.Addr) map[netip.Addr]bool {
+	set := map[netip.Addr]bool{}
+	for _, h := range hosts {
+		set[h.Unmap()] = true
+	}
+	return set
+}
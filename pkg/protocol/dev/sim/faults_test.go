@@ -0,0 +1,186 @@
+package udpsim_test
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	dtp "github.com/WhilecodingDoLearn/dtp/pkg/protocol"
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	addrA = netip.MustParseAddr("10.0.0.1")
+	addrB = netip.MustParseAddr("10.0.0.2")
+	addrC = netip.MustParseAddr("10.0.0.3")
+)
+
+// TestFaults sends one datagram each way between A and B and between A and C while the faults are
+// injected, and once more after they are healed.
+func TestFaults(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		inject func(network *udpsim.Network) []*udpsim.Fault
+		// arrivals is the number of datagrams A, B and C read while the faults last.
+		arrivals [3]int
+	}{
+		{name: "no fault", inject: func(*udpsim.Network) []*udpsim.Fault { return nil }, arrivals: [3]int{2, 1, 1}},
+		{
+			name: "partition",
+			inject: func(network *udpsim.Network) []*udpsim.Fault {
+				return []*udpsim.Fault{network.Partition([]netip.Addr{addrA}, []netip.Addr{addrB, addrC})}
+			},
+			arrivals: [3]int{0, 0, 0},
+		},
+		{
+			name: "partition keeps sides connected",
+			inject: func(network *udpsim.Network) []*udpsim.Fault {
+				return []*udpsim.Fault{network.Partition([]netip.Addr{addrA, addrC}, []netip.Addr{addrB})}
+			},
+			arrivals: [3]int{1, 0, 1},
+		},
+		{
+			name: "blackhole one direction",
+			inject: func(network *udpsim.Network) []*udpsim.Fault {
+				return []*udpsim.Fault{network.Blackhole(addrA, addrB)}
+			},
+			arrivals: [3]int{2, 0, 1},
+		},
+		{
+			name: "blackholes in both directions",
+			inject: func(network *udpsim.Network) []*udpsim.Fault {
+				return []*udpsim.Fault{network.Blackhole(addrA, addrB), network.Blackhole(addrB, addrA)}
+			},
+			arrivals: [3]int{1, 0, 1},
+		},
+	}
+
+	for _, subTest := range tests {
+		clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+		network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: 10 * time.Millisecond}, Clock: clock})
+		conns := []*udpsim.UDPConn{listen(t, network, "10.0.0.1", 53), listen(t, network, "10.0.0.2", 53), listen(t, network, "10.0.0.3", 53)}
+		var done []<-chan []arrival
+		for _, c := range conns {
+			done = append(done, receive(c, clock))
+		}
+		exchange := func() {
+			for _, pair := range [][2]int{{0, 1}, {1, 0}, {0, 2}, {2, 0}} {
+				to := conns[pair[1]].LocalAddr().(*udpsim.UDPAddr)
+				_, err := conns[pair[0]].WriteToUDP([]byte("ping"), to)
+				assert.Nil(t, err, subTest.name)
+			}
+			network.Run(time.Second)
+		}
+
+		faults := subTest.inject(network)
+		assert.Len(t, network.Faults(), len(faults), subTest.name)
+		exchange()
+		for _, f := range faults {
+			f.Heal()
+			assert.True(t, f.Healed(), subTest.name)
+		}
+		assert.Empty(t, network.Faults(), subTest.name)
+		exchange()
+		for i, c := range conns {
+			c.Close()
+			// Once healed every datagram of the second exchange arrives.
+			assert.Len(t, <-done[i], subTest.arrivals[i]+[3]int{2, 1, 1}[i], subTest.name)
+		}
+	}
+}
+
+// TestFreeze freezes B while both sides send. What B sends and receives waits for the thaw and
+// arrives in order, one link delay after it.
+func TestFreeze(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: 10 * time.Millisecond}, Clock: clock})
+	a := listen(t, network, "10.0.0.1", 53)
+	b := listen(t, network, "10.0.0.2", 53)
+	toA, toB := receive(a, clock), receive(b, clock)
+
+	freeze := network.Freeze(addrB)
+	for _, msg := range []string{"1", "2", "3"} {
+		_, err := a.WriteToUDP([]byte(msg), b.LocalAddr().(*udpsim.UDPAddr))
+		assert.Nil(t, err)
+		_, err = b.WriteToUDP([]byte(msg), a.LocalAddr().(*udpsim.UDPAddr))
+		assert.Nil(t, err)
+	}
+	network.Run(time.Second)
+	freeze.Heal()
+	freeze.Heal()
+	network.Run(time.Second)
+	a.Close()
+	b.Close()
+
+	for _, arrivals := range [][]arrival{<-toA, <-toB} {
+		if assert.Len(t, arrivals, 3) {
+			for i, a := range arrivals {
+				assert.Equal(t, []byte{'1' + byte(i)}, a.data)
+			}
+		}
+	}
+}
+
+func TestKill(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Clock: clock})
+	a := listen(t, network, "10.0.0.1", 53)
+	b := listen(t, network, "10.0.0.2", 53)
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := b.ReadFromUDP(make([]byte, 16))
+		read <- err
+	}()
+	network.Run(time.Second)
+	assert.Nil(t, network.Kill(netip.MustParseAddrPort("10.0.0.2:53")))
+	assert.ErrorIs(t, <-read, udpsim.ErrKilled)
+	assert.ErrorIs(t, network.Kill(netip.MustParseAddrPort("10.0.0.2:53")), udpsim.ErrUnreachable)
+
+	_, err := b.WriteToUDP([]byte("ping"), a.LocalAddr().(*udpsim.UDPAddr))
+	assert.ErrorIs(t, err, udpsim.ErrKilled)
+	var opErr *net.OpError
+	assert.True(t, errors.As(err, &opErr))
+	_, err = a.WriteToUDP([]byte("ping"), b.LocalAddr().(*udpsim.UDPAddr))
+	assert.ErrorIs(t, err, udpsim.ErrUnreachable)
+
+	// A plain Close still reports net.ErrClosed.
+	a.Close()
+	_, _, err = a.ReadFromUDP(make([]byte, 16))
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+// TestPartitionIdleTimeout cuts a client off its server. The server reaps the silent session after
+// its idle timeout, the partition outlasts it.
+func TestPartitionIdleTimeout(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: 10 * time.Millisecond}, Clock: clock})
+	serverConn := listen(t, network, "10.0.0.1", 9000)
+	server, err := dtp.NewServer(serverConn, dtp.Options{Clock: clock, IdleTimeout: 30 * time.Second})
+	assert.Nil(t, err)
+	go server.Serve()
+	defer server.Close()
+
+	clientConn := listen(t, network, "10.0.0.2", 0)
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := dtp.Dial(clientConn, serverConn.LocalAddr(), dtp.Options{Clock: clock})
+		dialed <- err
+	}()
+	var dialErr error
+	assert.True(t, network.RunUntil(received(dialed, &dialErr), time.Second))
+	assert.Nil(t, dialErr)
+	assert.Equal(t, 1, server.Sessions().Size())
+
+	partition := network.Partition([]netip.Addr{addrA}, []netip.Addr{addrB})
+	assert.True(t, network.RunUntil(func() bool { return server.Sessions().Size() == 0 }, time.Minute))
+	assert.GreaterOrEqual(t, clock.Now().Sub(time.Unix(0, 0)), 30*time.Second)
+	partition.Heal()
+}
@@ -0,0 +1,275 @@
+package udpsim
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// ipv4Overhead and ipv6Overhead are the IP and UDP header bytes added to every datagram, they
+	// count against the MTU and the bandwidth.
+	ipv4Overhead = 20 + 8
+	ipv6Overhead = 40 + 8
+	// defaultREDWeight is the weight of the newest sample in the average queue length of RED.
+	defaultREDWeight = 0.002
+)
+
+// LinkProfile describes one direction of a link: what happens to the datagrams a host sends to
+// another. The zero profile delivers everything at once.
+type LinkProfile struct {
+	// LossRate is the chance that a datagram is lost [0.0..1.0], independent of the ones before.
+	LossRate float64
+	// GilbertElliott adds bursty loss on top of LossRate.
+	GilbertElliott *GilbertElliott
+	// MinDelay and MaxDelay bound the propagation delay, it is picked uniformly for every datagram.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// ReorderRate is the chance that a datagram is held back up to MaxDelay longer than the others.
+	ReorderRate float64
+
+	// Bandwidth is the rate of the link in bits per second, zero is unlimited. Datagrams are sent
+	// one after another and wait in a queue meanwhile.
+	Bandwidth int64
+	// QueueLimit is the number of datagrams that can wait or be in transmission, the queue drops any
+	// further one (drop-tail). Zero is an unlimited queue. It only applies with a Bandwidth.
+	QueueLimit int
+	// RED drops datagrams early, before the queue is full. QueueLimit stays the hard limit.
+	RED *RED
+
+	// DuplicateRate is the chance that a datagram is delivered twice, each copy with its own delay.
+	DuplicateRate float64
+	// CorruptRate is the chance that a single bit of a datagram is flipped.
+	CorruptRate float64
+	// MTU is the largest IP packet the link carries, larger datagrams are dropped. Zero is no limit.
+	MTU int
+}
+
+// GilbertElliott is the two state model of bursty loss: the link moves between a good and a bad
+// state with the chances P and R for every datagram, and loses datagrams with the chance of the
+// state it is in. The mean burst is 1/R datagrams long.
+type GilbertElliott struct {
+	// P is the chance to move from the good to the bad state, R the chance to move back.
+	P float64
+	R float64
+	// LossGood and LossBad are the loss rates in the two states, LossBad is usually 1.
+	LossGood float64
+	LossBad  float64
+}
+
+// RED is random early detection: once the average queue length passes MinThreshold datagrams are
+// dropped with a chance that grows linearly up to MaxP at MaxThreshold, from there on all of them.
+type RED struct {
+	MinThreshold float64
+	MaxThreshold float64
+	MaxP         float64
+	// Weight is the weight of the current queue length in the moving average, 0.002 if zero.
+	Weight float64
+}
+
+// link is the state of one direction between two hosts. Its profile can be replaced at any time, the
+// queue and the loss state stay.
+type link struct {
+	profile LinkProfile
+	// custom is set once SetLink gave the link a profile of its own, otherwise it follows the default.
+	custom bool
+	// departures are the times the queued datagrams have left the sender, in order.
+	departures []time.Time
+	avgQueue   float64
+	bad        bool
+}
+
+type linkKey struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+// delivery is one copy of a datagram on its way.
+type delivery struct {
+	data  []byte
+	delay time.Duration
+}
+
+// DefaultLink returns the profile of all links that have none of their own.
+func (n *Network) DefaultLink() LinkProfile {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	return n.defaultLink
+}
+
+// SetDefaultLink changes the profile of all links that have none of their own. It applies to every
+// datagram sent afterwards.
+func (n *Network) SetDefaultLink(profile LinkProfile) {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	n.defaultLink = profile
+}
+
+// Link returns the profile of the direction from one host to another.
+func (n *Network) Link(from, to net.IP) LinkProfile {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	return n.profile(n.link(ipKey(from), ipKey(to)))
+}
+
+// SetLink gives the direction from one host to another a profile of its own, call it twice for both
+// directions. Datagrams already on their way are not affected, the queue of the link is kept.
+func (n *Network) SetLink(from, to net.IP, profile LinkProfile) {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	l := n.link(ipKey(from), ipKey(to))
+	l.profile = profile
+	l.custom = true
+}
+
+// ResetLink makes the direction from one host to another follow the default profile again.
+func (n *Network) ResetLink(from, to net.IP) {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	l := n.link(ipKey(from), ipKey(to))
+	l.profile = LinkProfile{}
+	l.custom = false
+}
+
+// link returns the state of a direction, the caller holds the lock.
+func (n *Network) link(from, to netip.Addr) *link {
+	key := linkKey{from, to}
+	l, ok := n.links[key]
+	if !ok {
+		l = &link{}
+		n.links[key] = l
+	}
+	return l
+}
+
+func (n *Network) profile(l *link) LinkProfile {
+	if l.custom {
+		return l.profile
+	}
+	return n.defaultLink
+}
+
+// impair sends data over the link from one host to another and returns the copies that arrive,
+// none if it is lost.
+func (n *Network) impair(from, to netip.Addr, data []byte) []delivery {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	l := n.link(from, to)
+	p := n.profile(l)
+
+	size := len(data) + ipv4Overhead
+	if to.Is6() {
+		size = len(data) + ipv6Overhead
+	}
+	if p.MTU > 0 && size > p.MTU {
+		return nil
+	}
+	if n.rand.Float64() < p.LossRate {
+		return nil
+	}
+	if p.GilbertElliott != nil && l.burstLoss(p.GilbertElliott, n.rand) {
+		return nil
+	}
+	queued, ok := l.enqueue(p, size, n.clock.Now(), n.rand)
+	if !ok {
+		return nil
+	}
+
+	copies := 1
+	if n.rand.Float64() < p.DuplicateRate {
+		copies = 2
+	}
+	deliveries := make([]delivery, 0, copies)
+	for i := 0; i < copies; i++ {
+		d := delivery{data: data, delay: queued + p.delay(n.rand)}
+		if len(data) > 0 && n.rand.Float64() < p.CorruptRate {
+			d.data = append([]byte(nil), data...)
+			bit := n.rand.Intn(len(data) * 8)
+			d.data[bit/8] ^= 1 << (bit % 8)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
+
+// delay picks the propagation delay of a datagram.
+func (p LinkProfile) delay(rnd *rand.Rand) time.Duration {
+	delay := p.MinDelay
+	if p.MaxDelay > p.MinDelay {
+		delay += time.Duration(rnd.Int63n(int64(p.MaxDelay - p.MinDelay)))
+	}
+	// Reordering: now and then a datagram is held back a bit longer than the ones after it.
+	if p.MaxDelay > 0 && rnd.Float64() < p.ReorderRate {
+		delay += time.Duration(rnd.Int63n(int64(p.MaxDelay)))
+	}
+	return delay
+}
+
+// burstLoss moves the Gilbert-Elliott state on and reports whether the datagram is lost in it.
+func (l *link) burstLoss(ge *GilbertElliott, rnd *rand.Rand) bool {
+	if l.bad {
+		l.bad = rnd.Float64() >= ge.R
+	} else {
+		l.bad = rnd.Float64() < ge.P
+	}
+	loss := ge.LossGood
+	if l.bad {
+		loss = ge.LossBad
+	}
+	return rnd.Float64() < loss
+}
+
+// enqueue puts a datagram of size bytes into the queue of the link and returns the time until it has
+// been sent. It reports false if the queue drops it.
+func (l *link) enqueue(p LinkProfile, size int, now time.Time, rnd *rand.Rand) (time.Duration, bool) {
+	if p.Bandwidth <= 0 {
+		return 0, true
+	}
+	sent := 0
+	for sent < len(l.departures) && !l.departures[sent].After(now) {
+		sent++
+	}
+	l.departures = l.departures[sent:]
+	queued := len(l.departures)
+
+	if p.QueueLimit > 0 && queued >= p.QueueLimit {
+		return 0, false
+	}
+	if p.RED != nil && l.earlyDrop(p.RED, queued, rnd) {
+		return 0, false
+	}
+
+	start := now
+	if queued > 0 {
+		start = l.departures[queued-1]
+	}
+	done := start.Add(time.Duration(int64(size) * 8 * int64(time.Second) / p.Bandwidth))
+	l.departures = append(l.departures, done)
+	return done.Sub(now), true
+}
+
+// earlyDrop updates the average queue length and decides whether RED drops the datagram.
+func (l *link) earlyDrop(red *RED, queued int, rnd *rand.Rand) bool {
+	weight := red.Weight
+	if weight <= 0 {
+		weight = defaultREDWeight
+	}
+	l.avgQueue += weight * (float64(queued) - l.avgQueue)
+	switch {
+	case l.avgQueue < red.MinThreshold:
+		return false
+	case l.avgQueue >= red.MaxThreshold:
+		return true
+	}
+	return rnd.Float64() < red.MaxP*(l.avgQueue-red.MinThreshold)/(red.MaxThreshold-red.MinThreshold)
+}
+
+// ipKey returns ip in the form used as key, nil is the unspecified IPv4 address.
+func ipKey(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.IPv4Unspecified()
+	}
+	return addr.Unmap()
+}
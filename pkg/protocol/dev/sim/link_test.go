@@ -0,0 +1,159 @@
+package udpsim_test
+
+import (
+	"bytes"
+	"math/bits"
+	"net"
+	"testing"
+	"time"
+
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	hostA = net.ParseIP("10.0.0.1")
+	hostB = net.ParseIP("10.0.0.2")
+)
+
+type arrival struct {
+	data []byte
+	at   time.Duration
+}
+
+// receive collects everything conn reads until it is closed, with the time on clock.
+func receive(conn *udpsim.UDPConn, clock udpsim.Clock) <-chan []arrival {
+	start := clock.Now()
+	done := make(chan []arrival, 1)
+	go func() {
+		var arrivals []arrival
+		for {
+			buf := make([]byte, 2048)
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				done <- arrivals
+				return
+			}
+			arrivals = append(arrivals, arrival{data: buf[:n], at: clock.Now().Sub(start)})
+		}
+	}()
+	return done
+}
+
+// transmit sends the payloads from host B to host A at once and returns what arrives within a minute.
+func transmit(t *testing.T, network *udpsim.Network, payloads [][]byte) []arrival {
+	t.Helper()
+	receiver := listen(t, network, "10.0.0.1", 53)
+	sender := listen(t, network, "10.0.0.2", 53)
+	done := receive(receiver, network.Clock())
+	for _, payload := range payloads {
+		_, err := sender.WriteToUDP(payload, &udpsim.UDPAddr{IP: hostA, Port: 53})
+		assert.Nil(t, err)
+	}
+	network.Run(time.Minute)
+	receiver.Close()
+	sender.Close()
+	return <-done
+}
+
+func payloads(count, size int) [][]byte {
+	p := make([][]byte, count)
+	for i := range p {
+		p[i] = bytes.Repeat([]byte{byte(i)}, size)
+	}
+	return p
+}
+
+func TestLinkProfile(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		profile  udpsim.LinkProfile
+		payloads [][]byte
+		// arrivals is the number of datagrams that arrive, at their times if given.
+		arrivals int
+		at       []time.Duration
+	}{
+		{name: "unimpaired", payloads: payloads(5, 100), arrivals: 5, at: []time.Duration{0, 0, 0, 0, 0}},
+		{name: "fixed delay", profile: udpsim.LinkProfile{MinDelay: 30 * time.Millisecond}, payloads: payloads(2, 100), arrivals: 2, at: []time.Duration{30 * time.Millisecond, 30 * time.Millisecond}},
+		{name: "mtu drops oversized", profile: udpsim.LinkProfile{MTU: 128}, payloads: [][]byte{make([]byte, 100), make([]byte, 101)}, arrivals: 1},
+		{
+			// 100 bytes and 28 header bytes are 1024 bits, 128ms at 8000 bit/s.
+			name:     "bandwidth serializes",
+			profile:  udpsim.LinkProfile{Bandwidth: 8000, MinDelay: 10 * time.Millisecond},
+			payloads: payloads(3, 100), arrivals: 3,
+			at: []time.Duration{138 * time.Millisecond, 266 * time.Millisecond, 394 * time.Millisecond},
+		},
+		{name: "drop-tail queue", profile: udpsim.LinkProfile{Bandwidth: 8000, QueueLimit: 2}, payloads: payloads(5, 100), arrivals: 2},
+		{name: "red drops beyond max threshold", profile: udpsim.LinkProfile{Bandwidth: 8000, RED: &udpsim.RED{MinThreshold: 1, MaxThreshold: 2, MaxP: 1, Weight: 1}}, payloads: payloads(5, 100), arrivals: 2},
+		{name: "lossy link", profile: udpsim.LinkProfile{LossRate: 1}, payloads: payloads(5, 100), arrivals: 0},
+		{name: "burst loss in bad state", profile: udpsim.LinkProfile{GilbertElliott: &udpsim.GilbertElliott{P: 1, R: 0, LossBad: 1}}, payloads: payloads(5, 100), arrivals: 0},
+		{name: "no loss in good state", profile: udpsim.LinkProfile{GilbertElliott: &udpsim.GilbertElliott{P: 0, R: 1, LossBad: 1}}, payloads: payloads(5, 100), arrivals: 5},
+		{name: "duplication", profile: udpsim.LinkProfile{DuplicateRate: 1}, payloads: payloads(5, 100), arrivals: 10},
+	}
+
+	for _, subTest := range tests {
+		network := udpsim.NewNetwork(udpsim.Options{Link: subTest.profile, Clock: udpsim.NewVirtualClock(time.Unix(0, 0))})
+		arrivals := transmit(t, network, subTest.payloads)
+		assert.Len(t, arrivals, subTest.arrivals, subTest.name)
+		for i, at := range subTest.at {
+			if i < len(arrivals) {
+				assert.Equal(t, at, arrivals[i].at, subTest.name)
+			}
+		}
+	}
+}
+
+func TestLinkCorruption(t *testing.T) {
+	t.Parallel()
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{CorruptRate: 1}, Clock: udpsim.NewVirtualClock(time.Unix(0, 0))})
+	sent := payloads(10, 64)
+	arrivals := transmit(t, network, sent)
+	assert.Len(t, arrivals, len(sent))
+	for i, a := range arrivals {
+		flipped := 0
+		for j := range a.data {
+			flipped += bits.OnesCount8(a.data[j] ^ sent[i][j])
+		}
+		assert.Equal(t, 1, flipped, "datagram %d", i)
+	}
+}
+
+// TestSetLink gives one direction a profile of its own and changes it mid-test, like a handover.
+func TestSetLink(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: 10 * time.Millisecond}, Clock: clock})
+	network.SetLink(hostB, hostA, udpsim.LinkProfile{LossRate: 1})
+	assert.Equal(t, udpsim.LinkProfile{LossRate: 1}, network.Link(hostB, hostA))
+	assert.Equal(t, network.DefaultLink(), network.Link(hostA, hostB))
+
+	a := listen(t, network, "10.0.0.1", 53)
+	b := listen(t, network, "10.0.0.2", 53)
+	toA, toB := receive(a, clock), receive(b, clock)
+	send := func(from *udpsim.UDPConn, to net.IP) {
+		_, err := from.WriteToUDP([]byte("ping"), &udpsim.UDPAddr{IP: to, Port: 53})
+		assert.Nil(t, err)
+	}
+
+	send(b, hostA)
+	send(a, hostB)
+	network.Run(time.Second)
+	network.SetLink(hostB, hostA, udpsim.LinkProfile{MinDelay: 200 * time.Millisecond})
+	send(b, hostA)
+	network.Run(time.Second)
+	network.ResetLink(hostB, hostA)
+	send(b, hostA)
+	network.Run(time.Second)
+	a.Close()
+	b.Close()
+
+	atA, atB := <-toA, <-toB
+	if assert.Len(t, atA, 2) {
+		assert.Equal(t, time.Second+200*time.Millisecond, atA[0].at)
+		assert.Equal(t, 2*time.Second+10*time.Millisecond, atA[1].at)
+	}
+	if assert.Len(t, atB, 1) {
+		assert.Equal(t, 10*time.Millisecond, atB[0].at)
+	}
+}
@@ -0,0 +1,351 @@
+package udpsim
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	// defaultMappingTimeout is the minimum RFC 4787 asks for, many home routers use less.
+	defaultMappingTimeout = 2 * time.Minute
+	defaultPinholeTimeout = 30 * time.Second
+	// firstNATPort is the first public port a NAT hands out.
+	firstNATPort = 20000
+)
+
+var (
+	ErrNATAddress   = errors.New("udpsim: NAT needs a public address outside of its private prefix")
+	ErrNATOverlap   = errors.New("udpsim: private prefix overlaps another NAT")
+	ErrFirewallHost = errors.New("udpsim: firewall needs a valid host prefix")
+)
+
+// NATType is the mapping and filtering behaviour of a NAT, with the classic names of RFC 3489.
+type NATType int
+
+const (
+	// FullCone maps a private endpoint to the same public port for every destination and lets
+	// everybody send to it.
+	FullCone NATType = iota
+	// AddressRestricted only lets hosts the private endpoint sent to send to the mapping.
+	AddressRestricted
+	// PortRestricted only lets the exact endpoints the private endpoint sent to send to the mapping.
+	PortRestricted
+	// Symmetric maps every destination to a public port of its own, filtered like PortRestricted.
+	Symmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case FullCone:
+		return "full-cone"
+	case AddressRestricted:
+		return "address-restricted"
+	case PortRestricted:
+		return "port-restricted"
+	case Symmetric:
+		return "symmetric"
+	}
+	return fmt.Sprintf("NATType(%d)", int(t))
+}
+
+// NATConfig describes a NAT device. The hosts of the private prefix sit behind it: their datagrams to
+// the outside leave from the public address, and nobody outside can send to them except through a
+// mapping. Hosts behind the same NAT reach each other directly.
+type NATConfig struct {
+	Type    NATType
+	Public  netip.Addr
+	Private netip.Prefix
+	// MappingTimeout removes a mapping that sent nothing for that long, 2 minutes if zero. Only
+	// outbound datagrams keep a mapping alive.
+	MappingTimeout time.Duration
+}
+
+// NAT is a NAT device in a network, see AddNAT.
+type NAT struct {
+	config   NATConfig
+	net      *Network
+	mappings map[mappingKey]*natMapping
+	ports    map[uint16]*natMapping
+	nextPort int
+}
+
+type mappingKey struct {
+	private netip.AddrPort
+	// remote is only set for symmetric NATs, which map every destination on its own.
+	remote netip.AddrPort
+}
+
+type natMapping struct {
+	key    mappingKey
+	public netip.AddrPort
+	// lastOut is the time of the last outbound datagram.
+	lastOut time.Time
+	// permissions are the remote endpoints the private endpoint sent to, with the time of the last
+	// datagram.
+	permissions map[netip.AddrPort]time.Time
+}
+
+// Mapping is a translation of a NAT from a private to a public endpoint.
+type Mapping struct {
+	Private netip.AddrPort
+	Public  netip.AddrPort
+	// Remote is the destination of a symmetric mapping.
+	Remote   netip.AddrPort
+	LastUsed time.Time
+}
+
+// AddNAT puts the hosts of config.Private behind a new NAT. The private prefixes of the NATs of a
+// network must not overlap, and no socket should be bound to the public address.
+func (n *Network) AddNAT(config NATConfig) (*NAT, error) {
+	if !config.Public.IsValid() || !config.Private.IsValid() || config.Private.Contains(config.Public) {
+		return nil, ErrNATAddress
+	}
+	if config.MappingTimeout <= 0 {
+		config.MappingTimeout = defaultMappingTimeout
+	}
+	config.Public = config.Public.Unmap()
+	config.Private = config.Private.Masked()
+
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	for _, other := range n.nats {
+		if other.config.Private.Overlaps(config.Private) || other.config.Public == config.Public {
+			return nil, ErrNATOverlap
+		}
+	}
+	nat := &NAT{
+		config:   config,
+		net:      n,
+		mappings: map[mappingKey]*natMapping{},
+		ports:    map[uint16]*natMapping{},
+		nextPort: firstNATPort,
+	}
+	n.nats = append(n.nats, nat)
+	return nat, nil
+}
+
+// Config returns the configuration of the NAT.
+func (nat *NAT) Config() NATConfig {
+	return nat.config
+}
+
+// Mappings returns the mappings of the NAT that did not time out.
+func (nat *NAT) Mappings() []Mapping {
+	defer nat.net.mux.Unlock()
+	nat.net.mux.Lock()
+	now := nat.net.clock.Now()
+	var mappings []Mapping
+	for _, m := range nat.mappings {
+		if nat.expired(m.lastOut, now) {
+			continue
+		}
+		mappings = append(mappings, Mapping{Private: m.key.private, Public: m.public, Remote: m.key.remote, LastUsed: m.lastOut})
+	}
+	return mappings
+}
+
+func (nat *NAT) expired(last, now time.Time) bool {
+	return now.Sub(last) >= nat.config.MappingTimeout
+}
+
+// outbound translates a datagram from a private endpoint to the outside and returns its public
+// source. The caller holds the lock of the network.
+func (nat *NAT) outbound(src, dst netip.AddrPort, now time.Time) (netip.AddrPort, bool) {
+	key := mappingKey{private: src}
+	if nat.config.Type == Symmetric {
+		key.remote = dst
+	}
+	m, ok := nat.mappings[key]
+	if ok && nat.expired(m.lastOut, now) {
+		nat.remove(m)
+		ok = false
+	}
+	if !ok {
+		port, found := nat.freePort()
+		if !found {
+			return netip.AddrPort{}, false
+		}
+		m = &natMapping{key: key, public: netip.AddrPortFrom(nat.config.Public, port), permissions: map[netip.AddrPort]time.Time{}}
+		nat.mappings[key] = m
+		nat.ports[port] = m
+	}
+	m.lastOut = now
+	m.permissions[dst] = now
+	return m.public, true
+}
+
+// inbound returns the private endpoint a datagram from src to the public port is for, if the
+// mapping exists and its filter lets src through.
+func (nat *NAT) inbound(src netip.AddrPort, port uint16, now time.Time) (netip.AddrPort, bool) {
+	m, ok := nat.ports[port]
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	if nat.expired(m.lastOut, now) {
+		nat.remove(m)
+		return netip.AddrPort{}, false
+	}
+	switch nat.config.Type {
+	case FullCone:
+		return m.key.private, true
+	case AddressRestricted:
+		for remote, last := range m.permissions {
+			if remote.Addr() == src.Addr() && !nat.expired(last, now) {
+				return m.key.private, true
+			}
+		}
+		return netip.AddrPort{}, false
+	}
+	last, ok := m.permissions[src]
+	if !ok || nat.expired(last, now) {
+		return netip.AddrPort{}, false
+	}
+	return m.key.private, true
+}
+
+func (nat *NAT) remove(m *natMapping) {
+	delete(nat.mappings, m.key)
+	delete(nat.ports, m.public.Port())
+}
+
+// freePort returns the next public port without a mapping, expired mappings are reused.
+func (nat *NAT) freePort() (uint16, bool) {
+	now := nat.net.clock.Now()
+	for i := 0; i < 1<<16-firstNATPort; i++ {
+		port := uint16(nat.nextPort)
+		nat.nextPort++
+		if nat.nextPort >= 1<<16 {
+			nat.nextPort = firstNATPort
+		}
+		m, used := nat.ports[port]
+		if used && nat.expired(m.lastOut, now) {
+			nat.remove(m)
+			used = false
+		}
+		if !used {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// FirewallConfig describes a stateful firewall in front of the hosts of a prefix. Datagrams from the
+// outside only pass if the host sent to their source endpoint within the timeout, or if they are for
+// an open port.
+type FirewallConfig struct {
+	Hosts netip.Prefix
+	// Timeout closes the pinhole of an endpoint the host did not send to for that long, 30 seconds if
+	// zero.
+	Timeout time.Duration
+	// OpenPorts accept datagrams from everybody, e.g. the port of a server.
+	OpenPorts []uint16
+}
+
+// Firewall is a firewall in a network, see AddFirewall.
+type Firewall struct {
+	config FirewallConfig
+	// pinholes are the pairs of inside and outside endpoints with the time of the last datagram out.
+	pinholes map[[2]netip.AddrPort]time.Time
+}
+
+// AddFirewall puts a firewall in front of the hosts of config.Hosts. Hosts behind a NAT are
+// protected by a firewall for their private prefix.
+func (n *Network) AddFirewall(config FirewallConfig) (*Firewall, error) {
+	if !config.Hosts.IsValid() {
+		return nil, ErrFirewallHost
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultPinholeTimeout
+	}
+	config.Hosts = config.Hosts.Masked()
+	fw := &Firewall{config: config, pinholes: map[[2]netip.AddrPort]time.Time{}}
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	n.firewalls = append(n.firewalls, fw)
+	return fw, nil
+}
+
+func (fw *Firewall) outbound(src, dst netip.AddrPort, now time.Time) {
+	fw.pinholes[[2]netip.AddrPort{src, dst}] = now
+}
+
+func (fw *Firewall) allows(src, dst netip.AddrPort, now time.Time) bool {
+	for _, port := range fw.config.OpenPorts {
+		if port == dst.Port() {
+			return true
+		}
+	}
+	pinhole := [2]netip.AddrPort{dst, src}
+	last, ok := fw.pinholes[pinhole]
+	if ok && now.Sub(last) >= fw.config.Timeout {
+		delete(fw.pinholes, pinhole)
+		return false
+	}
+	return ok
+}
+
+// realm returns the NAT ip sits behind, nil for the public part of the network. The caller holds
+// the lock.
+func (n *Network) realm(ip netip.Addr) *NAT {
+	for _, nat := range n.nats {
+		if nat.config.Private.Contains(ip) {
+			return nat
+		}
+	}
+	return nil
+}
+
+// publicNAT returns the NAT whose public address is ip. The caller holds the lock.
+func (n *Network) publicNAT(ip netip.Addr) *NAT {
+	for _, nat := range n.nats {
+		if nat.config.Public == ip {
+			return nat
+		}
+	}
+	return nil
+}
+
+// outbound passes a datagram from src to dst through the firewalls and the NAT of the sender and
+// returns the source it has on the wire. It reports false if the NAT has no port left.
+func (n *Network) outbound(src, dst netip.AddrPort) (netip.AddrPort, bool) {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	now := n.clock.Now()
+	for _, fw := range n.firewalls {
+		if fw.config.Hosts.Contains(src.Addr()) && !fw.config.Hosts.Contains(dst.Addr()) {
+			fw.outbound(src, dst, now)
+		}
+	}
+	nat := n.realm(src.Addr())
+	if nat == nil || nat.config.Private.Contains(dst.Addr()) {
+		return src, true
+	}
+	return nat.outbound(src, dst, now)
+}
+
+// inbound routes a datagram that arrives from src for dst: through the NAT that owns dst and the
+// firewalls in front of the receiver. It returns the endpoint of the receiving socket, or false if
+// the datagram is dropped on the way. The caller holds the lock.
+func (n *Network) inbound(src, dst netip.AddrPort) (netip.AddrPort, bool) {
+	now := n.clock.Now()
+	from := n.realm(src.Addr())
+	if nat := n.publicNAT(dst.Addr()); nat != nil {
+		private, ok := nat.inbound(src, dst.Port(), now)
+		if !ok {
+			return netip.AddrPort{}, false
+		}
+		dst, from = private, nat
+	}
+	// Private hosts can only be reached from behind their NAT or through it.
+	if n.realm(dst.Addr()) != from {
+		return netip.AddrPort{}, false
+	}
+	for _, fw := range n.firewalls {
+		if fw.config.Hosts.Contains(dst.Addr()) && !fw.config.Hosts.Contains(src.Addr()) && !fw.allows(src, dst, now) {
+			return netip.AddrPort{}, false
+		}
+	}
+	return dst, true
+}
@@ -0,0 +1,227 @@
+package udpsim_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	dtp "github.com/WhilecodingDoLearn/dtp/pkg/protocol"
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	natPublic  = netip.MustParseAddr("203.0.113.1")
+	natPrivate = netip.MustParsePrefix("192.168.1.0/24")
+)
+
+// natTopology puts a host behind a NAT and three outside endpoints in front of it.
+type natTopology struct {
+	network *udpsim.Network
+	clock   *udpsim.VirtualClock
+	nat     *udpsim.NAT
+	host    *udpsim.UDPConn
+	// server is the endpoint the host talks to, samePort shares its IP, other is another host.
+	server, sameIP, other *udpsim.UDPConn
+}
+
+func newNATTopology(t *testing.T, natType udpsim.NATType, timeout time.Duration) *natTopology {
+	t.Helper()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Clock: clock})
+	nat, err := network.AddNAT(udpsim.NATConfig{Type: natType, Public: natPublic, Private: natPrivate, MappingTimeout: timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &natTopology{
+		network: network,
+		clock:   clock,
+		nat:     nat,
+		host:    listen(t, network, "192.168.1.2", 5000),
+		server:  listen(t, network, "198.51.100.1", 53),
+		sameIP:  listen(t, network, "198.51.100.1", 54),
+		other:   listen(t, network, "198.51.100.2", 53),
+	}
+}
+
+// exchange sends a datagram from one socket to addr and returns the source the receiver saw, nil if
+// nothing arrived.
+func (nt *natTopology) exchange(t *testing.T, from, to *udpsim.UDPConn, addr *udpsim.UDPAddr) *udpsim.UDPAddr {
+	t.Helper()
+	_, err := from.WriteToUDP([]byte("ping"), addr)
+	assert.Nil(t, err)
+	to.SetReadDeadline(nt.clock.Now().Add(time.Millisecond))
+	received, started := make(chan *udpsim.UDPAddr, 1), make(chan struct{})
+	go func() {
+		close(started)
+		_, src, err := to.ReadFromUDP(make([]byte, 16))
+		if err != nil {
+			src = nil
+		}
+		received <- src
+	}()
+	<-started
+	nt.network.Run(time.Millisecond)
+	return <-received
+}
+
+func TestNATFiltering(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		natType udpsim.NATType
+		// sameIP and other tell whether the other endpoints can send to the mapping of the server.
+		sameIP bool
+		other  bool
+		// samePort tells whether the host keeps its public port towards another destination.
+		samePort bool
+	}{
+		{name: "full-cone", natType: udpsim.FullCone, sameIP: true, other: true, samePort: true},
+		{name: "address-restricted", natType: udpsim.AddressRestricted, sameIP: true, other: false, samePort: true},
+		{name: "port-restricted", natType: udpsim.PortRestricted, sameIP: false, other: false, samePort: true},
+		{name: "symmetric", natType: udpsim.Symmetric, sameIP: false, other: false, samePort: false},
+	}
+
+	for _, subTest := range tests {
+		nt := newNATTopology(t, subTest.natType, 0)
+		mapped := nt.exchange(t, nt.host, nt.server, &udpsim.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53})
+		if !assert.NotNil(t, mapped, subTest.name) {
+			continue
+		}
+		assert.Equal(t, natPublic.String(), mapped.IP.String(), subTest.name)
+		assert.Len(t, nt.nat.Mappings(), 1, subTest.name)
+
+		assert.NotNil(t, nt.exchange(t, nt.server, nt.host, mapped), subTest.name)
+		assert.Equal(t, subTest.sameIP, nt.exchange(t, nt.sameIP, nt.host, mapped) != nil, subTest.name)
+		assert.Equal(t, subTest.other, nt.exchange(t, nt.other, nt.host, mapped) != nil, subTest.name)
+
+		second := nt.exchange(t, nt.host, nt.other, &udpsim.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 53})
+		if assert.NotNil(t, second, subTest.name) {
+			assert.Equal(t, subTest.samePort, mapped.Port == second.Port, subTest.name)
+		}
+	}
+}
+
+func TestNATMappingTimeout(t *testing.T) {
+	t.Parallel()
+	serverAddr := &udpsim.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53}
+	tests := []struct {
+		name      string
+		keepalive time.Duration
+		idle      time.Duration
+		// open tells whether the server can still reach the first mapping after idle.
+		open bool
+	}{
+		{name: "within timeout", idle: 29 * time.Second, open: true},
+		{name: "timed out", idle: 30 * time.Second, open: false},
+		{name: "kept alive", keepalive: 20 * time.Second, idle: 50 * time.Second, open: true},
+	}
+
+	for _, subTest := range tests {
+		nt := newNATTopology(t, udpsim.PortRestricted, 30*time.Second)
+		mapped := nt.exchange(t, nt.host, nt.server, serverAddr)
+		for elapsed := time.Duration(0); elapsed < subTest.idle; {
+			step := subTest.idle - elapsed
+			if subTest.keepalive > 0 && subTest.keepalive < step {
+				step = subTest.keepalive
+			}
+			nt.clock.Advance(step)
+			elapsed += step
+			if subTest.keepalive > 0 && elapsed < subTest.idle {
+				nt.exchange(t, nt.host, nt.server, serverAddr)
+			}
+		}
+		assert.Equal(t, subTest.open, nt.exchange(t, nt.server, nt.host, mapped) != nil, subTest.name)
+
+		// A new datagram of the host opens a new mapping.
+		if !subTest.open {
+			remapped := nt.exchange(t, nt.host, nt.server, serverAddr)
+			assert.NotEqual(t, mapped.Port, remapped.Port, subTest.name)
+		}
+	}
+}
+
+func TestNATRealms(t *testing.T) {
+	t.Parallel()
+	nt := newNATTopology(t, udpsim.FullCone, 0)
+	neighbour := listen(t, nt.network, "192.168.1.3", 5000)
+	hostAddr := &udpsim.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+
+	assert.Nil(t, nt.exchange(t, nt.server, nt.host, hostAddr), "private address from outside")
+	src := nt.exchange(t, neighbour, nt.host, hostAddr)
+	if assert.NotNil(t, src, "neighbour behind the same NAT") {
+		assert.Equal(t, "192.168.1.3:5000", src.String())
+	}
+	assert.Empty(t, nt.nat.Mappings())
+
+	_, err := nt.network.AddNAT(udpsim.NATConfig{Public: netip.MustParseAddr("203.0.113.2"), Private: netip.MustParsePrefix("192.168.0.0/16")})
+	assert.ErrorIs(t, err, udpsim.ErrNATOverlap)
+	_, err = nt.network.AddNAT(udpsim.NATConfig{Public: netip.MustParseAddr("10.0.0.1"), Private: netip.MustParsePrefix("10.0.0.0/8")})
+	assert.ErrorIs(t, err, udpsim.ErrNATAddress)
+}
+
+func TestFirewall(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Clock: clock})
+	_, err := network.AddFirewall(udpsim.FirewallConfig{Hosts: netip.MustParsePrefix("10.0.0.0/24"), Timeout: 10 * time.Second, OpenPorts: []uint16{443}})
+	assert.Nil(t, err)
+	nt := &natTopology{network: network, clock: clock}
+	inside := listen(t, network, "10.0.0.1", 5000)
+	service := listen(t, network, "10.0.0.1", 443)
+	outside := listen(t, network, "198.51.100.1", 53)
+	insideAddr := &udpsim.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	outsideAddr := &udpsim.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53}
+
+	assert.Nil(t, nt.exchange(t, outside, inside, insideAddr), "unsolicited")
+	assert.NotNil(t, nt.exchange(t, outside, service, &udpsim.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}), "open port")
+	assert.NotNil(t, nt.exchange(t, inside, outside, outsideAddr), "outbound")
+	assert.NotNil(t, nt.exchange(t, outside, inside, insideAddr), "answer")
+	clock.Advance(10 * time.Second)
+	assert.Nil(t, nt.exchange(t, outside, inside, insideAddr), "closed pinhole")
+}
+
+// TestNATRebinding lets the NAT mapping of an idle client time out. Its next message leaves from a new
+// public port, and the server migrates the session after validating the new path.
+func TestNATRebinding(t *testing.T) {
+	t.Parallel()
+	nt := newNATTopology(t, udpsim.PortRestricted, 30*time.Second)
+	migrated := make(chan struct{}, 1)
+	server, err := dtp.NewServer(nt.server, dtp.Options{
+		Clock:       nt.clock,
+		IdleTimeout: time.Hour,
+		OnMigrate:   func(*dtp.Session, net.Addr, net.Addr) { migrated <- struct{}{} },
+	})
+	assert.Nil(t, err)
+	go server.Serve()
+	defer server.Close()
+
+	var client *dtp.DTPConnection
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := dtp.Dial(nt.host, nt.server.LocalAddr(), dtp.Options{Clock: nt.clock})
+		client = conn
+		dialed <- err
+	}()
+	var dialErr error
+	assert.True(t, nt.network.RunUntil(received(dialed, &dialErr), time.Second))
+	if !assert.Nil(t, dialErr) {
+		return
+	}
+	go func() {
+		for {
+			if _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	before := accepted.Session().RemoteAddr().String()
+
+	nt.network.Run(time.Minute)
+	assert.Nil(t, client.WriteMessage(&dtp.Message{Data: []byte("still there")}))
+	assert.True(t, nt.network.RunUntil(func() bool { return len(migrated) > 0 }, time.Second))
+	assert.NotEqual(t, before, accepted.Session().RemoteAddr().String())
+}
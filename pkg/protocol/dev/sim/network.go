@@ -0,0 +1,333 @@
+package udpsim
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+)
+
+// firstEphemeralPort is the first port handed out to sockets bound to port 0.
+const firstEphemeralPort = 49152
+
+var (
+	ErrAddrInUse   = errors.New("udpsim: address already in use")
+	ErrUnreachable = errors.New("udpsim: destination unreachable")
+	ErrNoPorts     = errors.New("udpsim: no free ephemeral port")
+	// ErrClosed is net.ErrClosed, sockets wrap it in a *net.OpError like the ones of package net.
+	ErrClosed = net.ErrClosed
+)
+
+// settleQuiet is the wall time the network has to stay quiet before Run considers it settled.
+const settleQuiet = 200 * time.Microsecond
+
+// settleIdle is the wall time the network has to stay idle before Run considers it settled.
+const settleIdle = 50 * time.Microsecond
+
+// Options configure a Network.
+type Options struct {
+	// Link is the profile of all links that have none of their own, see SetLink.
+	Link LinkProfile
+	// Seed seeds the random source of the network, zero picks a random seed. Two networks with the
+	// same seed and the same datagrams sent in the same order lose and delay the same datagrams.
+	//
+	// The seed only covers the network. Whether a protocol on top sends the same datagrams in the same
+	// order is up to its goroutines: Run waits a few microseconds of wall time for them to settle
+	// before the clock moves on (see settleQuiet), and a goroutine that takes longer, or sends from
+	// two goroutines at once, changes the order and with it every random draw after it. Randomness of
+	// its own, like session ids or keys, is not seeded either. A seed replays a run of a protocol
+	// stack likely but not surely; the network alone replays exactly.
+	Seed int64
+	// Clock is the time source of the network, the wall clock if nil. With a VirtualClock the network
+	// only moves on through Run, RunUntil or by advancing the clock.
+	Clock Clock
+	// Capture is called with every datagram sent in the network once its fate is known, see SetCapture.
+	Capture capture.Hook
+}
+
+// Network is an isolated simulated network. Sockets are bound to an IP and a port, so hosts with
+// different IPs can use the same port, and datagrams only travel between sockets of the same
+// network. Every network has its own links and random source, tests build one each and can run in
+// parallel.
+type Network struct {
+	defaultLink LinkProfile
+	links       map[linkKey]*link
+	nats        []*NAT
+	firewalls   []*Firewall
+	faults      []*Fault
+	seed        int64
+	rand        *rand.Rand
+	clock       Clock
+	hook        capture.Hook
+	conns       map[netip.AddrPort]*UDPConn
+	// nextPort is the next ephemeral port tried for sockets bound to port 0.
+	nextPort int
+	// activity counts the reads and writes of all sockets, Run watches it to see the network settle.
+	activity atomic.Uint64
+	mux      sync.Mutex
+}
+
+// NewNetwork creates an empty network.
+func NewNetwork(opts Options) *Network {
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = wallClock{}
+	}
+	return &Network{
+		defaultLink: opts.Link,
+		links:       map[linkKey]*link{},
+		seed:        seed,
+		rand:        rand.New(rand.NewSource(seed)),
+		clock:       clock,
+		hook:        opts.Capture,
+		conns:       map[netip.AddrPort]*UDPConn{},
+		nextPort:    firstEphemeralPort,
+	}
+}
+
+// Seed returns the seed of the random source, log it to replay a failing run.
+func (n *Network) Seed() int64 {
+	return n.seed
+}
+
+// Clock returns the clock the network runs on.
+func (n *Network) Clock() Clock {
+	return n.clock
+}
+
+// Run lets d pass. On a VirtualClock it jumps from one timer to the next and lets the sockets settle
+// before each, so that a minute of simulated traffic takes milliseconds. On the wall clock it sleeps.
+func (n *Network) Run(d time.Duration) {
+	n.RunUntil(func() bool { return false }, d)
+}
+
+// RunUntil runs like Run until done reports true or max has passed. It reports whether done did.
+func (n *Network) RunUntil(done func() bool, max time.Duration) bool {
+	vc, ok := n.clock.(*VirtualClock)
+	if !ok {
+		end := time.Now().Add(max)
+		for !done() {
+			if !time.Now().Before(end) {
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return true
+	}
+
+	end := vc.Now().Add(max)
+	for {
+		n.settle()
+		if done() {
+			return true
+		}
+		if !vc.fireNext(end) {
+			vc.AdvanceTo(end)
+			n.settle()
+			return done()
+		}
+	}
+}
+
+// settle waits until every socket is blocked in a read with nothing left to read, or until no socket
+// read or wrote for settleQuiet.
+func (n *Network) settle() {
+	for {
+		runtime.Gosched()
+		activity := n.activity.Load()
+		if n.idle() {
+			// The goroutines behind the sockets, like the application on top of a protocol stack, may
+			// still be busy with what the sockets read last. They get a moment before the clock moves on.
+			time.Sleep(settleIdle)
+			if n.activity.Load() == activity && n.idle() {
+				return
+			}
+			continue
+		}
+		time.Sleep(settleQuiet)
+		if n.activity.Load() == activity {
+			return
+		}
+	}
+}
+
+func (n *Network) idle() bool {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	for _, c := range n.conns {
+		if c.readers.Load() == 0 || len(c.inbox) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetCapture replaces the capture hook, nil stops capturing. Every datagram is recorded once with
+// the time it was sent: when it is lost on the link, or when it reaches the receiving socket or is
+// dropped on the way. Copies of a duplicated datagram are recorded on their own.
+func (n *Network) SetCapture(hook capture.Hook) {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	n.hook = hook
+}
+
+func (n *Network) record(r capture.Record) {
+	n.mux.Lock()
+	hook := n.hook
+	n.mux.Unlock()
+	if hook != nil {
+		hook(r)
+	}
+}
+
+// ListenUDP binds a socket to laddr. An unspecified IP receives the datagrams for the port on every
+// IP that has no socket of its own, port 0 picks a free ephemeral port.
+func (n *Network) ListenUDP(laddr *UDPAddr) (*UDPConn, error) {
+	local := &UDPAddr{Port: laddr.Port}
+	if laddr.IP != nil {
+		local.IP = append(net.IP(nil), laddr.IP...)
+	}
+
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	ip := ipKey(local.IP)
+	if local.Port == 0 {
+		port, err := n.ephemeralPort(ip)
+		if err != nil {
+			return nil, err
+		}
+		local.Port = port
+	}
+	key := netip.AddrPortFrom(ip, uint16(local.Port))
+	if _, exists := n.conns[key]; exists {
+		return nil, ErrAddrInUse
+	}
+
+	c := &UDPConn{
+		net:    n,
+		local:  local,
+		key:    key,
+		inbox:  make(chan packet, inboxSize),
+		closed: make(chan struct{}),
+	}
+	c.readDeadline.init(n.clock)
+	c.writeDeadline.init(n.clock)
+	n.conns[key] = c
+	return c, nil
+}
+
+// DialUDP binds a socket to laddr whose Read and Write go to raddr.
+func (n *Network) DialUDP(laddr, raddr *UDPAddr) (*UDPConn, error) {
+	if raddr == nil {
+		return nil, &net.OpError{Op: "dial", Net: "udp", Source: laddr, Err: errMissingAddress}
+	}
+	c, err := n.ListenUDP(laddr)
+	if err != nil {
+		return nil, err
+	}
+	c.remote = &UDPAddr{IP: append(net.IP(nil), raddr.IP...), Port: raddr.Port, Zone: raddr.Zone}
+	return c, nil
+}
+
+// ephemeralPort returns a free port on ip, the caller holds the lock.
+func (n *Network) ephemeralPort(ip netip.Addr) (int, error) {
+	for i := 0; i < 1<<16-firstEphemeralPort; i++ {
+		port := n.nextPort
+		n.nextPort++
+		if n.nextPort >= 1<<16 {
+			n.nextPort = firstEphemeralPort
+		}
+		if _, used := n.conns[netip.AddrPortFrom(ip, uint16(port))]; !used {
+			return port, nil
+		}
+	}
+	return 0, ErrNoPorts
+}
+
+// bound returns the socket that receives datagrams for addr, the caller holds the lock.
+func (n *Network) bound(addr netip.AddrPort) *UDPConn {
+	if c, ok := n.conns[addr]; ok {
+		return c
+	}
+	any := netip.IPv4Unspecified()
+	if addr.Addr().Is6() {
+		any = netip.IPv6Unspecified()
+	}
+	return n.conns[netip.AddrPortFrom(any, addr.Port())]
+}
+
+// reachable reports whether a socket is bound to addr or addr belongs to a NAT.
+func (n *Network) reachable(addr netip.AddrPort) bool {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	return n.bound(addr) != nil || n.publicNAT(addr.Addr()) != nil
+}
+
+func (n *Network) unbind(c *UDPConn) {
+	defer n.mux.Unlock()
+	n.mux.Lock()
+	if n.conns[c.key] == c {
+		delete(n.conns, c.key)
+	}
+}
+
+// datagram is a datagram on its way through the network.
+type datagram struct {
+	// host is the address of the sending socket, src the source on the wire, which differs behind a NAT.
+	host netip.Addr
+	src  netip.AddrPort
+	dst  netip.AddrPort
+	sent time.Time
+}
+
+// deliver hands a datagram to the socket behind its destination once the delay of the copy d has
+// passed. A datagram that is filtered or cut off on the way, for a socket that is gone by then or
+// whose buffer is full is dropped. One for a frozen host waits until it thaws.
+func (n *Network) deliver(dg datagram, d delivery) {
+	var push func()
+	push = func() {
+		r := capture.Record{Time: dg.sent, Src: dg.src, Dst: dg.dst, Data: d.data, Dropped: true}
+		var c *UDPConn
+		n.mux.Lock()
+		to, ok := n.inbound(dg.src, dg.dst)
+		if ok && n.holdLocked(to.Addr(), push) {
+			n.mux.Unlock()
+			return
+		}
+		if ok && !n.cut(dg.host, to.Addr()) {
+			c = n.bound(to)
+		}
+		if c != nil && !c.accepts(dg.src) {
+			c = nil
+		}
+		n.mux.Unlock()
+		if c != nil {
+			select {
+			case <-c.closed:
+			case c.inbox <- packet{data: d.data, addr: udpAddr(dg.src)}:
+				r.Dropped, r.Delay = false, n.clock.Now().Sub(dg.sent)
+			default:
+			}
+		}
+		n.record(r)
+	}
+	if d.delay <= 0 {
+		push()
+		return
+	}
+	n.clock.AfterFunc(d.delay, push)
+}
+
+func udpAddr(addr netip.AddrPort) *UDPAddr {
+	return net.UDPAddrFromAddrPort(addr)
+}
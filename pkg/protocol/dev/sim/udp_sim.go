@@ -1,48 +1,25 @@
 package udpsim
 
 import (
-	"errors"
-	"fmt"
-	"math/rand"
 	"net"
+	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
-)
-
-// SimConfig steuert Paketverlust, Verzögerung und Reordering.
-type SimConfig struct {
-	LossRate    float64       // Wahrscheinlicher Paketverlust [0.0..1.0]
-	MinDelay    time.Duration // Minimale Verzögerung pro Paket
-	MaxDelay    time.Duration // Maximale Verzögerung pro Paket
-	ReorderRate float64       // Chance, zusätzliche Verzögerung zu applizieren (Reordering)
-}
 
-// Config enthält die globale Simulationseinstellung (kann zur Laufzeit geändert werden).
-var Config = SimConfig{
-	LossRate:    0.0,
-	MinDelay:    0,
-	MaxDelay:    0,
-	ReorderRate: 0.0,
-}
-
-func init() {
-	// Initialisiere Zufallsgenerator für Delay/Reorder
-	rand.Seed(time.Now().UnixNano())
-}
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+)
 
-// UDPAddr entspricht net.UDPAddr
-type UDPAddr struct {
-	IP   net.IP
-	Port int
-}
+// UDPAddr entspricht net.UDPAddr, die Sockets geben echte net.UDPAddr heraus
+type UDPAddr = net.UDPAddr
 
-func (a *UDPAddr) Network() string { return "udp" }
-func (a *UDPAddr) String() string  { return fmt.Sprintf("%s:%d", a.IP.String(), a.Port) }
+// inboxSize is the number of datagrams a socket buffers before it drops new ones.
+const inboxSize = 1024
 
-// intern verwaltete Registry von Ports zu Kanälen
 var (
-	registry   = make(map[int]chan packet)
-	registryMu sync.Mutex
+	_ net.PacketConn = (*UDPConn)(nil)
+	_ net.Conn       = (*UDPConn)(nil)
 )
 
 // packet definiert die UDP-Paket-Nachricht
@@ -51,110 +28,81 @@ type packet struct {
 	addr *UDPAddr
 }
 
-// UDPConn simuliert net.UDPConn
+// UDPConn simuliert net.UDPConn: ein net.PacketConn, mit DialUDP erstellt auch ein net.Conn.
+// Deadlines laufen auf der Uhr des Network und dürfen jederzeit gesetzt werden.
 type UDPConn struct {
+	net           *Network
 	local         *UDPAddr
+	key           netip.AddrPort
 	remote        *UDPAddr
 	inbox         chan packet
+	readers       atomic.Int32
 	closed        chan struct{}
 	closeOnce     sync.Once
-	readDeadline  time.Time
-	writeDeadline time.Time
+	killed        atomic.Bool
+	readDeadline  deadline
+	writeDeadline deadline
 }
 
-// ListenUDP öffnet eine simulierte "bind"-Verbindung
-func ListenUDP(laddr *UDPAddr) (*UDPConn, error) {
-	registryMu.Lock()
-	defer registryMu.Unlock()
-
-	if _, exists := registry[laddr.Port]; exists {
-		return nil, errors.New("port bereits belegt")
+// ReadFromUDP liest ein Paket und liefert Absenderadresse
+func (c *UDPConn) ReadFromUDP(b []byte) (int, *UDPAddr, error) {
+	c.net.activity.Add(1)
+	expired := c.readDeadline.wait()
+	select {
+	case <-c.closed:
+		return 0, nil, c.opError("read", nil, c.closedErr())
+	default:
 	}
-
-	inbox := make(chan packet, 1024)
-	registry[laddr.Port] = inbox
-
-	return &UDPConn{
-		local:  laddr,
-		inbox:  inbox,
-		closed: make(chan struct{}),
-	}, nil
-}
-
-// DialUDP verbindet lokal zu remote
-func DialUDP(laddr, raddr *UDPAddr) (*UDPConn, error) {
-	lc, err := ListenUDP(laddr)
-	if err != nil {
-		return nil, err
+	if c.readDeadline.exceeded() {
+		return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
 	}
-	lc.remote = raddr
-	return lc, nil
-}
 
-// ReadFromUDP liest ein Paket und liefert Absenderadresse
-func (c *UDPConn) ReadFromUDP(b []byte) (int, *UDPAddr, error) {
-	var timer <-chan time.Time
-	if !c.readDeadline.IsZero() {
-		dur := time.Until(c.readDeadline)
-		if dur <= 0 {
-			return 0, nil, errors.New("read deadline exceeded")
+	c.readers.Add(1)
+	defer c.readers.Add(-1)
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, c.opError("read", nil, c.closedErr())
+		case pkt := <-c.inbox:
+			c.net.activity.Add(1)
+			n := copy(b, pkt.data)
+			return n, pkt.addr, nil
+		case <-expired:
+			// Die Deadline kann inzwischen verschoben worden sein
+			if expired = c.readDeadline.wait(); c.readDeadline.exceeded() {
+				return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+			}
 		}
-		timer = time.After(dur)
 	}
+}
 
-	select {
-	case <-c.closed:
-		return 0, nil, errors.New("connection closed")
-	case pkt := <-c.inbox:
-		n := copy(b, pkt.data)
-		return n, pkt.addr, nil
-	case <-timer:
-		return 0, nil, errors.New("read deadline exceeded")
+// ReadFrom implementiert net.PacketConn
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDP(b)
+	if addr == nil {
+		return n, nil, err
 	}
+	return n, addr, err
 }
 
-// WriteToUDP schreibt ein Paket an addr (mit Loss, Delay, Reorder)
+// WriteToUDP schreibt ein Paket über den Link zu addr, siehe LinkProfile
 func (c *UDPConn) WriteToUDP(b []byte, addr *UDPAddr) (int, error) {
-	registryMu.Lock()
-	ch, exists := registry[addr.Port]
-	registryMu.Unlock()
-	if !exists {
-		return 0, errors.New("Zielport nicht erreichbar")
+	if c.remote != nil {
+		return 0, c.opError("write", addr, net.ErrWriteToConnected)
 	}
-
-	// 1) Paketverlust
-	if rand.Float64() < Config.LossRate {
-		return len(b), nil // Paket geht verloren, aber wir tun so, als sei es gesendet
-	}
-
-	// 2) Basis-Verzögerung zufällig zwischen MinDelay und MaxDelay
-	var delay time.Duration
-	if Config.MaxDelay > Config.MinDelay {
-		delta := Config.MaxDelay - Config.MinDelay
-		delay = Config.MinDelay + time.Duration(rand.Int63n(int64(delta)))
+	if addr == nil {
+		return 0, c.opError("write", nil, errMissingAddress)
 	}
+	return c.write(b, addr)
+}
 
-	// 3) Reordering: gelegentlich noch mehr Verzögerung draufpacken
-	if rand.Float64() < Config.ReorderRate && Config.MaxDelay > 0 {
-		extra := time.Duration(rand.Int63n(int64(Config.MaxDelay)))
-		delay += extra
+// WriteTo implementiert net.PacketConn, addr muss eine *UDPAddr sein
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.local, Addr: addr, Err: net.InvalidAddrError("not a UDP address")}
 	}
-
-	// 4) Deferred Send in eigener Goroutine
-	pkt := packet{data: append([]byte(nil), b...), addr: c.local}
-	go func() {
-		select {
-		case <-c.closed:
-			return
-		case <-time.After(delay):
-			select {
-			case ch <- pkt:
-			case <-c.closed:
-			}
-		}
-	}()
-
-	return len(b), nil
+	return c.WriteToUDP(b, udpAddr)
 }
 
 // Read und Write nutzen ReadFromUDP/WriteToUDP mit gespeicherter remote-Adresse
@@ -164,37 +112,185 @@ func (c *UDPConn) Read(b []byte) (int, error) {
 }
 
 func (c *UDPConn) Write(b []byte) (int, error) {
-	return c.WriteToUDP(b, c.remote)
+	if c.remote == nil {
+		return 0, c.opError("write", nil, errMissingAddress)
+	}
+	return c.write(b, c.remote)
 }
 
-// Close schließt die Verbindung
+func (c *UDPConn) write(b []byte, addr *UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", addr, c.closedErr())
+	default:
+	}
+	if c.writeDeadline.exceeded() {
+		return 0, c.opError("write", addr, os.ErrDeadlineExceeded)
+	}
+	dst := netip.AddrPortFrom(ipKey(addr.IP), uint16(addr.Port))
+	if !c.net.reachable(dst) {
+		return 0, c.opError("write", addr, ErrUnreachable)
+	}
+	c.net.activity.Add(1)
+
+	// Verlorene Pakete gelten trotzdem als gesendet, ein eingefrorener Host sendet später
+	data := append([]byte(nil), b...)
+	send := func() { c.send(data, dst) }
+	if !c.net.hold(c.key.Addr(), send) {
+		send()
+	}
+	return len(b), nil
+}
+
+// send puts a datagram on the link to dst.
+func (c *UDPConn) send(data []byte, dst netip.AddrPort) {
+	dg := datagram{host: c.key.Addr(), src: c.key, dst: dst, sent: c.net.clock.Now()}
+	src, ok := c.net.outbound(c.key, dst)
+	if !ok {
+		c.net.record(capture.Record{Time: dg.sent, Src: c.key, Dst: dst, Data: data, Dropped: true})
+		return
+	}
+	dg.src = src
+	deliveries := c.net.impair(c.key.Addr(), dst.Addr(), data)
+	if len(deliveries) == 0 {
+		c.net.record(capture.Record{Time: dg.sent, Src: src, Dst: dst, Data: data, Dropped: true})
+	}
+	for _, d := range deliveries {
+		c.net.deliver(dg, d)
+	}
+}
+
+// Close schließt die Verbindung, blockierte Reads kehren mit net.ErrClosed zurück
 func (c *UDPConn) Close() error {
+	err := c.opError("close", nil, net.ErrClosed)
 	c.closeOnce.Do(func() {
 		close(c.closed)
-		registryMu.Lock()
-		delete(registry, c.local.Port)
-		registryMu.Unlock()
+		c.net.unbind(c)
+		c.readDeadline.set(time.Time{})
+		c.writeDeadline.set(time.Time{})
+		err = nil
 	})
-	return nil
+	return err
 }
 
-// LocalAddr und RemoteAddr
-func (c *UDPConn) LocalAddr() net.Addr  { return c.local }
-func (c *UDPConn) RemoteAddr() net.Addr { return c.remote }
+// Kill beendet den Socket abrupt wie ein abgestürzter Prozess: blockierte und spätere Reads und
+// Writes kehren mit ErrKilled zurück, Pakete für seine Adresse werden verworfen
+func (c *UDPConn) Kill() {
+	c.killed.Store(true)
+	c.Close()
+}
+
+// closedErr ist der Fehler eines geschlossenen Sockets
+func (c *UDPConn) closedErr() error {
+	if c.killed.Load() {
+		return ErrKilled
+	}
+	return net.ErrClosed
+}
+
+// LocalAddr und RemoteAddr, RemoteAddr ist nil ohne DialUDP
+func (c *UDPConn) LocalAddr() net.Addr { return c.local }
 
-// Deadlines setzen
+func (c *UDPConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return nil
+	}
+	return c.remote
+}
+
+// Deadlines setzen, auch während gelesen wird
 func (c *UDPConn) SetDeadline(t time.Time) error {
-	c.readDeadline = t
-	c.writeDeadline = t
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
 func (c *UDPConn) SetReadDeadline(t time.Time) error {
-	c.readDeadline = t
+	c.readDeadline.set(t)
 	return nil
 }
 
 func (c *UDPConn) SetWriteDeadline(t time.Time) error {
-	c.writeDeadline = t
+	c.writeDeadline.set(t)
 	return nil
 }
+
+// accepts reports whether the socket takes a datagram from src, a dialed socket only takes the ones
+// of its remote address.
+func (c *UDPConn) accepts(src netip.AddrPort) bool {
+	if c.remote == nil {
+		return true
+	}
+	return netip.AddrPortFrom(ipKey(c.remote.IP), uint16(c.remote.Port)) == src
+}
+
+func (c *UDPConn) opError(op string, addr *UDPAddr, err error) error {
+	opErr := &net.OpError{Op: op, Net: "udp", Source: c.local, Err: err}
+	if addr != nil {
+		opErr.Addr = addr
+	}
+	return opErr
+}
+
+var errMissingAddress = &net.AddrError{Err: "missing address"}
+
+// deadline is a read or write deadline on the clock of the network. Waiting operations select on the
+// channel of wait, it is closed when the deadline passes or is moved, so they can look again.
+type deadline struct {
+	clock Clock
+	t     time.Time
+	stop  func() bool
+	// changed is closed once t passed or t is set anew.
+	changed chan struct{}
+	mux     sync.Mutex
+}
+
+func (d *deadline) init(clock Clock) {
+	d.clock = clock
+	d.changed = make(chan struct{})
+}
+
+// wait returns a channel that is closed when the deadline passes or changes.
+func (d *deadline) wait() <-chan struct{} {
+	defer d.mux.Unlock()
+	d.mux.Lock()
+	return d.changed
+}
+
+// exceeded reports whether the deadline is set and passed.
+func (d *deadline) exceeded() bool {
+	defer d.mux.Unlock()
+	d.mux.Lock()
+	return !d.t.IsZero() && !d.clock.Now().Before(d.t)
+}
+
+// set moves the deadline to t, the zero time clears it.
+func (d *deadline) set(t time.Time) {
+	defer d.mux.Unlock()
+	d.mux.Lock()
+	if d.stop != nil {
+		d.stop()
+		d.stop = nil
+	}
+	d.t = t
+	d.notify()
+	if t.IsZero() {
+		return
+	}
+	if dur := t.Sub(d.clock.Now()); dur > 0 {
+		d.stop = d.clock.AfterFunc(dur, func() {
+			defer d.mux.Unlock()
+			d.mux.Lock()
+			// A timer stopped too late must not wake the waiters of a newer deadline.
+			if d.t.Equal(t) {
+				d.notify()
+			}
+		})
+	}
+}
+
+// notify wakes everybody waiting on the deadline, the caller holds the lock.
+func (d *deadline) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
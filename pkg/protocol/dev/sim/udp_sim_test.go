@@ -0,0 +1,512 @@
+package udpsim_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	dtp "github.com/WhilecodingDoLearn/dtp/pkg/protocol"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func listen(t *testing.T, network *udpsim.Network, ip string, port int) *udpsim.UDPConn {
+	t.Helper()
+	conn, err := network.ListenUDP(&udpsim.UDPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestNetworkAddresses(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		bound []string
+		bind  string
+		err   error
+		// to is sent a datagram from a fresh socket, it has to arrive at the socket bound to at.
+		to string
+		at string
+	}{
+		{name: "same port on another ip", bound: []string{"10.0.0.1:53"}, bind: "10.0.0.2:53", to: "10.0.0.2:53", at: "10.0.0.2:53"},
+		{name: "address in use", bound: []string{"10.0.0.1:53"}, bind: "10.0.0.1:53", err: udpsim.ErrAddrInUse},
+		{name: "unspecified ip receives for every ip", bound: []string{"0.0.0.0:53"}, bind: "10.0.0.1:54", to: "10.0.0.7:53", at: "0.0.0.0:53"},
+		{name: "specific ip wins over unspecified", bound: []string{"0.0.0.0:53"}, bind: "10.0.0.1:53", to: "10.0.0.1:53", at: "10.0.0.1:53"},
+		{name: "ephemeral port", bind: "10.0.0.1:0", to: "10.0.0.1:49152", at: "10.0.0.1:0"},
+	}
+
+	for _, subTest := range tests {
+		network := udpsim.NewNetwork(udpsim.Options{})
+		conns := map[string]*udpsim.UDPConn{}
+		for _, addr := range append(subTest.bound, subTest.bind) {
+			conn, err := network.ListenUDP(udpAddr(t, addr))
+			if err != nil {
+				assert.ErrorIs(t, err, subTest.err, subTest.name)
+				continue
+			}
+			t.Cleanup(func() { conn.Close() })
+			conns[addr] = conn
+		}
+		if subTest.err != nil {
+			continue
+		}
+
+		sender := listen(t, network, "10.0.0.9", 0)
+		_, err := sender.WriteToUDP([]byte("ping"), udpAddr(t, subTest.to))
+		assert.Nil(t, err, subTest.name)
+
+		conn := conns[subTest.at]
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 16)
+		n, from, err := conn.ReadFromUDP(buf)
+		assert.Nil(t, err, subTest.name)
+		assert.Equal(t, "ping", string(buf[:n]), subTest.name)
+		assert.Equal(t, sender.LocalAddr().String(), from.String(), subTest.name)
+	}
+}
+
+func TestNetworksAreIsolated(t *testing.T) {
+	t.Parallel()
+	first, second := udpsim.NewNetwork(udpsim.Options{}), udpsim.NewNetwork(udpsim.Options{})
+	outside := listen(t, first, "10.0.0.1", 53)
+	inside := listen(t, second, "10.0.0.1", 53)
+
+	sender := listen(t, second, "10.0.0.2", 53)
+	_, err := sender.WriteToUDP([]byte("ping"), &udpsim.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53})
+	assert.Nil(t, err)
+	_, err = sender.WriteToUDP([]byte("ping"), &udpsim.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 53})
+	assert.ErrorIs(t, err, udpsim.ErrUnreachable)
+
+	buf := make([]byte, 16)
+	inside.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = inside.ReadFromUDP(buf)
+	assert.Nil(t, err)
+	outside.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = outside.ReadFromUDP(buf)
+	assert.Error(t, err)
+}
+
+func udpAddr(t *testing.T, s string) *udpsim.UDPAddr {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &udpsim.UDPAddr{IP: addr.IP, Port: addr.Port}
+}
+
+// TestSeedReplay sends the same datagrams over two lossy networks with the same seed, they have to
+// lose and reorder the same ones.
+func TestSeedReplay(t *testing.T) {
+	t.Parallel()
+	run := func(seed int64) []byte {
+		clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+		network := udpsim.NewNetwork(udpsim.Options{
+			Link:  udpsim.LinkProfile{LossRate: 0.3, MaxDelay: 50 * time.Millisecond, ReorderRate: 0.5},
+			Seed:  seed,
+			Clock: clock,
+		})
+		assert.Equal(t, seed, network.Seed())
+		receiver := listen(t, network, "10.0.0.1", 53)
+		sender := listen(t, network, "10.0.0.2", 53)
+		done := make(chan []byte)
+		go func() {
+			var received []byte
+			buf := make([]byte, 1)
+			for {
+				if _, _, err := receiver.ReadFromUDP(buf); err != nil {
+					done <- received
+					return
+				}
+				received = append(received, buf[0])
+			}
+		}()
+
+		for i := 0; i < 100; i++ {
+			sender.WriteToUDP([]byte{byte(i)}, &udpsim.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53})
+		}
+		network.Run(time.Second)
+		receiver.Close()
+		return <-done
+	}
+
+	first := run(42)
+	assert.Less(t, len(first), 100)
+	assert.Equal(t, first, run(42))
+	assert.NotEqual(t, first, run(43))
+}
+
+// TestIdleTimeoutOnVirtualClock lets a session of the real protocol stack idle into its timeout. The
+// 30 seconds pass on the virtual clock only.
+func TestIdleTimeoutOnVirtualClock(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: 10 * time.Millisecond}, Clock: clock})
+	serverConn := listen(t, network, "10.0.0.1", 9000)
+	server, err := dtp.NewServer(serverConn, dtp.Options{Clock: clock, IdleTimeout: 30 * time.Second})
+	assert.Nil(t, err)
+	go server.Serve()
+	defer server.Close()
+
+	clientConn := listen(t, network, "10.0.0.2", 0)
+	dialed, closed := make(chan error, 1), make(chan error, 1)
+	go func() {
+		client, err := dtp.Dial(clientConn, serverConn.LocalAddr(), dtp.Options{Clock: clock})
+		dialed <- err
+		if err != nil {
+			return
+		}
+		_, err = client.ReadMessage()
+		closed <- err
+	}()
+
+	started, began := time.Now(), clock.Now()
+	var dialErr, readErr error
+	assert.True(t, network.RunUntil(received(dialed, &dialErr), time.Second))
+	assert.Nil(t, dialErr)
+	assert.True(t, network.RunUntil(received(closed, &readErr), time.Minute))
+	assert.ErrorIs(t, readErr, io.EOF)
+	assert.GreaterOrEqual(t, clock.Now().Sub(began), 30*time.Second)
+	assert.Less(t, time.Since(started), 5*time.Second)
+	assert.Equal(t, 0, server.Sessions().Size())
+}
+
+// TestAmplificationLimit floods the server with small requests that never complete the handshake.
+// Until the address is validated the answers stay within factor times the flood and use up that
+// budget; once a client completed the handshake from the address the server sends it as much as
+// the application writes.
+func TestAmplificationLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   dtp.Options
+		factor int
+		// limited is set if the answers outgrow factor times the requests, so that the server has to stop.
+		limited bool
+	}{
+		{name: "retry tokens with default factor", opts: dtp.Options{RetryMode: dtp.RetryAlways}, factor: 3},
+		{name: "retry tokens with factor 1", opts: dtp.Options{RetryMode: dtp.RetryAlways, AmplificationFactor: 1}, factor: 1, limited: true},
+		{name: "sessions with factor 1", opts: dtp.Options{AmplificationFactor: 1}, factor: 1, limited: true},
+	}
+
+	t.Parallel()
+	serverAddr, clientAddr := netip.MustParseAddrPort("10.0.0.1:9000"), netip.MustParseAddrPort("10.0.0.2:9000")
+	for _, subTest := range tests {
+		clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+		var recorder capture.Recorder
+		network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: time.Millisecond}, Clock: clock, Capture: recorder.Hook()})
+		serverConn := listen(t, network, "10.0.0.1", 9000)
+		opts := subTest.opts
+		opts.Clock = clock
+		server, err := dtp.NewServer(serverConn, opts)
+		assert.Nil(t, err, subTest.name)
+		go server.Serve()
+
+		// bytes sums the datagrams between client and server from the first record on.
+		bytes := func(first int) (fromClient, toClient, largestRequest, largestAnswer int) {
+			for _, r := range recorder.Records()[first:] {
+				switch {
+				case r.Src == clientAddr && r.Dst == serverAddr:
+					fromClient += len(r.Data)
+					largestRequest = max(largestRequest, len(r.Data))
+				case r.Src == serverAddr && r.Dst == clientAddr:
+					toClient += len(r.Data)
+					largestAnswer = max(largestAnswer, len(r.Data))
+				}
+			}
+			return fromClient, toClient, largestRequest, largestAnswer
+		}
+
+		clientConn := listen(t, network, "10.0.0.2", 9000)
+		for sid := 0; sid < 50; sid++ {
+			req := codec.Encode(codec.Package{SessionID: sid % 5, MSgCode: codec.REQ})
+			_, err := clientConn.WriteToUDP(req, serverConn.LocalAddr().(*udpsim.UDPAddr))
+			assert.Nil(t, err, subTest.name)
+		}
+		clientConn.SetReadDeadline(clock.Now().Add(time.Second))
+		drained := make(chan error, 1)
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				if _, _, err := clientConn.ReadFrom(buf); err != nil {
+					drained <- err
+					return
+				}
+			}
+		}()
+		var drainErr error
+		assert.True(t, network.RunUntil(received(drained, &drainErr), 2*time.Second), subTest.name)
+		assert.ErrorIs(t, drainErr, os.ErrDeadlineExceeded, subTest.name)
+
+		flood, answers, largestRequest, largestAnswer := bytes(0)
+		assert.Greater(t, answers, 0, subTest.name)
+		assert.LessOrEqual(t, answers, subTest.factor*flood, subTest.name)
+		if subTest.limited {
+			assert.Greater(t, answers+largestAnswer+subTest.factor*largestRequest, subTest.factor*flood, "budget used up: "+subTest.name)
+			assert.Greater(t, server.Stats().AmplificationLimited, uint64(0), subTest.name)
+		} else {
+			assert.Equal(t, uint64(0), server.Stats().AmplificationLimited, "every request answered: "+subTest.name)
+		}
+
+		// The handshake validates the address, from then on the answers are no longer limited.
+		clientConn.SetReadDeadline(time.Time{})
+		dialed, read := make(chan error, 1), make(chan error, 1)
+		go func() {
+			client, err := dtp.Dial(clientConn, serverConn.LocalAddr(), dtp.Options{Clock: clock})
+			dialed <- err
+			if err != nil {
+				return
+			}
+			for i := 0; i < 20; i++ {
+				if _, err := client.ReadMessage(); err != nil {
+					read <- err
+					return
+				}
+			}
+			read <- nil
+		}()
+		var dialErr, readErr error
+		assert.True(t, network.RunUntil(received(dialed, &dialErr), 10*time.Second), subTest.name)
+		if !assert.Nil(t, dialErr, subTest.name) {
+			server.Close()
+			continue
+		}
+		accepted, err := server.Accept()
+		assert.Nil(t, err, subTest.name)
+		limited, validated := server.Stats().AmplificationLimited, len(recorder.Records())
+		for i := 0; i < 20; i++ {
+			assert.Nil(t, accepted.WriteMessage(&dtp.Message{Data: make([]byte, 500)}), subTest.name)
+		}
+		assert.True(t, network.RunUntil(received(read, &readErr), 10*time.Second), subTest.name)
+		assert.Nil(t, readErr, "every message arrived: "+subTest.name)
+
+		sent, data, _, _ := bytes(validated)
+		assert.Greater(t, data, subTest.factor*(flood+sent), "no limit after validation: "+subTest.name)
+		assert.Equal(t, limited, server.Stats().AmplificationLimited, subTest.name)
+		server.Close()
+	}
+}
+
+// received reports whether c delivered its error, which it stores in err.
+func received(c chan error, err *error) func() bool {
+	return func() bool {
+		select {
+		case *err = <-c:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		// prepare runs before the read, during runs while it is blocked.
+		prepare func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock)
+		during  func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock)
+		timeout bool
+		closed  bool
+		// after is the virtual time the read returned at.
+		after time.Duration
+	}{
+		{
+			name:    "deadline passed",
+			prepare: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) { conn.SetReadDeadline(clock.Now()) },
+			timeout: true,
+		},
+		{
+			name: "deadline passes while reading",
+			prepare: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) {
+				conn.SetReadDeadline(clock.Now().Add(time.Second))
+			},
+			timeout: true, after: time.Second,
+		},
+		{
+			name: "deadline extended while reading",
+			prepare: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) {
+				conn.SetReadDeadline(clock.Now().Add(time.Second))
+			},
+			during: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) {
+				conn.SetDeadline(clock.Now().Add(3 * time.Second))
+			},
+			timeout: true, after: 3 * time.Second,
+		},
+		{
+			name: "deadline moved into the past while reading",
+			prepare: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) {
+				conn.SetReadDeadline(clock.Now().Add(time.Hour))
+			},
+			during: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) {
+				conn.SetReadDeadline(clock.Now().Add(-time.Second))
+			},
+			timeout: true,
+		},
+		{
+			name: "deadline cleared while reading",
+			prepare: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) {
+				conn.SetReadDeadline(clock.Now().Add(time.Second))
+			},
+			during: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) {
+				conn.SetReadDeadline(time.Time{})
+				clock.Advance(time.Minute)
+				conn.Close()
+			},
+			closed: true, after: time.Minute,
+		},
+		{
+			name:   "closed while reading",
+			during: func(conn *udpsim.UDPConn, clock *udpsim.VirtualClock) { conn.Close() },
+			closed: true,
+		},
+	}
+
+	for _, subTest := range tests {
+		clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+		network := udpsim.NewNetwork(udpsim.Options{Clock: clock})
+		conn := listen(t, network, "10.0.0.1", 53)
+		if subTest.prepare != nil {
+			subTest.prepare(conn, clock)
+		}
+		done := make(chan error, 1)
+		var returned time.Time
+		go func() {
+			_, _, err := conn.ReadFrom(make([]byte, 16))
+			returned = clock.Now()
+			done <- err
+		}()
+		network.Run(0)
+		if subTest.during != nil {
+			subTest.during(conn, clock)
+		}
+		network.Run(time.Hour)
+		err := <-done
+
+		var netErr net.Error
+		if assert.ErrorAs(t, err, &netErr, subTest.name) {
+			assert.Equal(t, subTest.timeout, netErr.Timeout(), subTest.name)
+		}
+		assert.Equal(t, subTest.timeout, errors.Is(err, os.ErrDeadlineExceeded), subTest.name)
+		assert.Equal(t, subTest.closed, errors.Is(err, net.ErrClosed), subTest.name)
+		assert.Equal(t, subTest.after, returned.Sub(time.Unix(0, 0)), subTest.name)
+	}
+}
+
+func TestConnInterfaces(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Clock: clock})
+	server := listen(t, network, "10.0.0.1", 53)
+	other := listen(t, network, "10.0.0.3", 53)
+	dialed, err := network.DialUDP(&udpsim.UDPAddr{IP: hostB}, server.LocalAddr().(*udpsim.UDPAddr))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer dialed.Close()
+
+	var conn net.Conn = dialed
+	assert.Equal(t, server.LocalAddr(), conn.RemoteAddr())
+	assert.Nil(t, server.RemoteAddr())
+	_, err = dialed.WriteTo([]byte("x"), server.LocalAddr())
+	assert.ErrorIs(t, err, net.ErrWriteToConnected)
+	_, err = server.Write([]byte("x"))
+	assert.NotNil(t, err)
+
+	// A dialed socket only reads datagrams from its remote address.
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(t, err)
+	var pc net.PacketConn = server
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "ping", string(buf[:n]))
+		assert.Equal(t, dialed.LocalAddr().String(), from.String())
+	}
+	_, err = other.WriteTo([]byte("spoof"), dialed.LocalAddr())
+	assert.Nil(t, err)
+	_, err = server.WriteTo([]byte("pong"), from)
+	assert.Nil(t, err)
+	n, err = conn.Read(buf)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "pong", string(buf[:n]))
+	}
+
+	// The write deadline fails writes once it passed.
+	assert.Nil(t, server.SetWriteDeadline(clock.Now().Add(time.Second)))
+	_, err = server.WriteTo([]byte("x"), from)
+	assert.Nil(t, err)
+	clock.Advance(time.Second)
+	_, err = server.WriteTo([]byte("x"), from)
+	var netErr net.Error
+	if assert.ErrorAs(t, err, &netErr) {
+		assert.True(t, netErr.Timeout())
+	}
+	assert.Nil(t, server.SetWriteDeadline(time.Time{}))
+	_, err = server.WriteTo([]byte("x"), from)
+	assert.Nil(t, err)
+
+	assert.Nil(t, server.Close())
+	_, err = server.WriteTo([]byte("x"), from)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.ErrorIs(t, server.Close(), net.ErrClosed)
+}
+
+// TestCapture records one datagram of every fate: delivered, delayed, lost on the link and arriving
+// after the receiver closed.
+func TestCapture(t *testing.T) {
+	t.Parallel()
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	var recorder capture.Recorder
+	network := udpsim.NewNetwork(udpsim.Options{Clock: clock, Capture: recorder.Hook()})
+	network.SetLink(hostA, hostB, udpsim.LinkProfile{MinDelay: 10 * time.Millisecond})
+	network.SetLink(hostB, net.ParseIP("10.0.0.3"), udpsim.LinkProfile{LossRate: 1})
+	network.SetLink(hostA, net.ParseIP("10.0.0.3"), udpsim.LinkProfile{MinDelay: time.Millisecond})
+	a := listen(t, network, "10.0.0.1", 53)
+	b := listen(t, network, "10.0.0.2", 53)
+	c := listen(t, network, "10.0.0.3", 53)
+	toA, toB := receive(a, clock), receive(b, clock)
+
+	send := func(from *udpsim.UDPConn, to *udpsim.UDPConn, data string) {
+		_, err := from.WriteTo([]byte(data), to.LocalAddr())
+		assert.Nil(t, err)
+	}
+	send(b, a, "delivered")
+	send(a, b, "delayed")
+	send(b, c, "lost")
+	send(a, c, "gone")
+	c.Close()
+	network.Run(time.Second)
+	a.Close()
+	b.Close()
+	<-toA
+	<-toB
+
+	var pcapng bytes.Buffer
+	w, err := capture.NewPcapngWriter(&pcapng)
+	assert.Nil(t, err)
+	fates := map[string]capture.Record{}
+	for _, r := range recorder.Records() {
+		fates[string(r.Data)] = r
+		assert.Nil(t, w.WriteRecord(r))
+	}
+	assert.Len(t, fates, 4)
+	assert.Equal(t, netip.MustParseAddrPort("10.0.0.2:53"), fates["delivered"].Src)
+	assert.Equal(t, netip.MustParseAddrPort("10.0.0.1:53"), fates["delivered"].Dst)
+	assert.False(t, fates["delivered"].Dropped || fates["delivered"].Delayed())
+	assert.True(t, fates["delayed"].Delayed())
+	assert.Equal(t, 10*time.Millisecond, fates["delayed"].Delay)
+	assert.True(t, fates["lost"].Dropped)
+	assert.True(t, fates["gone"].Dropped)
+	assert.Equal(t, time.Unix(0, 0), fates["delayed"].Time)
+	assert.Contains(t, pcapng.String(), "delayed 10ms")
+}
@@ -0,0 +1,96 @@
+// Package dissect decodes captured DTP datagrams into a timeline, like a Wireshark dissector.
+package dissect
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+)
+
+// Frame is a dissected datagram. Durations are in nanoseconds in JSON.
+type Frame struct {
+	// Index counts the datagrams of the input from 1, it stays the same when frames are filtered.
+	Index int `json:"index"`
+	// Time is zero for dumps, which have no timestamps. Offset is the time since the first datagram.
+	Time    time.Time      `json:"time,omitzero"`
+	Offset  time.Duration  `json:"offset"`
+	Src     netip.AddrPort `json:"src,omitzero"`
+	Dst     netip.AddrPort `json:"dst,omitzero"`
+	Size    int            `json:"size"`
+	Dropped bool           `json:"dropped,omitempty"`
+	Delay   time.Duration  `json:"delay,omitempty"`
+	// Message is nil if the datagram could not be decoded, Error says why.
+	Message *Message `json:"message,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Message is the decoded package of a datagram.
+type Message struct {
+	SessionID  int         `json:"session_id"`
+	UserID     int         `json:"user_id"`
+	Code       codec.State `json:"code"`
+	PacketID   int         `json:"packet_id"`
+	FrameBegin int         `json:"frame_begin"`
+	FrameEnd   int         `json:"frame_end"`
+	// PayloadLength is the length the package announces, PayloadSize the bytes it carries.
+	PayloadLength int    `json:"payload_length"`
+	PayloadSize   int    `json:"payload_size"`
+	RemoteAddr    string `json:"remote_addr,omitempty"`
+}
+
+// Dissect decodes the datagrams with the codec package, in the order of the records.
+func Dissect(records []capture.Record) []Frame {
+	frames := make([]Frame, 0, len(records))
+	var first time.Time
+	for i, r := range records {
+		if i == 0 {
+			first = r.Time
+		}
+		f := Frame{Index: i + 1, Time: r.Time, Src: r.Src, Dst: r.Dst, Size: len(r.Data), Dropped: r.Dropped, Delay: r.Delay}
+		if !r.Time.IsZero() && !first.IsZero() {
+			f.Offset = r.Time.Sub(first)
+		}
+		p, err := codec.Decode(r.Data)
+		if err != nil {
+			f.Error = err.Error()
+			frames = append(frames, f)
+			continue
+		}
+		f.Message = &Message{
+			SessionID:     p.SessionID,
+			UserID:        p.UserID,
+			Code:          p.MSgCode,
+			PacketID:      p.PackedID,
+			FrameBegin:    p.FrameBegin,
+			FrameEnd:      p.FrameEnd,
+			PayloadLength: p.PayloadLength,
+			PayloadSize:   len(p.Payload),
+		}
+		if p.Rma != nil {
+			f.Message.RemoteAddr = p.Rma.String()
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// FilterSessions returns the frames of the sessions, frames that could not be decoded belong to none.
+// Without ids all frames are returned.
+func FilterSessions(frames []Frame, ids ...int) []Frame {
+	if len(ids) == 0 {
+		return frames
+	}
+	wanted := map[int]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var filtered []Frame
+	for _, f := range frames {
+		if f.Message != nil && wanted[f.Message.SessionID] {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,144 @@
+package dissect
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDissect(t *testing.T) {
+	start := time.Unix(100, 0)
+	tests := []struct {
+		name    string
+		record  capture.Record
+		message *Message
+		err     string
+		offset  time.Duration
+	}{
+		{
+			name:    "request",
+			record:  capture.Record{Time: start, Data: codec.Encode(codec.Package{SessionID: 7, UserID: 222, MSgCode: codec.REQ, FrameEnd: 3})},
+			message: &Message{SessionID: 7, UserID: 222, Code: codec.REQ, FrameEnd: 3},
+		},
+		{
+			name:    "payload and remote address",
+			record:  capture.Record{Time: start.Add(time.Millisecond), Data: codec.Encode(codec.Package{SessionID: 7, MSgCode: codec.ALI, PackedID: 2, FrameBegin: 4, FrameEnd: 7, PayloadLength: 4, Payload: []byte("ABCD"), Rma: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}})},
+			message: &Message{SessionID: 7, Code: codec.ALI, PacketID: 2, FrameBegin: 4, FrameEnd: 7, PayloadLength: 4, PayloadSize: 4, RemoteAddr: "10.0.0.1:53"},
+			offset:  time.Millisecond,
+		},
+		{
+			name:   "no message code",
+			record: capture.Record{Time: start.Add(time.Second), Data: []byte("Sid:7|Uid:0|Msg:10|PId:0|Bid:0|Lid:0|Tol:0|Pyl:|Rma:")},
+			err:    "Msg: 10 is no message code", offset: time.Second,
+		},
+		{name: "garbage", record: capture.Record{Time: start.Add(time.Second), Data: []byte{0xff, 0x00}}, err: "invalid field", offset: time.Second},
+	}
+
+	var records []capture.Record
+	for _, subTest := range tests {
+		records = append(records, subTest.record)
+	}
+	frames := Dissect(records)
+	for i, subTest := range tests {
+		f := frames[i]
+		assert.Equal(t, i+1, f.Index, subTest.name)
+		assert.Equal(t, subTest.offset, f.Offset, subTest.name)
+		assert.Equal(t, len(subTest.record.Data), f.Size, subTest.name)
+		assert.Equal(t, subTest.message, f.Message, subTest.name)
+		if subTest.err == "" {
+			assert.Empty(t, f.Error, subTest.name)
+		} else {
+			assert.Contains(t, f.Error, subTest.err, subTest.name)
+		}
+	}
+
+	assert.Len(t, FilterSessions(frames), 4)
+	filtered := FilterSessions(frames, 7, 9)
+	if assert.Len(t, filtered, 2) {
+		assert.Equal(t, []int{1, 2}, []int{filtered[0].Index, filtered[1].Index})
+	}
+	assert.Empty(t, FilterSessions(frames, 9))
+}
+
+func TestRead(t *testing.T) {
+	req := codec.Encode(codec.Package{SessionID: 7, MSgCode: codec.REQ})
+	pcapng := func() []byte {
+		var buf bytes.Buffer
+		w, _ := capture.NewPcapngWriter(&buf)
+		w.WriteRecord(capture.Record{Time: time.Unix(1, 0), Src: netip.MustParseAddrPort("10.0.0.2:4000"), Dst: netip.MustParseAddrPort("10.0.0.1:9000"), Data: req, Dropped: true})
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name   string
+		input  []byte
+		format Format
+		data   [][]byte
+		err    bool
+	}{
+		{name: "pcapng", input: pcapng(), data: [][]byte{req}},
+		{name: "raw lines", input: []byte("# comment\n" + string(req) + "\n\n" + string(req) + "\n"), data: [][]byte{req, req}},
+		{name: "hex lines", input: []byte("0x5369643a\n53 69 64 3a\n53:69:64:3a\n"), data: [][]byte{[]byte("Sid:"), []byte("Sid:"), []byte("Sid:")}},
+		{name: "hex and raw mixed", input: []byte("5369643a\n" + string(req) + "\n"), data: [][]byte{[]byte("Sid:"), req}},
+		{name: "raw keeps hex looking lines", input: []byte("5369643a\n"), format: Raw, data: [][]byte{[]byte("5369643a")}},
+		{name: "invalid hex", input: []byte("5369643a\nSid:\n"), format: Hex, err: true},
+		{name: "pcap expected", input: []byte(string(req) + "\n"), format: Pcap, err: true},
+	}
+
+	for _, subTest := range tests {
+		records, err := Read(bytes.NewReader(subTest.input), subTest.format)
+		if subTest.err {
+			assert.Error(t, err, subTest.name)
+			continue
+		}
+		assert.Nil(t, err, subTest.name)
+		var data [][]byte
+		for _, r := range records {
+			data = append(data, r.Data)
+		}
+		assert.Equal(t, subTest.data, data, subTest.name)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	frames := Dissect([]capture.Record{
+		{Time: time.Unix(1, 0), Src: netip.MustParseAddrPort("10.0.0.2:4000"), Dst: netip.MustParseAddrPort("10.0.0.1:9000"), Data: codec.Encode(codec.Package{SessionID: 7, MSgCode: codec.OPN, FrameEnd: 3})},
+		{Time: time.Unix(1, 5e8), Data: []byte("nonsense"), Dropped: true},
+		{Time: time.Unix(2, 0), Data: codec.Encode(codec.Package{SessionID: 7, MSgCode: codec.ACK}), Delay: 20 * time.Millisecond},
+	})
+
+	var text bytes.Buffer
+	assert.Nil(t, WriteText(&text, frames))
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if assert.Len(t, lines, 4) {
+		assert.Equal(t, []string{"1", "0.000000", "10.0.0.2:4000", "10.0.0.1:9000", "51", "OPN", "7", "0", "0", "0-3", "0", "0B"}, strings.Fields(lines[1]))
+		assert.Contains(t, lines[2], "dropped, decode error:")
+		assert.Contains(t, lines[2], "0.500000")
+		assert.Contains(t, lines[3], "delayed 20ms")
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, WriteJSON(&out, frames))
+	dec := json.NewDecoder(&out)
+	var objects []map[string]any
+	for dec.More() {
+		var obj map[string]any
+		assert.Nil(t, dec.Decode(&obj))
+		objects = append(objects, obj)
+	}
+	if assert.Len(t, objects, 3) {
+		assert.Equal(t, "OPN", objects[0]["message"].(map[string]any)["code"])
+		assert.Equal(t, "10.0.0.2:4000", objects[0]["src"])
+		assert.Equal(t, true, objects[1]["dropped"])
+		assert.NotContains(t, objects[1], "message")
+		assert.Equal(t, float64(20*time.Millisecond), objects[2]["delay"])
+		assert.NotContains(t, objects[2], "src")
+	}
+}
@@ -0,0 +1,106 @@
+package dissect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+)
+
+// Format is the format of the input of Read.
+type Format int
+
+const (
+	// Auto reads pcap and pcapng files, anything else as a dump with one datagram per line, either in
+	// hex or raw.
+	Auto Format = iota
+	Pcap
+	Hex
+	Raw
+)
+
+// ParseFormat parses the name of a format: auto, pcap (also for pcapng), hex or raw.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "auto":
+		return Auto, nil
+	case "pcap", "pcapng":
+		return Pcap, nil
+	case "hex":
+		return Hex, nil
+	case "raw":
+		return Raw, nil
+	}
+	return Auto, fmt.Errorf("unknown format %q, expected auto, pcap, hex or raw", s)
+}
+
+// Read reads the datagrams of a capture file or a dump.
+func Read(r io.Reader, format Format) ([]capture.Record, error) {
+	br := bufio.NewReader(r)
+	if format == Auto && isCapture(br) {
+		format = Pcap
+	}
+	if format != Pcap {
+		return ReadDump(br, format)
+	}
+	reader, err := capture.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return reader.ReadAll()
+}
+
+func isCapture(br *bufio.Reader) bool {
+	magic, err := br.Peek(4)
+	if err != nil {
+		return false
+	}
+	for _, m := range []uint32{0xa1b2c3d4, 0xa1b23c4d, 0x0a0d0d0a} {
+		if binary.LittleEndian.Uint32(magic) == m || binary.BigEndian.Uint32(magic) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDump reads one datagram per line. Hex lines may separate the bytes with spaces or colons and
+// start with 0x, raw lines are the datagram as sent, like "Sid:1|Uid:2|...". Empty lines and lines
+// starting with # are skipped. With Auto every line is taken as hex if it is valid hex.
+func ReadDump(r io.Reader, format Format) ([]capture.Record, error) {
+	var records []capture.Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var data []byte
+		switch format {
+		case Raw:
+			data = []byte(text)
+		case Hex:
+			var err error
+			if data, err = parseHex(text); err != nil {
+				return records, fmt.Errorf("line %d: %w", line, err)
+			}
+		default:
+			var err error
+			if data, err = parseHex(text); err != nil {
+				data = []byte(text)
+			}
+		}
+		records = append(records, capture.Record{Data: data})
+	}
+	return records, scanner.Err()
+}
+
+func parseHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	s = strings.NewReplacer(" ", "", "\t", "", ":", "").Replace(s)
+	return hex.DecodeString(s)
+}
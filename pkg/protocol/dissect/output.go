@@ -0,0 +1,66 @@
+package dissect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// WriteText writes the frames as a table, one line per datagram.
+func WriteText(w io.Writer, frames []Frame) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NO.\tTIME\tSOURCE\tDESTINATION\tSIZE\tCODE\tSESSION\tUSER\tPID\tFRAMES\tTOL\tPAYLOAD\tINFO")
+	for _, f := range frames {
+		src, dst := "-", "-"
+		if f.Src.IsValid() {
+			src = f.Src.String()
+		}
+		if f.Dst.IsValid() {
+			dst = f.Dst.String()
+		}
+		fmt.Fprintf(tw, "%d\t%.6f\t%s\t%s\t%d\t", f.Index, f.Offset.Seconds(), src, dst, f.Size)
+		if m := f.Message; m != nil {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d-%d\t%d\t%dB\t", m.Code, m.SessionID, m.UserID, m.PacketID, m.FrameBegin, m.FrameEnd, m.PayloadLength, m.PayloadSize)
+		} else {
+			fmt.Fprint(tw, "?\t-\t-\t-\t-\t-\t-\t")
+		}
+		fmt.Fprintln(tw, f.info())
+	}
+	return tw.Flush()
+}
+
+// info sums up what is special about a frame.
+func (f Frame) info() string {
+	info := ""
+	add := func(s string) {
+		if info != "" {
+			info += ", "
+		}
+		info += s
+	}
+	if f.Dropped {
+		add("dropped")
+	}
+	if f.Delay > 0 {
+		add("delayed " + f.Delay.String())
+	}
+	if f.Message != nil && f.Message.RemoteAddr != "" {
+		add("rma " + f.Message.RemoteAddr)
+	}
+	if f.Error != "" {
+		add("decode error: " + f.Error)
+	}
+	return info
+}
+
+// WriteJSON writes the frames as JSON lines, one object per datagram.
+func WriteJSON(w io.Writer, frames []Frame) error {
+	enc := json.NewEncoder(w)
+	for _, f := range frames {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1 +1,72 @@
 package dtp
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrHandshakeTimeout     = errors.New("dtp: handshake timed out")
+	ErrConnectionRefused    = errors.New("dtp: session refused by server")
+	ErrTooManySessions      = errors.New("dtp: session limit reached")
+	ErrPowTooHard           = errors.New("dtp: proof-of-work challenge too hard")
+	ErrNoKeys               = errors.New("dtp: session has no keys")
+	ErrDecrypt              = errors.New("dtp: payload could not be decrypted")
+	ErrKeyPhase             = errors.New("dtp: payload sealed in an unknown key phase")
+	ErrReplay               = errors.New("dtp: package received before")
+	ErrKeyUpdatePending     = errors.New("dtp: previous key update not confirmed by peer")
+	ErrMessageTooLarge      = errors.New("dtp: message too large")
+	ErrClosed               = errors.New("dtp: connection closed")
+	ErrIllegalTransition    = errors.New("dtp: illegal state transition")
+	ErrSessionExpired       = errors.New("dtp: session expired")
+	ErrConnectionIDLength   = errors.New("dtp: connection id length out of range")
+	ErrSessionClosed        = errors.New("dtp: session closed by the server")
+	ErrUnknownSession       = errors.New("dtp: unknown session")
+	ErrMigrationUnsupported = errors.New("dtp: only client connections migrate")
+)
+
+// TransitionError is returned for a state change the session state machine does not allow.
+// It matches ErrIllegalTransition.
+type TransitionError struct {
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%v: %v → %v", ErrIllegalTransition, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+// RejectError is returned by Dial if the server refused the session. It matches ErrConnectionRefused.
+type RejectError struct {
+	Reason RejectReason
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrConnectionRefused, e.Reason)
+}
+
+func (e *RejectError) Is(target error) bool {
+	return target == ErrConnectionRefused
+}
+
+// PowError is returned by Dial if the server asked for more proof-of-work than the client is
+// willing to do, either above MaxPowDifficulty or not solvable within PowTimeBudget. It matches ErrPowTooHard.
+type PowError struct {
+	Difficulty int
+	TimedOut   bool
+}
+
+func (e *PowError) Error() string {
+	if e.TimedOut {
+		return fmt.Sprintf("%v: difficulty %d not solved in time", ErrPowTooHard, e.Difficulty)
+	}
+	return fmt.Sprintf("%v: difficulty %d", ErrPowTooHard, e.Difficulty)
+}
+
+func (e *PowError) Is(target error) bool {
+	return target == ErrPowTooHard
+}
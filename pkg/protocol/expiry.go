@@ -0,0 +1,179 @@
+package dtp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ExpiryReason tells why the reaper closed a session.
+type ExpiryReason int
+
+const (
+	// ExpiredIdle sessions received nothing within their idle timeout.
+	ExpiredIdle ExpiryReason = iota + 1
+	// ExpiredLifetime sessions outlived their maximum lifetime.
+	ExpiredLifetime
+	// ExpiredHandshake sessions were not established in time, see Options.HandshakeTimeout.
+	ExpiredHandshake
+)
+
+func (r ExpiryReason) String() string {
+	switch r {
+	case ExpiredIdle:
+		return "idle timeout"
+	case ExpiredLifetime:
+		return "lifetime exceeded"
+	case ExpiredHandshake:
+		return "handshake timeout"
+	}
+	return fmt.Sprintf("ExpiryReason(%d)", int(r))
+}
+
+// ExpireFunc is called by the reaper for every session it closed.
+type ExpireFunc func(session *Session, reason ExpiryReason)
+
+// setLifetime makes the session expire after idle without a package and, unless max is zero,
+// max after it was created.
+func (sh *Session) setLifetime(idle, max time.Duration) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	sh.idleTimeout = idle
+	sh.lastReceived = sh.createdAt
+	if max > 0 {
+		sh.expiresAt = sh.createdAt.Add(max)
+	}
+}
+
+// setHandshakeTimeout makes the session expire if it is not established within timeout after it
+// was created, whatever its idle timeout and lifetime are.
+func (sh *Session) setHandshakeTimeout(timeout time.Duration) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	sh.handshakeDeadline = sh.createdAt.Add(timeout)
+}
+
+// touch records a package received from the peer, it restarts the idle timeout.
+func (sh *Session) touch(now time.Time) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	sh.lastReceived = now
+}
+
+// LastActivity returns the time the last package of the peer was received.
+func (sh *Session) LastActivity() time.Time {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return sh.lastReceived
+}
+
+func (sh *Session) expired(now time.Time) (ExpiryReason, bool) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	if !sh.expiresAt.IsZero() && !now.Before(sh.expiresAt) {
+		return ExpiredLifetime, true
+	}
+	established := sh.state != REQ && sh.state != HSK && sh.state != OPN
+	if !established && !sh.handshakeDeadline.IsZero() && !now.Before(sh.handshakeDeadline) {
+		return ExpiredHandshake, true
+	}
+	if sh.idleTimeout > 0 && now.Sub(sh.lastReceived) >= sh.idleTimeout {
+		return ExpiredIdle, true
+	}
+	return 0, false
+}
+
+type reaper struct {
+	// stop cancels the pending tick, stopped keeps a running tick from arming the next one.
+	stop    func() bool
+	stopped bool
+	// mux is held by a running tick, StopReaper waits for it.
+	mux sync.Mutex
+}
+
+// SetClock sets the clock the reaper and the expiry run on, see Clock. It takes effect with the next
+// StartReaper.
+func (sh *SessionHandler) SetClock(clock Clock) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	sh.clock = clock
+}
+
+// StartReaper closes and removes expired sessions every interval until StopReaper is called. It
+// also writes sessions whose keys changed to the store, see Checkpoint.
+// The connection of an expired session is closed, its ReadMessage returns ErrSessionExpired.
+// onExpire may be nil. A running reaper is stopped first.
+func (sh *SessionHandler) StartReaper(interval time.Duration, onExpire ExpireFunc) {
+	sh.StopReaper()
+	r := &reaper{}
+	sh.mux.Lock()
+	sh.reaper = r
+	clock := sh.clock
+	sh.mux.Unlock()
+
+	var tick func()
+	tick = func() {
+		defer r.mux.Unlock()
+		r.mux.Lock()
+		if r.stopped {
+			return
+		}
+		sh.Reap(clock.Now(), onExpire)
+		sh.Checkpoint(false)
+		r.stop = clock.AfterFunc(interval, tick)
+	}
+	r.mux.Lock()
+	r.stop = clock.AfterFunc(interval, tick)
+	r.mux.Unlock()
+}
+
+// StopReaper stops the reaper and waits for it to finish.
+func (sh *SessionHandler) StopReaper() {
+	sh.mux.Lock()
+	r := sh.reaper
+	sh.reaper = nil
+	sh.mux.Unlock()
+	if r != nil {
+		r.mux.Lock()
+		r.stopped = true
+		r.stop()
+		r.mux.Unlock()
+	}
+}
+
+// Reap closes and removes all sessions that are expired at now and returns how many there were.
+func (sh *SessionHandler) Reap(now time.Time, onExpire ExpireFunc) int {
+	type expiry struct {
+		session *Session
+		reason  ExpiryReason
+	}
+	var expired []expiry
+	for i := range sh.shards {
+		shard := &sh.shards[i]
+		shard.mux.Lock()
+		for id, session := range shard.sessions {
+			if reason, ok := session.expired(now); ok {
+				delete(shard.sessions, id)
+				sh.size.Add(-1)
+				expired = append(expired, expiry{session, reason})
+			}
+		}
+		shard.mux.Unlock()
+	}
+
+	for _, e := range expired {
+		// The session is gone, a failing store only keeps a record that expires on restore.
+		sh.Store().Delete(e.session.id)
+		// A session that is closed already only has to be removed.
+		if e.session.transition(CLD) != nil {
+			continue
+		}
+		if c := e.session.connection(); c != nil {
+			c.terminate(ErrSessionExpired)
+		}
+		if onExpire != nil {
+			onExpire(e.session, e.reason)
+		}
+	}
+	return len(expired)
+}
@@ -0,0 +1,160 @@
+package dtp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReap(t *testing.T) {
+	tests := []struct {
+		name      string
+		idle      time.Duration
+		lifetime  time.Duration
+		handshake time.Duration
+		path      []State
+		active    time.Duration
+		after     time.Duration
+		reason    ExpiryReason
+	}{
+		{name: "active session", idle: time.Minute, after: 30 * time.Second},
+		{name: "idle session", idle: time.Minute, after: time.Minute, reason: ExpiredIdle},
+		{name: "activity restarts the idle timeout", idle: time.Minute, active: 30 * time.Second, after: time.Minute},
+		{name: "lifetime exceeded", idle: time.Minute, lifetime: 2 * time.Minute, active: 110 * time.Second, after: 2 * time.Minute, reason: ExpiredLifetime},
+		{name: "no lifetime", idle: time.Hour, active: 50 * time.Minute, after: 100 * time.Minute},
+		{name: "handshake not finished", handshake: time.Minute, path: []State{HSK, OPN}, after: time.Minute, reason: ExpiredHandshake},
+		{name: "handshake in time", handshake: time.Minute, path: []State{HSK}, after: 30 * time.Second},
+		{name: "established before the deadline", handshake: time.Minute, path: []State{HSK, OPN, ALI}, after: time.Hour},
+	}
+
+	for _, subTest := range tests {
+		handler := NewSessionHandler()
+		session := NewSession(1)
+		session.setLifetime(subTest.idle, subTest.lifetime)
+		if subTest.handshake > 0 {
+			session.setHandshakeTimeout(subTest.handshake)
+		}
+		for _, state := range subTest.path {
+			assert.Nil(t, session.transition(state), subTest.name)
+		}
+		assert.Nil(t, handler.AddSession(session), subTest.name)
+		if subTest.active > 0 {
+			session.touch(session.createdAt.Add(subTest.active))
+		}
+
+		var reasons []ExpiryReason
+		reaped := handler.Reap(session.createdAt.Add(subTest.after), func(_ *Session, reason ExpiryReason) {
+			reasons = append(reasons, reason)
+		})
+		if subTest.reason == 0 {
+			assert.Equal(t, 0, reaped, subTest.name)
+			assert.True(t, handler.HasSession(1), subTest.name)
+			continue
+		}
+		assert.Equal(t, 1, reaped, subTest.name)
+		assert.Equal(t, []ExpiryReason{subTest.reason}, reasons, subTest.name)
+		assert.False(t, handler.HasSession(1), subTest.name)
+		assert.Equal(t, CLD, session.State(), subTest.name)
+	}
+}
+
+func TestIdleSessionExpires(t *testing.T) {
+	server := startServer(t, Options{IdleTimeout: 100 * time.Millisecond, ReapInterval: 10 * time.Millisecond})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	_, err = accepted.ReadMessage()
+	assert.ErrorIs(t, err, ErrSessionExpired)
+	_, err = client.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF, "the client is told about the expiry")
+	assert.Equal(t, 0, server.Sessions().Size())
+	assert.Equal(t, uint64(1), server.Stats().SessionsExpired)
+}
+
+// TestIdleSessionWithoutTimeout leaves a session quiet for a week on the virtual clock, without an
+// idle timeout the server keeps it.
+func TestIdleSessionWithoutTimeout(t *testing.T) {
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: 10 * time.Millisecond}, Clock: clock})
+	serverConn, err := network.ListenUDP(&udpsim.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9000})
+	assert.Nil(t, err)
+	server, err := NewServer(serverConn, Options{Clock: clock, ReapInterval: time.Hour})
+	assert.Nil(t, err)
+	go server.Serve()
+	defer server.Close()
+	clientConn, err := network.ListenUDP(&udpsim.UDPAddr{IP: net.ParseIP("10.0.0.2")})
+	assert.Nil(t, err)
+	defer clientConn.Close()
+
+	dialed := make(chan error, 1)
+	var client *DTPConnection
+	go func() {
+		var err error
+		client, err = Dial(clientConn, serverConn.LocalAddr(), Options{Clock: clock})
+		dialed <- err
+	}()
+	var dialErr error
+	assert.True(t, network.RunUntil(func() bool {
+		select {
+		case dialErr = <-dialed:
+			return true
+		default:
+			return false
+		}
+	}, time.Minute))
+	if !assert.Nil(t, dialErr) {
+		return
+	}
+
+	network.Run(7 * 24 * time.Hour)
+	session, ok := server.Sessions().GetSession(client.Session().ID())
+	if assert.True(t, ok) {
+		assert.Equal(t, ALI, session.State())
+	}
+	assert.Equal(t, uint64(0), server.Stats().SessionsExpired)
+}
+
+// TestHandshakeExpires sends a REQ and never answers the OPN, without any idle timeout or lifetime
+// the server still drops the session once the handshake ran out of time.
+func TestHandshakeExpires(t *testing.T) {
+	clock := udpsim.NewVirtualClock(time.Unix(0, 0))
+	network := udpsim.NewNetwork(udpsim.Options{Link: udpsim.LinkProfile{MinDelay: 10 * time.Millisecond}, Clock: clock})
+	serverConn, err := network.ListenUDP(&udpsim.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9000})
+	assert.Nil(t, err)
+	server, err := NewServer(serverConn, Options{Clock: clock})
+	assert.Nil(t, err)
+	go server.Serve()
+	defer server.Close()
+	clientConn, err := network.ListenUDP(&udpsim.UDPAddr{IP: net.ParseIP("10.0.0.2")})
+	assert.Nil(t, err)
+	defer clientConn.Close()
+
+	_, err = clientConn.WriteTo(codec.Encode(codec.Package{SessionID: 7, MSgCode: codec.REQ}), serverConn.LocalAddr())
+	assert.Nil(t, err)
+	assert.True(t, network.RunUntil(func() bool { return server.Sessions().Size() == 1 }, time.Second))
+
+	lifetime := server.opts.handshakeLifetime()
+	network.Run(lifetime / 2)
+	assert.Equal(t, 1, server.Sessions().Size(), "still within the handshake")
+	assert.True(t, network.RunUntil(func() bool { return server.Sessions().Size() == 0 }, lifetime))
+	assert.Equal(t, uint64(1), server.Stats().SessionsExpired)
+}
+
+func TestStopReaper(t *testing.T) {
+	handler := NewSessionHandler()
+	session := NewSession(1)
+	session.setLifetime(time.Nanosecond, 0)
+	assert.Nil(t, handler.AddSession(session))
+
+	handler.StartReaper(time.Hour, nil)
+	handler.StopReaper()
+	handler.StopReaper()
+	assert.True(t, handler.HasSession(1))
+}
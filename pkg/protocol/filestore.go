@@ -0,0 +1,298 @@
+package dtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// FileStore is a SessionStore in a single append-only log file. Every Put and Delete appends one JSON
+// line and syncs the file; opening the store replays the log. Once the log holds more than twice as
+// many entries as there are records it is compacted into a new file that replaces the old one.
+//
+// The secrets of a record are sealed with AES-256-GCM under the store key before they are written,
+// everything else, ids and addresses among it, is stored in the clear.
+type FileStore struct {
+	path    string
+	aead    cipher.AEAD
+	file    *os.File
+	records map[int]SessionRecord
+	// entries is the number of lines in the log.
+	entries int
+	mux     sync.Mutex
+}
+
+const (
+	// minCompactEntries keeps small logs from being compacted over and over.
+	minCompactEntries = 1024
+	maxStoreLine      = 1 << 20
+)
+
+var ErrStoreClosed = errors.New("dtp: session store closed")
+
+type storeEntry struct {
+	Op     string
+	ID     int
+	Record *SessionRecord `json:",omitempty"`
+}
+
+// OpenFileStore opens the store at path, creating it if needed. key seals the secrets of the
+// records, it has to be the same every time the store is opened.
+func OpenFileStore(path string, key []byte) (*FileStore, error) {
+	if len(key) == 0 {
+		return nil, errors.New("dtp: session store needs a key")
+	}
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileStore{path: path, aead: aead, records: map[int]SessionRecord{}}
+	clean, err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+	if !clean {
+		// A torn last line of a crash is dropped by writing the log anew.
+		if err := fs.compact(); err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}
+	fs.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// load replays the log. It reports false if the log ends in a line that cannot be read, the torn
+// write of a crash. A line that cannot be read before the last one is an error, dropping it would
+// drop every record after it with it.
+func (fs *FileStore) load() (bool, error) {
+	f, err := os.Open(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), maxStoreLine)
+	// torn is the number of the line that could not be read, it has to be the last one.
+	line, torn := 0, 0
+	for scanner.Scan() {
+		line++
+		if torn > 0 {
+			return false, fmt.Errorf("dtp: session store %s: line %d is corrupt", fs.path, torn)
+		}
+		var entry storeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || (entry.Op == "put" && entry.Record == nil) {
+			torn = line
+			continue
+		}
+		switch entry.Op {
+		case "put":
+			record, err := fs.open(*entry.Record)
+			if err != nil {
+				return false, fmt.Errorf("dtp: session store %s: %w", fs.path, err)
+			}
+			fs.records[record.ID] = record
+		case "del":
+			delete(fs.records, entry.ID)
+		}
+		fs.entries++
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("dtp: session store %s: line %d: %w", fs.path, line+1, err)
+	}
+	return torn == 0, nil
+}
+
+func (fs *FileStore) Get(id int) (SessionRecord, bool, error) {
+	defer fs.mux.Unlock()
+	fs.mux.Lock()
+	record, ok := fs.records[id]
+	return record, ok, nil
+}
+
+func (fs *FileStore) Put(record SessionRecord) error {
+	sealed, err := fs.seal(record)
+	if err != nil {
+		return err
+	}
+	defer fs.mux.Unlock()
+	fs.mux.Lock()
+	if err := fs.append(storeEntry{Op: "put", ID: record.ID, Record: &sealed}); err != nil {
+		return err
+	}
+	fs.records[record.ID] = record
+	return fs.maybeCompact()
+}
+
+func (fs *FileStore) Delete(id int) error {
+	defer fs.mux.Unlock()
+	fs.mux.Lock()
+	if _, ok := fs.records[id]; !ok {
+		return nil
+	}
+	if err := fs.append(storeEntry{Op: "del", ID: id}); err != nil {
+		return err
+	}
+	delete(fs.records, id)
+	return fs.maybeCompact()
+}
+
+func (fs *FileStore) Scan(f func(record SessionRecord) bool) error {
+	fs.mux.Lock()
+	records := make([]SessionRecord, 0, len(fs.records))
+	for _, record := range fs.records {
+		records = append(records, record)
+	}
+	fs.mux.Unlock()
+	for _, record := range records {
+		if !f(record) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	defer fs.mux.Unlock()
+	fs.mux.Lock()
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+func (fs *FileStore) append(entry storeEntry) error {
+	if fs.file == nil {
+		return ErrStoreClosed
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	fs.entries++
+	return fs.file.Sync()
+}
+
+func (fs *FileStore) maybeCompact() error {
+	if fs.entries < minCompactEntries || fs.entries <= 2*len(fs.records) {
+		return nil
+	}
+	return fs.compact()
+}
+
+// compact writes all records to a new log and replaces the old one with it.
+func (fs *FileStore) compact() error {
+	var buf bytes.Buffer
+	for _, record := range fs.records {
+		sealed, err := fs.seal(record)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(storeEntry{Op: "put", ID: record.ID, Record: &sealed})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+
+	tmp := fs.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, fs.path); err != nil {
+		return err
+	}
+
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	fs.file, err = os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		fs.file = nil
+		return err
+	}
+	fs.entries = len(fs.records)
+	return nil
+}
+
+// seal returns a copy of record with its secrets sealed, bound to the id of the record.
+func (fs *FileStore) seal(record SessionRecord) (SessionRecord, error) {
+	var err error
+	if record.Secret, err = fs.sealField(record.ID, "secret", record.Secret); err != nil {
+		return record, err
+	}
+	if record.Resumption, err = fs.sealField(record.ID, "resumption", record.Resumption); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+func (fs *FileStore) open(record SessionRecord) (SessionRecord, error) {
+	var err error
+	if record.Secret, err = fs.openField(record.ID, "secret", record.Secret); err != nil {
+		return record, err
+	}
+	if record.Resumption, err = fs.openField(record.ID, "resumption", record.Resumption); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+func (fs *FileStore) sealField(id int, field string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, fs.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return fs.aead.Seal(nonce, nonce, plaintext, storeAAD(id, field)), nil
+}
+
+func (fs *FileStore) openField(id int, field string, sealed []byte) ([]byte, error) {
+	nonceSize := fs.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := fs.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], storeAAD(id, field))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func storeAAD(id int, field string) []byte {
+	return []byte("dtp store " + strconv.Itoa(id) + " " + field)
+}
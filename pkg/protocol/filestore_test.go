@@ -0,0 +1,225 @@
+package dtp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRecord(id int) SessionRecord {
+	return SessionRecord{
+		ID:          id,
+		Network:     "udp",
+		RemoteAddr:  "127.0.0.1:4000",
+		CreatedAt:   time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC),
+		IdleTimeout: time.Minute,
+		Secret:      bytes.Repeat([]byte{0xab}, secretLength),
+		Resumption:  bytes.Repeat([]byte{0xcd}, secretLength),
+		SendSeq:     uint64(id) * 10,
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	key := []byte("store key")
+	store, err := OpenFileStore(path, key)
+	assert.Nil(t, err)
+	for id := 1; id <= 3; id++ {
+		assert.Nil(t, store.Put(testRecord(id)))
+	}
+	assert.Nil(t, store.Delete(2))
+	assert.Nil(t, store.Delete(2), "deleting twice is no error")
+	assert.Nil(t, store.Close())
+
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, bytes.Repeat([]byte{0xab}, 8)), "secrets are sealed at rest")
+
+	tests := []struct {
+		name   string
+		id     int
+		exists bool
+	}{
+		{name: "kept", id: 1, exists: true},
+		{name: "deleted", id: 2},
+		{name: "kept after delete", id: 3, exists: true},
+		{name: "never stored", id: 4},
+	}
+
+	store, err = OpenFileStore(path, key)
+	assert.Nil(t, err)
+	defer store.Close()
+	for _, subTest := range tests {
+		record, ok, err := store.Get(subTest.id)
+		assert.Nil(t, err, subTest.name)
+		assert.Equal(t, subTest.exists, ok, subTest.name)
+		if subTest.exists {
+			assert.Equal(t, testRecord(subTest.id), record, subTest.name)
+		}
+	}
+
+	_, err = OpenFileStore(path, []byte("wrong key"))
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestFileStoreRecovers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	store, err := OpenFileStore(path, []byte("key"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put(testRecord(1)))
+	assert.Nil(t, store.Close())
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	f.WriteString(`{"Op":"put","ID":2,"Rec`)
+	f.Close()
+
+	store, err = OpenFileStore(path, []byte("key"))
+	assert.Nil(t, err, "a torn last line is dropped")
+	_, ok, _ := store.Get(1)
+	assert.True(t, ok)
+	assert.Nil(t, store.Put(testRecord(3)))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenFileStore(path, []byte("key"))
+	assert.Nil(t, err)
+	defer store.Close()
+	count := 0
+	store.Scan(func(SessionRecord) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 2, count)
+}
+
+// TestFileStoreCorruptLine breaks a line in the middle of the log. Opening the store fails and leaves
+// the log as it is, the records after the line are not lost.
+func TestFileStoreCorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	store, err := OpenFileStore(path, []byte("key"))
+	assert.Nil(t, err)
+	for id := 1; id <= 3; id++ {
+		assert.Nil(t, store.Put(testRecord(id)))
+	}
+	assert.Nil(t, store.Close())
+
+	log, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := bytes.SplitAfter(log, []byte("\n"))
+	lines[1] = []byte("{\"Op\":\"put\",\"ID\":2\n")
+	corrupt := bytes.Join(lines, nil)
+	assert.Nil(t, os.WriteFile(path, corrupt, 0o600))
+
+	_, err = OpenFileStore(path, []byte("key"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2")
+	}
+	after, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, corrupt, after)
+}
+
+func TestFileStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	store, err := OpenFileStore(path, []byte("key"))
+	assert.Nil(t, err)
+	defer store.Close()
+	for i := 0; i < minCompactEntries; i++ {
+		assert.Nil(t, store.Put(testRecord(i%4)))
+	}
+	assert.Equal(t, 4, store.entries)
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	key := []byte("store key")
+	store, err := OpenFileStore(path, key)
+	assert.Nil(t, err)
+	server := startServer(t, Options{SessionStore: store})
+	addr := server.conn.LocalAddr().String()
+
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	_, err = server.Accept()
+	assert.Nil(t, err)
+	assert.Nil(t, server.Close())
+	assert.Nil(t, store.Close())
+
+	store, err = OpenFileStore(path, key)
+	assert.Nil(t, err)
+	defer store.Close()
+	conn, err := net.ListenPacket("udp", addr)
+	assert.Nil(t, err)
+	restarted, err := NewServer(conn, Options{SessionStore: store})
+	assert.Nil(t, err)
+	go restarted.Serve()
+	defer restarted.Close()
+	assert.Equal(t, uint64(1), restarted.Stats().SessionsRestored)
+
+	accepted, err := restarted.Accept()
+	assert.Nil(t, err)
+	assert.Equal(t, client.Session().ID(), accepted.Session().ID())
+	assert.Nil(t, client.WriteMessage(&Message{Data: []byte("still there?")}))
+	msg, err := accepted.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "still there?", string(msg.Data))
+	assert.Nil(t, accepted.WriteMessage(&Message{Data: []byte("yes")}))
+	msg, err = client.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "yes", string(msg.Data))
+}
+
+// crash copies the records of store as a crashed server left them behind.
+func crash(t *testing.T, store SessionStore) *MemoryStore {
+	t.Helper()
+	left := NewMemoryStore()
+	assert.Nil(t, store.Scan(func(record SessionRecord) bool {
+		assert.Nil(t, left.Put(record))
+		return true
+	}))
+	return left
+}
+
+// TestRestoredSequenceAfterSecondCrash crashes the server twice, neither time the session is written
+// on the way down. The package numbers of the session still only grow.
+func TestRestoredSequenceAfterSecondCrash(t *testing.T) {
+	store := NewMemoryStore()
+	server := startServer(t, Options{SessionStore: store})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	var last uint64
+	for crashes := 0; crashes < 3; crashes++ {
+		session := accepted.Session()
+		if crashes > 0 {
+			assert.Greater(t, session.sendSeq.Load(), last, "restored past the package numbers used")
+		}
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, accepted.WriteMessage(&Message{Data: []byte("hello")}))
+			msg, err := client.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, "hello", string(msg.Data))
+		}
+		last = session.sendSeq.Load()
+
+		store = crash(t, store)
+		addr := server.conn.LocalAddr().String()
+		assert.Nil(t, server.conn.Close())
+		conn, err := net.ListenPacket("udp", addr)
+		assert.Nil(t, err)
+		server, err = NewServer(conn, Options{SessionStore: store})
+		assert.Nil(t, err)
+		go server.Serve()
+		defer server.Close()
+		accepted, err = server.Accept()
+		assert.Nil(t, err)
+		assert.Equal(t, client.Session().ID(), accepted.Session().ID())
+	}
+}
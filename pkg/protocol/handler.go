@@ -16,7 +16,7 @@ type Reader interface {
 
 type DTPHandler struct {
 	buffer []byte
-	cache  map[Frame][]codec.Package
+	cache  map[Frame][]Package
 }
 
 func (dtpH DTPHandler) Read(b []byte) (*Message, error) {
@@ -30,7 +30,7 @@ func (dtpH DTPHandler) Read(b []byte) (*Message, error) {
 		ps[p.PackedID] = p
 		return nil, nil
 	}
-	ps = make([]codec.Package, p.FrameEnd-p.FrameBegin+1, p.FrameEnd-p.FrameBegin+1)
+	ps = make([]Package, p.FrameEnd-p.FrameBegin+1, p.FrameEnd-p.FrameBegin+1)
 	ps[p.PackedID] = p
 
 	return nil, nil
@@ -0,0 +1,113 @@
+package dtp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// handshakeParams are the optional fields a REQ, OPN, RTY, ERR or TKT carries in its payload.
+// They use the same "Key:Value|Key:Value" framing as the codec, values are Base64 encoded.
+// Unknown keys are skipped so that older peers can talk to newer ones.
+type handshakeParams struct {
+	KeyShare   []byte
+	Token      []byte
+	Difficulty int
+	Solution   []byte
+	Reason     RejectReason
+	Ticket     []byte
+	EarlyData  []byte
+	// Lifetime of a ticket in seconds, only set in a TKT.
+	Lifetime int
+	// ConnectionID is the id the server issued for the session, set in the OPN or the ALI of a resumption.
+	ConnectionID int
+}
+
+func (hp handshakeParams) encode() []byte {
+	var sb strings.Builder
+	writeParam(&sb, "Key", hp.KeyShare)
+	writeParam(&sb, "Tok", hp.Token)
+	if hp.Difficulty > 0 {
+		writeParam(&sb, "Pow", []byte(strconv.Itoa(hp.Difficulty)))
+	}
+	writeParam(&sb, "Sol", hp.Solution)
+	if hp.Reason != RejectNone {
+		writeParam(&sb, "Rsn", []byte(strconv.Itoa(int(hp.Reason))))
+	}
+	writeParam(&sb, "Tkt", hp.Ticket)
+	writeParam(&sb, "Erl", hp.EarlyData)
+	if hp.Lifetime > 0 {
+		writeParam(&sb, "Ttl", []byte(strconv.Itoa(hp.Lifetime)))
+	}
+	if hp.ConnectionID != 0 {
+		writeParam(&sb, "Cid", []byte(strconv.Itoa(hp.ConnectionID)))
+	}
+	return []byte(sb.String())
+}
+
+func writeParam(sb *strings.Builder, key string, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	if sb.Len() > 0 {
+		sb.WriteByte('|')
+	}
+	sb.WriteString(key)
+	sb.WriteByte(':')
+	sb.WriteString(base64.StdEncoding.EncodeToString(value))
+}
+
+func decodeHandshakeParams(b []byte) (handshakeParams, error) {
+	var hp handshakeParams
+	if len(b) == 0 {
+		return hp, nil
+	}
+	for i, part := range strings.Split(string(b), "|") {
+		key, raw, ok := strings.Cut(part, ":")
+		if !ok {
+			return hp, fmt.Errorf("invalid handshake param at pos %d: %q (expected Key:Value)", i, part)
+		}
+		value, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return hp, fmt.Errorf("%s (Base64): %w", key, err)
+		}
+		switch key {
+		case "Key":
+			hp.KeyShare = value
+		case "Tok":
+			hp.Token = value
+		case "Pow":
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return hp, fmt.Errorf("Pow: %w", err)
+			}
+			hp.Difficulty = n
+		case "Sol":
+			hp.Solution = value
+		case "Rsn":
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return hp, fmt.Errorf("Rsn: %w", err)
+			}
+			hp.Reason = RejectReason(n)
+		case "Tkt":
+			hp.Ticket = value
+		case "Erl":
+			hp.EarlyData = value
+		case "Ttl":
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return hp, fmt.Errorf("Ttl: %w", err)
+			}
+			hp.Lifetime = n
+		case "Cid":
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return hp, fmt.Errorf("Cid: %w", err)
+			}
+			hp.ConnectionID = n
+		}
+	}
+	return hp, nil
+}
@@ -0,0 +1,134 @@
+package dtp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo is a snapshot of a session for monitoring. Durations are in nanoseconds in JSON.
+type SessionInfo struct {
+	ID           int           `json:"id"`
+	RemoteAddr   string        `json:"remote_addr"`
+	State        State         `json:"state"`
+	CreatedAt    time.Time     `json:"created_at"`
+	Age          time.Duration `json:"age"`
+	LastActivity time.Time     `json:"last_activity"`
+	// RTT is the smoothed round trip time, zero until the first sample. It is sampled by the
+	// handshake and by path validations.
+	RTT        time.Duration `json:"rtt"`
+	PacketsIn  uint64        `json:"packets_in"`
+	BytesIn    uint64        `json:"bytes_in"`
+	PacketsOut uint64        `json:"packets_out"`
+	BytesOut   uint64        `json:"bytes_out"`
+	KeyPhase   uint8         `json:"key_phase"`
+	// Retransmits is the number of packages that wait for an answer and are sent again without
+	// one: the OPN of a session whose ACK is missing and an unanswered path challenge.
+	Retransmits int `json:"pending_retransmissions"`
+}
+
+// sessionTraffic counts the datagrams of a session.
+type sessionTraffic struct {
+	packetsIn  atomic.Uint64
+	bytesIn    atomic.Uint64
+	packetsOut atomic.Uint64
+	bytesOut   atomic.Uint64
+}
+
+func (sh *Session) received(n int) {
+	sh.traffic.packetsIn.Add(1)
+	sh.traffic.bytesIn.Add(uint64(n))
+}
+
+func (sh *Session) sent(n int) {
+	sh.traffic.packetsOut.Add(1)
+	sh.traffic.bytesOut.Add(uint64(n))
+}
+
+// sampleRTT feeds a round trip time sample into the smoothed RTT, like TCP with a gain of 1/8.
+func (sh *Session) sampleRTT(sample time.Duration) {
+	if sample <= 0 {
+		return
+	}
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	if sh.rtt == 0 {
+		sh.rtt = sample
+		return
+	}
+	sh.rtt += (sample - sh.rtt) / 8
+}
+
+// RTT returns the smoothed round trip time of the session, zero if it was never measured.
+func (sh *Session) RTT() time.Duration {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return sh.rtt
+}
+
+// Info returns a snapshot of the session.
+func (sh *Session) Info() SessionInfo {
+	now := sh.now()
+	info := SessionInfo{
+		ID:         sh.id,
+		State:      sh.State(),
+		KeyPhase:   sh.KeyPhase(),
+		PacketsIn:  sh.traffic.packetsIn.Load(),
+		BytesIn:    sh.traffic.bytesIn.Load(),
+		PacketsOut: sh.traffic.packetsOut.Load(),
+		BytesOut:   sh.traffic.bytesOut.Load(),
+	}
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	if sh.remoteAddr != nil {
+		info.RemoteAddr = sh.remoteAddr.String()
+	}
+	info.CreatedAt = sh.createdAt
+	info.Age = now.Sub(sh.createdAt)
+	info.LastActivity = sh.lastReceived
+	info.RTT = sh.rtt
+	if info.State == OPN {
+		info.Retransmits++
+	}
+	if sh.challenge != nil {
+		info.Retransmits++
+	}
+	return info
+}
+
+// Info returns a snapshot of the session with id.
+func (sh *SessionHandler) Info(sessionId int) (SessionInfo, bool) {
+	session, ok := sh.GetSession(sessionId)
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return session.Info(), true
+}
+
+// List returns a snapshot of every session, in no particular order.
+func (sh *SessionHandler) List() []SessionInfo {
+	infos := make([]SessionInfo, 0, sh.Size())
+	sh.Range(func(session *Session) bool {
+		infos = append(infos, session.Info())
+		return true
+	})
+	return infos
+}
+
+// CloseSession closes the session with id at once. The peer of an established session is told
+// with a CLD, ReadMessage on its connection returns ErrSessionClosed.
+func (sh *SessionHandler) CloseSession(sessionId int) error {
+	session, ok := sh.GetSession(sessionId)
+	if !ok {
+		return ErrUnknownSession
+	}
+	if err := sh.RemoveSession(sessionId); err != nil {
+		return err
+	}
+	if session.transition(CLD) != nil {
+		return nil
+	}
+	if c := session.connection(); c != nil {
+		c.terminate(ErrSessionClosed)
+	}
+	return nil
+}
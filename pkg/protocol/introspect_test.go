@@ -0,0 +1,104 @@
+package dtp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionInfo(t *testing.T) {
+	server := startServer(t, Options{})
+	clientConn := listenClient(t)
+	client, err := Dial(clientConn, server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	assert.Nil(t, client.WriteMessage(&Message{Data: []byte("ping")}))
+	_, err = accepted.ReadMessage()
+	assert.Nil(t, err)
+
+	info, ok := server.Sessions().Info(client.Session().ID())
+	assert.True(t, ok)
+	assert.Equal(t, clientConn.LocalAddr().String(), info.RemoteAddr)
+	assert.Equal(t, ALI, info.State)
+	assert.Greater(t, info.RTT, time.Duration(0), "the handshake measured the rtt")
+	assert.Equal(t, uint64(2), info.PacketsIn, "ACK and data")
+	assert.Greater(t, info.BytesIn, uint64(0))
+	assert.Equal(t, uint64(2), info.PacketsOut, "OPN and ALI")
+	assert.Equal(t, 0, info.Retransmits, "everything answered")
+	assert.Len(t, server.Sessions().List(), 1)
+
+	server.challengePath(accepted.Session(), listenClient(t).LocalAddr())
+	info, _ = server.Sessions().Info(client.Session().ID())
+	assert.Equal(t, 1, info.Retransmits, "the path challenge waits for its response")
+
+	assert.Greater(t, client.Session().Info().RTT, time.Duration(0))
+	assert.Equal(t, uint64(1), client.Session().Info().PacketsOut, "data after the handshake")
+}
+
+func TestSessionInfoBeforeACK(t *testing.T) {
+	server := startServer(t, Options{})
+	res := exchange(t, listenClient(t), server, codec.Package{SessionID: 7, MSgCode: codec.REQ})
+	assert.Equal(t, codec.OPN, res.MSgCode)
+	params, err := decodeHandshakeParams(res.Payload)
+	assert.Nil(t, err)
+
+	info, ok := server.Sessions().Info(params.ConnectionID)
+	if assert.True(t, ok) {
+		assert.Equal(t, OPN, info.State)
+		assert.Equal(t, 1, info.Retransmits, "the OPN is repeated until the ACK arrives")
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	server := startServer(t, Options{})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	id := strconv.Itoa(client.Session().ID())
+	debug := httptest.NewServer(NewDebugHandler(server.Sessions()))
+	defer debug.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{name: "list", method: http.MethodGet, path: "/sessions", status: http.StatusOK},
+		{name: "single", method: http.MethodGet, path: "/sessions/" + id, status: http.StatusOK},
+		{name: "unknown", method: http.MethodGet, path: "/sessions/1", status: http.StatusNotFound},
+		{name: "no id", method: http.MethodGet, path: "/sessions/abc", status: http.StatusBadRequest},
+		{name: "close", method: http.MethodDelete, path: "/sessions/" + id, status: http.StatusNoContent},
+		{name: "closed", method: http.MethodGet, path: "/sessions/" + id, status: http.StatusNotFound},
+		{name: "close again", method: http.MethodDelete, path: "/sessions/" + id, status: http.StatusNotFound},
+	}
+
+	for _, subTest := range tests {
+		req, err := http.NewRequest(subTest.method, debug.URL+subTest.path, nil)
+		assert.Nil(t, err, subTest.name)
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, subTest.name)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, subTest.status, res.StatusCode, subTest.name)
+		if subTest.name == "single" {
+			var info map[string]any
+			assert.Nil(t, json.Unmarshal(body, &info), subTest.name)
+			assert.Equal(t, "ALI", info["state"], subTest.name)
+		}
+	}
+
+	_, err = accepted.ReadMessage()
+	assert.ErrorIs(t, err, ErrSessionClosed)
+	_, err = client.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF, "the client is told")
+}
@@ -0,0 +1,321 @@
+package dtp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The session secret is agreed with X25519 during the handshake: the client sends its key share
+// in the REQ, the server answers with its share in the OPN. From the secret every side derives an
+// AES-128-GCM key and IV per direction.
+//
+// Keys are updated in-band. Every sealed payload starts with the key phase it was sealed in. Either
+// side may move to the next phase, whose secret is derived from the current one; the peer follows
+// as soon as it opens a payload of the next phase. The previous keys stay valid for a grace period
+// so that packages still in flight can be read.
+const (
+	keyLength    = 16
+	secretLength = 32
+)
+
+type directionKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+}
+
+func deriveDirectionKeys(secret []byte, label string) (directionKeys, error) {
+	key, err := hkdf.Expand(sha256.New, secret, "dtp "+label+" key", keyLength)
+	if err != nil {
+		return directionKeys{}, err
+	}
+	iv, err := hkdf.Expand(sha256.New, secret, "dtp "+label+" iv", 12)
+	if err != nil {
+		return directionKeys{}, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return directionKeys{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return directionKeys{}, err
+	}
+	return directionKeys{aead: aead, iv: iv}, nil
+}
+
+// nonce mixes the package number into the IV, package numbers never repeat within a direction.
+func (dk directionKeys) nonce(pn uint64) []byte {
+	nonce := append([]byte(nil), dk.iv...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], pn)
+	for i := range seq {
+		nonce[len(nonce)-8+i] ^= seq[i]
+	}
+	return nonce
+}
+
+// keyGeneration are the keys of one key phase.
+type keyGeneration struct {
+	phase  uint8
+	secret []byte
+	send   directionKeys
+	recv   directionKeys
+}
+
+func newKeyGeneration(secret []byte, phase uint8, isClient bool) (*keyGeneration, error) {
+	c2s, err := deriveDirectionKeys(secret, "c2s")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := deriveDirectionKeys(secret, "s2c")
+	if err != nil {
+		return nil, err
+	}
+	if isClient {
+		return &keyGeneration{phase: phase, secret: secret, send: c2s, recv: s2c}, nil
+	}
+	return &keyGeneration{phase: phase, secret: secret, send: s2c, recv: c2s}, nil
+}
+
+func (kg *keyGeneration) next(isClient bool) (*keyGeneration, error) {
+	secret, err := hkdf.Expand(sha256.New, kg.secret, "dtp key update", secretLength)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyGeneration(secret, kg.phase+1, isClient)
+}
+
+type sessionKeys struct {
+	isClient bool
+	current  *keyGeneration
+	previous *keyGeneration
+	// previousUntil ends the grace period of the previous keys.
+	previousUntil time.Time
+	// confirmed is set once the peer sent in the current phase, only then another update may start.
+	confirmed bool
+	packets   uint64
+	bytes     uint64
+	updatedAt time.Time
+	// resumption is the secret session tickets are issued for.
+	resumption []byte
+	// received are the package numbers opened so far, a package is only opened once.
+	received replayWindow
+
+	updatePackets  uint64
+	updateBytes    uint64
+	updateInterval time.Duration
+	grace          time.Duration
+	now            func() time.Time
+	mux            sync.Mutex
+}
+
+// agreeSessionKeys derives the initial keys of a session from the X25519 exchange. A resumed session
+// mixes in the resumption secret of its ticket.
+func agreeSessionKeys(private *ecdh.PrivateKey, peerShare []byte, sessionId int, isClient bool, opts Options, resumption []byte) (*sessionKeys, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerShare)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hkdf.Key(sha256.New, append(shared, resumption...), []byte("dtp session "+strconv.Itoa(sessionId)), "dtp initial", secretLength)
+	if err != nil {
+		return nil, err
+	}
+	resumptionSecret, err := hkdf.Expand(sha256.New, secret, "dtp resumption", secretLength)
+	if err != nil {
+		return nil, err
+	}
+	initial, err := newKeyGeneration(secret, 0, isClient)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKeys{
+		isClient:       isClient,
+		current:        initial,
+		confirmed:      true,
+		updatedAt:      nowFunc(opts.Clock)(),
+		resumption:     resumptionSecret,
+		updatePackets:  opts.KeyUpdatePackets,
+		updateBytes:    opts.KeyUpdateBytes,
+		updateInterval: opts.KeyUpdateInterval,
+		grace:          opts.KeyUpdateGrace,
+		now:            nowFunc(opts.Clock),
+	}, nil
+}
+
+// restoreSessionKeys rebuilds the keys of a session from the secret of its current phase.
+func restoreSessionKeys(secret []byte, phase uint8, resumption []byte, isClient bool, opts Options) (*sessionKeys, error) {
+	if len(secret) != secretLength {
+		return nil, ErrNoKeys
+	}
+	current, err := newKeyGeneration(secret, phase, isClient)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKeys{
+		isClient:       isClient,
+		current:        current,
+		confirmed:      true,
+		updatedAt:      nowFunc(opts.Clock)(),
+		resumption:     resumption,
+		updatePackets:  opts.KeyUpdatePackets,
+		updateBytes:    opts.KeyUpdateBytes,
+		updateInterval: opts.KeyUpdateInterval,
+		grace:          opts.KeyUpdateGrace,
+		now:            nowFunc(opts.Clock),
+	}, nil
+}
+
+// snapshot returns the current phase, its secret and the resumption secret.
+func (sk *sessionKeys) snapshot() (uint8, []byte, []byte) {
+	defer sk.mux.Unlock()
+	sk.mux.Lock()
+	return sk.current.phase, append([]byte(nil), sk.current.secret...), append([]byte(nil), sk.resumption...)
+}
+
+func (sk *sessionKeys) currentPhase() uint8 {
+	defer sk.mux.Unlock()
+	sk.mux.Lock()
+	return sk.current.phase
+}
+
+// update moves to the next key phase. It fails while the peer has not confirmed the current one.
+func (sk *sessionKeys) update() error {
+	defer sk.mux.Unlock()
+	sk.mux.Lock()
+	if !sk.confirmed {
+		return ErrKeyUpdatePending
+	}
+	next, err := sk.current.next(sk.isClient)
+	if err != nil {
+		return err
+	}
+	sk.advance(next)
+	sk.confirmed = false
+	return nil
+}
+
+func (sk *sessionKeys) advance(next *keyGeneration) {
+	sk.previous = sk.current
+	sk.previousUntil = sk.now().Add(sk.grace)
+	sk.current = next
+	sk.packets = 0
+	sk.bytes = 0
+	sk.updatedAt = sk.now()
+}
+
+// due reports whether one of the automatic update limits is reached.
+func (sk *sessionKeys) due() bool {
+	return sk.packets >= sk.updatePackets || sk.bytes >= sk.updateBytes || sk.now().Sub(sk.updatedAt) >= sk.updateInterval
+}
+
+// seal encrypts plaintext as package pn. If a limit is reached the keys are updated first.
+// The result starts with the key phase, aad is authenticated together with it.
+func (sk *sessionKeys) seal(pn uint64, aad, plaintext []byte) ([]byte, error) {
+	defer sk.mux.Unlock()
+	sk.mux.Lock()
+	if sk.confirmed && sk.due() {
+		next, err := sk.current.next(sk.isClient)
+		if err != nil {
+			return nil, err
+		}
+		sk.advance(next)
+		sk.confirmed = false
+	}
+
+	gen := sk.current
+	out := []byte{gen.phase}
+	out = gen.send.aead.Seal(out, gen.send.nonce(pn), plaintext, append(aad, gen.phase))
+	sk.packets++
+	sk.bytes += uint64(len(plaintext))
+	return out, nil
+}
+
+// open decrypts a sealed payload of package pn with the keys of the phase it names.
+func (sk *sessionKeys) open(pn uint64, aad, sealed []byte) ([]byte, error) {
+	if len(sealed) < 1 {
+		return nil, ErrDecrypt
+	}
+	phase, ciphertext := sealed[0], sealed[1:]
+	aad = append(aad, phase)
+
+	defer sk.mux.Unlock()
+	sk.mux.Lock()
+	switch {
+	case phase == sk.current.phase:
+		plaintext, err := sk.current.recv.aead.Open(nil, sk.current.recv.nonce(pn), ciphertext, aad)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		if !sk.received.accept(pn) {
+			return nil, ErrReplay
+		}
+		sk.confirmed = true
+		return plaintext, nil
+	case phase == sk.current.phase+1:
+		// The peer updated its keys, follow it once the payload proves the new phase.
+		next, err := sk.current.next(sk.isClient)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := next.recv.aead.Open(nil, next.recv.nonce(pn), ciphertext, aad)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		if !sk.received.accept(pn) {
+			return nil, ErrReplay
+		}
+		sk.advance(next)
+		sk.confirmed = true
+		return plaintext, nil
+	case sk.previous != nil && phase == sk.previous.phase && sk.now().Before(sk.previousUntil):
+		plaintext, err := sk.previous.recv.aead.Open(nil, sk.previous.recv.nonce(pn), ciphertext, aad)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		if !sk.received.accept(pn) {
+			return nil, ErrReplay
+		}
+		return plaintext, nil
+	}
+	return nil, ErrKeyPhase
+}
+
+// replayWindowSize is the number of package numbers below the highest one that are still accepted
+// out of order, older packages are dropped.
+const replayWindowSize = 64
+
+// replayWindow remembers the package numbers received recently. Bit i of seen stands for highest-i.
+type replayWindow struct {
+	highest uint64
+	seen    uint64
+}
+
+// accept records pn and reports whether it was new.
+func (w *replayWindow) accept(pn uint64) bool {
+	if w.seen == 0 || pn > w.highest {
+		if shift := pn - w.highest; w.seen == 0 || shift >= replayWindowSize {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<shift | 1
+		}
+		w.highest = pn
+		return true
+	}
+	age := w.highest - pn
+	if age >= replayWindowSize || w.seen&(1<<age) != 0 {
+		return false
+	}
+	w.seen |= 1 << age
+	return true
+}
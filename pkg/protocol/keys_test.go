@@ -0,0 +1,130 @@
+package dtp
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func agreedKeys(t *testing.T, opts Options) (*sessionKeys, *sessionKeys) {
+	t.Helper()
+	clientKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	opts = opts.withDefaults()
+	client, err := agreeSessionKeys(clientKey, serverKey.PublicKey().Bytes(), 1, true, opts, nil)
+	assert.Nil(t, err)
+	server, err := agreeSessionKeys(serverKey, clientKey.PublicKey().Bytes(), 1, false, opts, nil)
+	assert.Nil(t, err)
+	return client, server
+}
+
+func roundTrip(t *testing.T, from, to *sessionKeys, pn uint64) error {
+	t.Helper()
+	sealed, err := from.seal(pn, dataAAD(1, pn), []byte("hello"))
+	assert.Nil(t, err)
+	plaintext, err := to.open(pn, dataAAD(1, pn), sealed)
+	if err == nil {
+		assert.Equal(t, []byte("hello"), plaintext)
+	}
+	return err
+}
+
+func TestSessionKeys(t *testing.T) {
+	client, server := agreedKeys(t, Options{})
+
+	assert.Nil(t, roundTrip(t, client, server, 0))
+	assert.Nil(t, roundTrip(t, server, client, 0))
+
+	sealed, err := client.seal(1, dataAAD(1, 1), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = server.open(2, dataAAD(1, 2), sealed)
+	assert.ErrorIs(t, err, ErrDecrypt, "package number is authenticated")
+	_, err = client.open(1, dataAAD(1, 1), sealed)
+	assert.ErrorIs(t, err, ErrDecrypt, "directions use different keys")
+	_, err = server.open(1, dataAAD(1, 1), sealed)
+	assert.Nil(t, err)
+	_, err = server.open(1, dataAAD(1, 1), sealed)
+	assert.ErrorIs(t, err, ErrReplay, "a package is opened once")
+}
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		received []uint64
+		pn       uint64
+		accepted bool
+	}{
+		{name: "first package", pn: 0, accepted: true},
+		{name: "next package", received: []uint64{0, 1}, pn: 2, accepted: true},
+		{name: "duplicate", received: []uint64{0, 1, 2}, pn: 1},
+		{name: "duplicate of the highest", received: []uint64{0, 1, 2}, pn: 2},
+		{name: "reordered", received: []uint64{0, 2}, pn: 1, accepted: true},
+		{name: "gap", received: []uint64{0}, pn: 1000, accepted: true},
+		{name: "oldest in the window", received: []uint64{100}, pn: 100 - replayWindowSize + 1, accepted: true},
+		{name: "older than the window", received: []uint64{100}, pn: 100 - replayWindowSize},
+		{name: "duplicate after a jump", received: []uint64{5, 1 << 32}, pn: 5},
+	}
+
+	for _, subTest := range tests {
+		var window replayWindow
+		for _, pn := range subTest.received {
+			assert.True(t, window.accept(pn), subTest.name)
+		}
+		assert.Equal(t, subTest.accepted, window.accept(subTest.pn), subTest.name)
+	}
+}
+
+func TestKeyUpdate(t *testing.T) {
+	client, server := agreedKeys(t, Options{KeyUpdateGrace: 50 * time.Millisecond})
+
+	inFlight, err := client.seal(1, dataAAD(1, 1), []byte("old phase"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, client.update())
+	assert.ErrorIs(t, client.update(), ErrKeyUpdatePending, "no second update before the peer confirmed")
+	assert.Equal(t, uint8(1), client.currentPhase())
+	assert.Equal(t, uint8(0), server.currentPhase())
+
+	assert.Nil(t, roundTrip(t, client, server, 2))
+	assert.Equal(t, uint8(1), server.currentPhase(), "server follows the update")
+
+	plaintext, err := server.open(1, dataAAD(1, 1), inFlight)
+	assert.Nil(t, err, "previous phase accepted during the grace period")
+	assert.Equal(t, []byte("old phase"), plaintext)
+
+	assert.Nil(t, roundTrip(t, server, client, 0))
+	assert.Nil(t, client.update(), "update possible again after the server sent in the new phase")
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = server.open(1, dataAAD(1, 1), inFlight)
+	assert.ErrorIs(t, err, ErrKeyPhase, "previous phase rejected after the grace period")
+}
+
+func TestAutomaticKeyUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		send int
+		exp  uint8
+	}{
+		{name: "below the limits", opts: Options{KeyUpdatePackets: 10}, send: 9, exp: 0},
+		{name: "packet limit", opts: Options{KeyUpdatePackets: 10}, send: 11, exp: 1},
+		{name: "byte limit", opts: Options{KeyUpdateBytes: 12}, send: 4, exp: 1},
+		{name: "interval", opts: Options{KeyUpdateInterval: time.Nanosecond}, send: 2, exp: 1},
+	}
+
+	for _, subTest := range tests {
+		client, server := agreedKeys(t, subTest.opts)
+		for pn := 0; pn < subTest.send; pn++ {
+			assert.Nil(t, roundTrip(t, client, server, uint64(pn)), subTest.name)
+		}
+		assert.Equal(t, subTest.exp, client.currentPhase(), subTest.name)
+		assert.Equal(t, subTest.exp, server.currentPhase(), subTest.name)
+	}
+}
@@ -0,0 +1,183 @@
+package dtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+)
+
+// A client may change its address during a session, a phone moving from Wi-Fi to LTE or a NAT
+// rebinding. Sessions are found by id, so the server still recognizes packages from the new address,
+// but it only moves the session there after validating the path:
+//
+//	client (new addr) ── ALI or PCH, sealed ──▶ server
+//	client (new addr) ◀── PCH(challenge) ────── server
+//	client (new addr) ── PRS(challenge) ──────▶ server   remoteAddr = new addr
+//
+// Only packages sealed with the session keys start a validation, and until the response arrives
+// everything sent to the new address counts against its amplification limit. Each package is opened
+// once, see replayWindow, so a package an attacker recorded and replays from a spoofed address is
+// dropped: it is neither delivered again nor answered with a challenge.
+const challengeSize = 8
+
+// MigrationFunc is called once a session moved from one client address to another.
+type MigrationFunc func(session *Session, from, to net.Addr)
+
+type pathChallenge struct {
+	addr   net.Addr
+	data   []byte
+	sentAt time.Time
+}
+
+// challengeTimeout is the time after which an unanswered challenge is repeated.
+func (s *Server) challengeTimeout() time.Duration {
+	return s.opts.HandshakeTimeout
+}
+
+// authenticated reports whether the payload of p was sealed with the session keys and returns it
+// opened. A package that was opened before is not authenticated again.
+func authenticated(session *Session, p Package) ([]byte, bool) {
+	if session.keys == nil || len(p.Payload) == 0 {
+		return nil, false
+	}
+	pn := uint64(p.PackedID)
+	data, err := session.keys.open(pn, dataAAD(p.SessionID, pn), p.Payload)
+	return data, err == nil
+}
+
+// probe handles an authenticated package of an established session that arrived from an address
+// other than its remote address. It starts the validation of the new path and reports whether the
+// session takes packages from there.
+func (s *Server) probe(session *Session, addr net.Addr) bool {
+	if session.State() != ALI {
+		return false
+	}
+	s.challengePath(session, addr)
+	return true
+}
+
+func (s *Server) challengePath(session *Session, addr net.Addr) {
+	now := s.opts.Clock.Now()
+	session.mux.Lock()
+	pending := session.challenge
+	if pending != nil && sameAddr(pending.addr, addr) && now.Sub(pending.sentAt) < s.challengeTimeout() {
+		session.mux.Unlock()
+		return
+	}
+	challenge := &pathChallenge{addr: addr, data: make([]byte, challengeSize), sentAt: now}
+	session.challenge = challenge
+	session.mux.Unlock()
+
+	if _, err := rand.Read(challenge.data); err != nil {
+		return
+	}
+	s.sendPath(session, codec.PCH, challenge.data, addr)
+}
+
+// handlePath answers a path challenge of the client and completes the validation of a new path.
+func (s *Server) handlePath(session *Session, p Package, addr net.Addr) {
+	if session.State() != ALI {
+		return
+	}
+	data, ok := authenticated(session, p)
+	if !ok {
+		return
+	}
+	session.touch(s.opts.Clock.Now())
+	migrating := !sameAddr(session.RemoteAddr(), addr)
+	if p.MSgCode == codec.PCH {
+		s.sendPath(session, codec.PRS, data, addr)
+		if migrating {
+			s.challengePath(session, addr)
+		}
+		return
+	}
+
+	session.mux.Lock()
+	challenge := session.challenge
+	if challenge == nil || !sameAddr(challenge.addr, addr) || !bytes.Equal(challenge.data, data) {
+		session.mux.Unlock()
+		return
+	}
+	session.challenge = nil
+	from := session.remoteAddr
+	session.mux.Unlock()
+	session.sampleRTT(s.opts.Clock.Now().Sub(challenge.sentAt))
+	if migrating {
+		s.migrate(session, from, addr)
+	}
+}
+
+// migrate moves the session to the validated address to.
+func (s *Server) migrate(session *Session, from, to net.Addr) {
+	session.mux.Lock()
+	session.remoteAddr = to
+	session.resetPath()
+	session.mux.Unlock()
+	s.amplification.validate(to)
+	s.persist(session)
+	s.counters.migrations.Add(1)
+	if s.opts.OnMigrate != nil {
+		s.opts.OnMigrate(session, from, to)
+	}
+}
+
+// resetPath forgets what was learned about the old path. The ack timeout is measured anew.
+func (sh *Session) resetPath() {
+	sh.ackTimeout = 0
+	sh.lastSend = time.Time{}
+}
+
+// sendPath sends a sealed PCH or PRS. The path is not validated yet, so it is amplification limited.
+func (s *Server) sendPath(session *Session, msg codec.State, data []byte, addr net.Addr) error {
+	p, err := sealPath(session, msg, data)
+	if err != nil {
+		return err
+	}
+	validated := sameAddr(session.RemoteAddr(), addr)
+	if validated {
+		return s.send(session, p, addr)
+	}
+	return s.send(nil, p, addr)
+}
+
+func sealPath(session *Session, msg codec.State, data []byte) (Package, error) {
+	if session.keys == nil {
+		return Package{}, ErrNoKeys
+	}
+	pn := session.sendSeq.Add(1) - 1
+	sealed, err := session.keys.seal(pn, dataAAD(session.id, pn), data)
+	if err != nil {
+		return Package{}, err
+	}
+	return Package{SessionID: session.id, MSgCode: msg, PackedID: int(pn), PayloadLength: len(sealed), Payload: sealed}, nil
+}
+
+// Migrate moves a client connection to another packet connection, for example one bound to a new
+// network interface. A sealed probe tells the server about the new address, it validates the path
+// and moves the session once ReadMessage answered its challenge. The old packet connection stays
+// open, it belongs to the caller.
+func (c *DTPConnection) Migrate(conn net.PacketConn) error {
+	if c.server != nil {
+		return ErrMigrationUnsupported
+	}
+	c.connMux.Lock()
+	old := c.conn
+	c.conn = conn
+	c.connMux.Unlock()
+	// Wake up a ReadMessage blocked on the old connection, it continues on the new one.
+	old.SetReadDeadline(c.session.now())
+
+	probe := make([]byte, challengeSize)
+	if _, err := rand.Read(probe); err != nil {
+		return err
+	}
+	p, err := sealPath(c.session, codec.PCH, probe)
+	if err != nil {
+		return err
+	}
+	return c.send(p)
+}
@@ -0,0 +1,132 @@
+package dtp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigration(t *testing.T) {
+	migrated := make(chan [2]string, 1)
+	server := startServer(t, Options{OnMigrate: func(_ *Session, from, to net.Addr) {
+		migrated <- [2]string{from.String(), to.String()}
+	}})
+	var recorder capture.Recorder
+	before := listenClient(t)
+	client, err := Dial(before, server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	received := make(chan string, 1)
+	go func() {
+		if msg, err := client.ReadMessage(); err == nil {
+			received <- string(msg.Data)
+		}
+	}()
+	after := listenClient(t)
+	assert.Nil(t, client.Migrate(capture.Wrap(after, recorder.Hook())))
+
+	select {
+	case addrs := <-migrated:
+		assert.Equal(t, [2]string{before.LocalAddr().String(), after.LocalAddr().String()}, addrs)
+	case <-time.After(time.Second):
+		t.Fatal("session did not migrate")
+	}
+	assert.Equal(t, after.LocalAddr().String(), accepted.Session().RemoteAddr().String())
+	assert.Equal(t, uint64(1), server.Stats().Migrations)
+
+	assert.Nil(t, accepted.WriteMessage(&Message{Data: []byte("moved")}))
+	select {
+	case data := <-received:
+		assert.Equal(t, "moved", data)
+	case <-time.After(time.Second):
+		t.Fatal("message did not arrive on the new path")
+	}
+	// The path challenge and its response are sealed like data.
+	assertPayloadLengths(t, recorder.Records())
+}
+
+// TestReplayedData replays a recorded data package of the client, from its own address and from
+// another one. The server drops it both times.
+func TestReplayedData(t *testing.T) {
+	server := startServer(t, Options{})
+	var recorder capture.Recorder
+	clientConn := listenClient(t)
+	client, err := Dial(capture.Wrap(clientConn, recorder.Hook()), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	first := len(recorder.Records())
+	assert.Nil(t, client.WriteMessage(&Message{Data: []byte("once")}))
+	msg, err := accepted.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "once", string(msg.Data))
+	records := recorder.Records()[first:]
+	if !assert.Len(t, records, 1) {
+		return
+	}
+	recorded := records[0].Data
+
+	_, err = clientConn.WriteTo(recorded, server.conn.LocalAddr())
+	assert.Nil(t, err)
+	attacker := listenClient(t)
+	_, err = attacker.WriteTo(recorded, server.conn.LocalAddr())
+	assert.Nil(t, err)
+	attacker.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = attacker.ReadFrom(make([]byte, maxPackageSize))
+	assert.Error(t, err, "no challenge for a replay")
+
+	assert.Nil(t, client.WriteMessage(&Message{Data: []byte("next")}))
+	msg, err = accepted.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "next", string(msg.Data), "the replays were not delivered")
+	assert.Equal(t, uint64(0), server.Stats().Migrations)
+}
+
+func TestMigrationNeedsValidatedPath(t *testing.T) {
+	server := startServer(t, Options{})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	addr := accepted.Session().RemoteAddr().String()
+
+	sealed, err := sealPath(client.Session(), codec.ALI, []byte("replayed"))
+	assert.Nil(t, err)
+	tests := []struct {
+		name      string
+		p         codec.Package
+		challenge bool
+	}{
+		{name: "unsealed data", p: codec.Package{SessionID: client.Session().ID(), MSgCode: codec.ALI, Payload: []byte("forged")}},
+		{name: "close", p: codec.Package{SessionID: client.Session().ID(), MSgCode: codec.CLD}},
+		{name: "sealed data", p: sealed, challenge: true},
+		{name: "replayed sealed data", p: sealed},
+	}
+
+	for _, subTest := range tests {
+		attacker := listenClient(t)
+		_, err := attacker.WriteTo(codec.Encode(subTest.p), server.conn.LocalAddr())
+		assert.Nil(t, err, subTest.name)
+
+		attacker.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, maxPackageSize)
+		n, _, err := attacker.ReadFrom(buf)
+		if !subTest.challenge {
+			assert.Error(t, err, subTest.name)
+		} else if assert.Nil(t, err, subTest.name) {
+			res, err := codec.Decode(buf[:n])
+			assert.Nil(t, err, subTest.name)
+			assert.Equal(t, codec.PCH, res.MSgCode, subTest.name)
+		}
+		assert.Equal(t, addr, accepted.Session().RemoteAddr().String(), subTest.name)
+		assert.True(t, server.Sessions().HasSession(client.Session().ID()), subTest.name)
+	}
+	assert.Equal(t, uint64(0), server.Stats().Migrations)
+}
@@ -1,4 +1,199 @@
 package dtp
 
+import "time"
+
+// RetryMode decides when the server answers a REQ with a stateless retry token
+// instead of creating a session right away.
+type RetryMode int
+
+const (
+	RetryNever RetryMode = iota
+	RetryAlways
+	RetryUnderLoad
+)
+
 type Options struct {
+	// RetryMode selects when a REQ has to echo a valid retry token before the server creates a Session.
+	RetryMode RetryMode
+	// RetryLoadThreshold is the number of sessions from which on RetryUnderLoad starts sending retries.
+	RetryLoadThreshold int
+	// RetrySecret is the key material the retry tokens are sealed with. Servers sharing a secret accept each others tokens.
+	// A random secret is generated if it is empty.
+	RetrySecret []byte
+	// RetrySecretRotation is the interval after which the token key is rotated. Tokens sealed with the previous key stay valid.
+	RetrySecretRotation time.Duration
+	// RetryTokenLifetime is the maximum age of a retry token the server accepts.
+	RetryTokenLifetime time.Duration
+
+	// AmplificationFactor limits the bytes sent to a remote address before it is validated
+	// to this multiple of the bytes received from it.
+	AmplificationFactor int
+
+	// SourceRateLimit limits the datagrams the server accepts from one source prefix.
+	SourceRateLimit RateLimit
+	// SourcePrefixIPv4 and SourcePrefixIPv6 are the prefix lengths sources are grouped by.
+	SourcePrefixIPv4 int
+	SourcePrefixIPv6 int
+	// SessionRateLimit limits the datagrams the server accepts per session.
+	SessionRateLimit RateLimit
+	// MaxSessions caps the number of concurrent sessions, zero means unlimited.
+	MaxSessions int
+	// Admission decides about every REQ that passed the limits, nil admits all of them.
+	Admission AdmissionPolicy
+
+	// PowThreshold is the number of sessions from which on a REQ is answered with a proof-of-work
+	// challenge, zero disables the challenge.
+	PowThreshold int
+	// PowDifficulty is the number of leading zero bits a solution has to produce.
+	PowDifficulty int
+	// MaxPowDifficulty is the highest difficulty the client tries to solve.
+	MaxPowDifficulty int
+	// PowTimeBudget is the time the client spends on a challenge before it gives up.
+	PowTimeBudget time.Duration
+
+	// KeyUpdatePackets, KeyUpdateBytes and KeyUpdateInterval trigger an automatic key update once that
+	// many packages or payload bytes were sealed with the current keys, or once the keys are that old.
+	KeyUpdatePackets  uint64
+	KeyUpdateBytes    uint64
+	KeyUpdateInterval time.Duration
+	// KeyUpdateGrace is the time the previous keys are still accepted after an update.
+	KeyUpdateGrace time.Duration
+
+	// SessionTickets makes the server issue a resumption ticket after the handshake and at close.
+	SessionTickets bool
+	// TicketKey seals the tickets, servers sharing a key accept each others tickets.
+	// A random key is generated if it is empty.
+	TicketKey []byte
+	// TicketLifetime is the time a ticket can be used to resume.
+	TicketLifetime time.Duration
+	// ResumeTicket makes Dial resume the session the ticket was issued for. A ticket is used once, see SessionTicket.
+	ResumeTicket *SessionTicket
+	// EarlyData is sent by Dial together with ResumeTicket in the first flight. It may be replayed by
+	// an attacker, so it has to be safe to process twice. If the server does not accept the ticket it is
+	// sent again as the first message once the session is established.
+	EarlyData []byte
+
+	// ConnectionIDLength is the length in bytes of the random session ids, 4 to 8.
+	ConnectionIDLength int
+	// IDGenerator issues the ids of new sessions on the server, RandomIDs of ConnectionIDLength if nil.
+	IDGenerator IDGenerator
+
+	// SessionStore keeps established sessions across restarts of the server, a MemoryStore if nil.
+	// Sessions found in it are restored by NewServer and handed out by Accept.
+	SessionStore SessionStore
+
+	// IdleTimeout closes a session on the server that received nothing for that long, zero means no
+	// limit. Nothing sends keepalives, so a quiet session only lives past it if the application talks.
+	IdleTimeout time.Duration
+	// MaxLifetime closes a session on the server once it is that old, zero means no limit.
+	MaxLifetime time.Duration
+	// ReapInterval is the interval in which the server looks for expired sessions.
+	ReapInterval time.Duration
+
+	// OnMigrate is called on the server once a session moved to a new client address.
+	OnMigrate MigrationFunc
+
+	// OnStateChange is registered with every session, on the server as well as in Dial.
+	OnStateChange StateChangeFunc
+
+	// Clock is the time source of the server or client, the wall clock if nil. See Clock.
+	Clock Clock
+
+	// HandshakeTimeout is the time the client waits for an answer before it repeats its last handshake package.
+	// The server drops a session that is not established after all retries or the lifetime of a retry
+	// token, whichever is longer, even without IdleTimeout.
+	HandshakeTimeout time.Duration
+	// HandshakeRetries is the number of repetitions before Dial gives up.
+	HandshakeRetries int
+}
+
+const (
+	defaultRetryLoadThreshold  = 1000
+	defaultRetrySecretRotation = 10 * time.Minute
+	defaultRetryTokenLifetime  = 10 * time.Second
+	defaultAmplificationFactor = 3
+	defaultSourcePrefixIPv4    = 32
+	defaultSourcePrefixIPv6    = 64
+	defaultPowDifficulty       = 16
+	defaultMaxPowDifficulty    = 24
+	defaultPowTimeBudget       = 2 * time.Second
+	// AES-GCM confidentiality limit, see RFC 9001 section 6.6.
+	defaultKeyUpdatePackets  = 1 << 23
+	defaultKeyUpdateBytes    = 1 << 36
+	defaultKeyUpdateInterval = 24 * time.Hour
+	defaultKeyUpdateGrace    = 3 * time.Second
+	defaultTicketLifetime    = 24 * time.Hour
+	defaultReapInterval      = time.Second
+	defaultHandshakeTimeout  = 500 * time.Millisecond
+	defaultHandshakeRetries  = 5
+)
+
+// withDefaults returns a copy of the options with all zero values replaced by their defaults.
+func (o Options) withDefaults() Options {
+	if o.RetryLoadThreshold <= 0 {
+		o.RetryLoadThreshold = defaultRetryLoadThreshold
+	}
+	if o.RetrySecretRotation <= 0 {
+		o.RetrySecretRotation = defaultRetrySecretRotation
+	}
+	if o.RetryTokenLifetime <= 0 {
+		o.RetryTokenLifetime = defaultRetryTokenLifetime
+	}
+	if o.AmplificationFactor <= 0 {
+		o.AmplificationFactor = defaultAmplificationFactor
+	}
+	if o.SourcePrefixIPv4 <= 0 {
+		o.SourcePrefixIPv4 = defaultSourcePrefixIPv4
+	}
+	if o.SourcePrefixIPv6 <= 0 {
+		o.SourcePrefixIPv6 = defaultSourcePrefixIPv6
+	}
+	if o.PowDifficulty <= 0 {
+		o.PowDifficulty = defaultPowDifficulty
+	}
+	if o.MaxPowDifficulty <= 0 {
+		o.MaxPowDifficulty = defaultMaxPowDifficulty
+	}
+	if o.PowTimeBudget <= 0 {
+		o.PowTimeBudget = defaultPowTimeBudget
+	}
+	if o.KeyUpdatePackets == 0 {
+		o.KeyUpdatePackets = defaultKeyUpdatePackets
+	}
+	if o.KeyUpdateBytes == 0 {
+		o.KeyUpdateBytes = defaultKeyUpdateBytes
+	}
+	if o.KeyUpdateInterval <= 0 {
+		o.KeyUpdateInterval = defaultKeyUpdateInterval
+	}
+	if o.KeyUpdateGrace <= 0 {
+		o.KeyUpdateGrace = defaultKeyUpdateGrace
+	}
+	if o.TicketLifetime <= 0 {
+		o.TicketLifetime = defaultTicketLifetime
+	}
+	if o.ConnectionIDLength == 0 {
+		o.ConnectionIDLength = defaultConnectionIDLength
+	}
+	if o.IDGenerator == nil {
+		o.IDGenerator = RandomIDs{Length: o.ConnectionIDLength}
+	}
+	if o.ReapInterval <= 0 {
+		o.ReapInterval = defaultReapInterval
+	}
+	if o.Clock == nil {
+		o.Clock = wallClock{}
+	}
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if o.HandshakeRetries <= 0 {
+		o.HandshakeRetries = defaultHandshakeRetries
+	}
+	return o
+}
+
+// handshakeLifetime is the time a session on the server gets to be established.
+func (o Options) handshakeLifetime() time.Duration {
+	return max(o.HandshakeTimeout*time.Duration(o.HandshakeRetries+1), o.RetryTokenLifetime)
 }
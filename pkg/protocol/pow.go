@@ -0,0 +1,68 @@
+package dtp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"time"
+)
+
+// A proof-of-work challenge is hashcash-style: the client has to find a solution so that
+// SHA-256(challenge | solution) starts with at least difficulty zero bits. The challenge is the
+// retry token of the RTY together with the initial id and the key share of the REQ, see powChallenge.
+// The server stays stateless, and a solution is bound to the address and to the one session it was
+// solved for: a REQ with another initial id needs another solution.
+
+// powDeadlineCheck is the number of hashes between two looks at the clock while solving.
+const powDeadlineCheck = 4096
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
+
+// powChallenge returns the challenge of a REQ with the retry token, initial id and key share.
+func powChallenge(token []byte, initialID int, keyShare []byte) []byte {
+	challenge := make([]byte, 0, len(token)+8+len(keyShare))
+	challenge = append(challenge, token...)
+	challenge = binary.BigEndian.AppendUint64(challenge, uint64(initialID))
+	return append(challenge, keyShare...)
+}
+
+func powHash(challenge, solution []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(challenge)
+	h.Write(solution)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func verifyPow(challenge, solution []byte, difficulty int) bool {
+	if len(solution) == 0 {
+		return false
+	}
+	sum := powHash(challenge, solution)
+	return leadingZeroBits(sum[:]) >= difficulty
+}
+
+// solvePow searches a solution until deadline, it reports false if there was none in time.
+func solvePow(challenge []byte, difficulty int, deadline time.Time) ([]byte, bool) {
+	solution := make([]byte, 8)
+	for counter := uint64(0); ; counter++ {
+		if counter%powDeadlineCheck == 0 && time.Now().After(deadline) {
+			return nil, false
+		}
+		binary.BigEndian.PutUint64(solution, counter)
+		sum := powHash(challenge, solution)
+		if leadingZeroBits(sum[:]) >= difficulty {
+			return solution, true
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package dtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		b   []byte
+		exp int
+	}{
+		{b: []byte{0x80}, exp: 0},
+		{b: []byte{0x01}, exp: 7},
+		{b: []byte{0x00, 0x10}, exp: 11},
+		{b: []byte{0x00, 0x00}, exp: 16},
+	}
+
+	for _, subTest := range tests {
+		assert.Equal(t, subTest.exp, leadingZeroBits(subTest.b), subTest.b)
+	}
+}
+
+func TestSolvePow(t *testing.T) {
+	challenge := []byte("challenge")
+	solution, ok := solvePow(challenge, 12, time.Now().Add(time.Second))
+	assert.True(t, ok)
+	assert.True(t, verifyPow(challenge, solution, 12))
+	assert.False(t, verifyPow([]byte("other challenge"), solution, 12), "solution is bound to the challenge")
+	assert.False(t, verifyPow(challenge, nil, 0), "empty solution")
+
+	_, ok = solvePow(challenge, 200, time.Now().Add(10*time.Millisecond))
+	assert.False(t, ok, "gives up at the deadline")
+}
@@ -0,0 +1,152 @@
+package dtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedSources bounds the number of source prefixes the server keeps buckets for.
+const maxRateLimitedSources = 65536
+
+// RateLimit configures a pair of token buckets. A rate of zero disables the bucket.
+// Burst is the number of seconds worth of tokens a bucket holds, it defaults to one second.
+type RateLimit struct {
+	PacketsPerSecond float64
+	BytesPerSecond   float64
+	Burst            float64
+}
+
+func (rl RateLimit) enabled() bool {
+	return rl.PacketsPerSecond > 0 || rl.BytesPerSecond > 0
+}
+
+type tokenBucket struct {
+	rate   float64
+	size   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) tokenBucket {
+	return tokenBucket{rate: rate, size: rate * burst, tokens: rate * burst, last: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.size {
+		tb.tokens = tb.size
+	}
+	tb.last = now
+}
+
+// has reports whether n tokens are available, a disabled bucket always has enough.
+func (tb *tokenBucket) has(n float64) bool {
+	return tb.rate <= 0 || tb.tokens >= n
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb.rate > 0 {
+		tb.tokens -= n
+	}
+}
+
+func (tb *tokenBucket) full() bool {
+	return tb.tokens >= tb.size
+}
+
+// trafficLimiter is the packets and bytes bucket pair of one source or session.
+type trafficLimiter struct {
+	packets tokenBucket
+	bytes   tokenBucket
+}
+
+func newTrafficLimiter(rl RateLimit, now time.Time) *trafficLimiter {
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	return &trafficLimiter{packets: newTokenBucket(rl.PacketsPerSecond, burst, now), bytes: newTokenBucket(rl.BytesPerSecond, burst, now)}
+}
+
+func (tl *trafficLimiter) allow(n int, now time.Time) bool {
+	tl.packets.refill(now)
+	tl.bytes.refill(now)
+	// Both buckets are checked before either is charged, a dropped datagram costs nothing.
+	if !tl.packets.has(1) || !tl.bytes.has(float64(n)) {
+		return false
+	}
+	tl.packets.take(1)
+	tl.bytes.take(float64(n))
+	return true
+}
+
+// sourceLimiter rate limits datagrams per source IP prefix.
+type sourceLimiter struct {
+	limit   RateLimit
+	ipv4    net.IPMask
+	ipv6    net.IPMask
+	sources map[string]*trafficLimiter
+	now     func() time.Time
+	mux     sync.Mutex
+}
+
+func newSourceLimiter(limit RateLimit, prefixV4, prefixV6 int, now func() time.Time) *sourceLimiter {
+	return &sourceLimiter{
+		limit:   limit,
+		ipv4:    net.CIDRMask(prefixV4, 32),
+		ipv6:    net.CIDRMask(prefixV6, 128),
+		sources: map[string]*trafficLimiter{},
+		now:     now,
+	}
+}
+
+// prefix returns the masked source IP of addr, or the whole address if it carries no IP.
+func (sl *sourceLimiter) prefix(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(sl.ipv4).String()
+	}
+	return ip.Mask(sl.ipv6).String()
+}
+
+func (sl *sourceLimiter) allow(addr net.Addr, n int) bool {
+	if !sl.limit.enabled() {
+		return true
+	}
+	defer sl.mux.Unlock()
+	sl.mux.Lock()
+
+	now := sl.now()
+	key := sl.prefix(addr)
+	limiter, ok := sl.sources[key]
+	if !ok {
+		if len(sl.sources) >= maxRateLimitedSources {
+			sl.prune(now)
+			if len(sl.sources) >= maxRateLimitedSources {
+				return false
+			}
+		}
+		limiter = newTrafficLimiter(sl.limit, now)
+		sl.sources[key] = limiter
+	}
+	return limiter.allow(n, now)
+}
+
+// prune forgets sources whose buckets are full again, they would start over with the same state.
+func (sl *sourceLimiter) prune(now time.Time) {
+	for key, limiter := range sl.sources {
+		limiter.packets.refill(now)
+		limiter.bytes.refill(now)
+		if limiter.packets.full() && limiter.bytes.full() {
+			delete(sl.sources, key)
+		}
+	}
+}
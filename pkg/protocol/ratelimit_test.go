@@ -0,0 +1,45 @@
+package dtp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrafficLimiter(t *testing.T) {
+	now := time.Date(2025, 8, 28, 12, 0, 0, 0, time.UTC)
+	limiter := newTrafficLimiter(RateLimit{PacketsPerSecond: 10, BytesPerSecond: 100}, now)
+
+	assert.True(t, limiter.allow(60, now))
+	assert.False(t, limiter.allow(60, now), "byte bucket is empty")
+	assert.True(t, limiter.allow(40, now))
+	assert.True(t, limiter.allow(60, now.Add(time.Second)), "bucket refills over time")
+
+	for i := 0; i < 9; i++ {
+		limiter.allow(0, now.Add(time.Second))
+	}
+	assert.False(t, limiter.allow(0, now.Add(time.Second)), "packet bucket is empty")
+}
+
+func TestSourcePrefix(t *testing.T) {
+	now := time.Date(2025, 8, 28, 12, 0, 0, 0, time.UTC)
+	limiter := newSourceLimiter(RateLimit{PacketsPerSecond: 1}, 24, 48, func() time.Time { return now })
+
+	tests := []struct {
+		addr net.Addr
+		exp  string
+	}{
+		{addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.17"), Port: 4000}, exp: "192.168.1.0"},
+		{addr: &net.UDPAddr{IP: net.ParseIP("2001:db8:1:2::1"), Port: 4000}, exp: "2001:db8:1::"},
+	}
+
+	for _, subTest := range tests {
+		assert.Equal(t, subTest.exp, limiter.prefix(subTest.addr))
+	}
+
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.1.99"), Port: 5000}
+	assert.True(t, limiter.allow(tests[0].addr, 10))
+	assert.False(t, limiter.allow(other, 10), "addresses of one prefix share a bucket")
+}
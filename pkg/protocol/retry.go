@@ -0,0 +1,86 @@
+package dtp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// A retry token proves that a client can receive packages at the address it claims.
+// It is stateless: the server keeps nothing per token, it only recomputes the tag.
+//
+//	token = timestamp (8 byte, unix nano) | tag (16 byte)
+//	tag   = HMAC-SHA256(epochKey, timestamp | remote address)[:16]
+//
+// The epoch key is derived from the configured secret and the rotation epoch the timestamp
+// falls into, so rotating needs no coordination between servers sharing the same secret.
+const (
+	retryTimestampSize = 8
+	retryTagSize       = 16
+	retryTokenSize     = retryTimestampSize + retryTagSize
+)
+
+type retryTokens struct {
+	secret   []byte
+	rotation time.Duration
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+func newRetryTokens(opts Options) (*retryTokens, error) {
+	secret := opts.RetrySecret
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &retryTokens{secret: secret, rotation: opts.RetrySecretRotation, lifetime: opts.RetryTokenLifetime, now: nowFunc(opts.Clock)}, nil
+}
+
+// epochKey derives the HMAC key for the rotation epoch of t.
+func (rt *retryTokens) epochKey(t time.Time) []byte {
+	var epoch [8]byte
+	binary.BigEndian.PutUint64(epoch[:], uint64(t.UnixNano()/int64(rt.rotation)))
+	mac := hmac.New(sha256.New, rt.secret)
+	mac.Write([]byte("dtp retry"))
+	mac.Write(epoch[:])
+	return mac.Sum(nil)
+}
+
+func (rt *retryTokens) tag(timestamp []byte, t time.Time, addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, rt.epochKey(t))
+	mac.Write(timestamp)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:retryTagSize]
+}
+
+// seal creates a new token bound to addr.
+func (rt *retryTokens) seal(addr net.Addr) []byte {
+	now := rt.now()
+	token := make([]byte, retryTimestampSize, retryTokenSize)
+	binary.BigEndian.PutUint64(token, uint64(now.UnixNano()))
+	return append(token, rt.tag(token, now, addr)...)
+}
+
+// validate reports whether token was sealed by this server for addr and is neither expired
+// nor older than the previous rotation epoch.
+func (rt *retryTokens) validate(token []byte, addr net.Addr) bool {
+	if len(token) != retryTokenSize || addr == nil {
+		return false
+	}
+	timestamp := token[:retryTimestampSize]
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(timestamp)))
+	now := rt.now()
+	age := now.Sub(issued)
+	if age < 0 || age > rt.lifetime {
+		return false
+	}
+	if now.UnixNano()/int64(rt.rotation)-issued.UnixNano()/int64(rt.rotation) > 1 {
+		return false
+	}
+	return hmac.Equal(token[retryTimestampSize:], rt.tag(timestamp, issued, addr))
+}
@@ -0,0 +1,65 @@
+package dtp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryToken(t *testing.T) {
+	now := time.Date(2025, 8, 28, 12, 0, 0, 0, time.UTC)
+	rt, err := newRetryTokens(Options{RetrySecret: []byte("secret")}.withDefaults())
+	assert.Nil(t, err)
+	rt.now = func() time.Time { return now }
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9999}
+	other := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9999}
+	token := rt.seal(addr)
+
+	tampered := append([]byte(nil), token...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		token []byte
+		addr  net.Addr
+		after time.Duration
+		exp   bool
+	}{
+		{name: "valid token", token: token, addr: addr, exp: true},
+		{name: "other address", token: token, addr: other, exp: false},
+		{name: "tampered tag", token: tampered, addr: addr, exp: false},
+		{name: "truncated", token: token[:10], addr: addr, exp: false},
+		{name: "expired", token: token, addr: addr, after: defaultRetryTokenLifetime + time.Second, exp: false},
+		{name: "from the future", token: token, addr: addr, after: -time.Second, exp: false},
+	}
+
+	for _, subTest := range tests {
+		rt.now = func() time.Time { return now.Add(subTest.after) }
+		assert.Equal(t, subTest.exp, rt.validate(subTest.token, subTest.addr), subTest.name)
+	}
+}
+
+func TestRetryTokenRotation(t *testing.T) {
+	now := time.Date(2025, 8, 28, 12, 0, 0, 0, time.UTC)
+	opts := Options{RetrySecret: []byte("secret"), RetrySecretRotation: time.Second, RetryTokenLifetime: time.Hour}.withDefaults()
+	rt, err := newRetryTokens(opts)
+	assert.Nil(t, err)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9999}
+
+	rt.now = func() time.Time { return now }
+	token := rt.seal(addr)
+
+	rt.now = func() time.Time { return now.Add(time.Second) }
+	assert.True(t, rt.validate(token, addr), "token of the previous epoch is accepted")
+
+	rt.now = func() time.Time { return now.Add(2 * time.Second) }
+	assert.False(t, rt.validate(token, addr), "token two epochs old is rejected")
+
+	other, err := newRetryTokens(opts)
+	assert.Nil(t, err)
+	other.now = func() time.Time { return now }
+	assert.True(t, other.validate(token, addr), "servers sharing a secret accept each others tokens")
+}
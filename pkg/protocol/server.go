@@ -1 +1,548 @@
 package dtp
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+)
+
+const maxPackageSize = 2048
+
+// acceptQueueSize is the number of established connections waiting for Accept.
+const acceptQueueSize = 128
+
+// Server accepts sessions on a single packet connection. Sessions are identified by the
+// session id of the packages, not by the remote address.
+type Server struct {
+	conn          net.PacketConn
+	opts          Options
+	sessions      *SessionHandler
+	retry         *retryTokens
+	amplification *amplificationLimiter
+	sources       *sourceLimiter
+	tickets       *ticketSealer
+	counters      counters
+	accepted      chan *DTPConnection
+	// handshakes maps the initial ids and addresses of the clients to their sessions, for repeated REQs.
+	handshakes   map[handshakeKey]*Session
+	handshakeMux sync.Mutex
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func NewServer(conn net.PacketConn, opts Options) (*Server, error) {
+	opts = opts.withDefaults()
+	retry, err := newRetryTokens(opts)
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := newTicketSealer(opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := opts.IDGenerator.NewID(); err != nil {
+		return nil, err
+	}
+	sessions := NewSessionHandler()
+	sessions.SetMaxSessions(opts.MaxSessions)
+	sessions.SetClock(opts.Clock)
+	if opts.SessionStore != nil {
+		sessions.SetStore(opts.SessionStore)
+	}
+	restored, err := restoreSessions(sessions.Store(), opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conn:          conn,
+		opts:          opts,
+		sessions:      sessions,
+		retry:         retry,
+		amplification: newAmplificationLimiter(opts.AmplificationFactor, opts.RetryTokenLifetime, opts.Clock.Now),
+		sources:       newSourceLimiter(opts.SourceRateLimit, opts.SourcePrefixIPv4, opts.SourcePrefixIPv6, opts.Clock.Now),
+		tickets:       tickets,
+		accepted:      make(chan *DTPConnection, acceptQueueSize+len(restored)),
+		handshakes:    map[handshakeKey]*Session{},
+		closed:        make(chan struct{}),
+	}
+	for _, session := range restored {
+		s.restore(session)
+	}
+	sessions.StartReaper(opts.ReapInterval, func(*Session, ExpiryReason) {
+		s.counters.sessionsExpired.Add(1)
+	})
+	return s, nil
+}
+
+// restoreSessions reads the sessions of the store that did not expire meanwhile.
+func restoreSessions(store SessionStore, opts Options) ([]*Session, error) {
+	var restored []*Session
+	var expired []int
+	now := opts.Clock.Now()
+	err := store.Scan(func(record SessionRecord) bool {
+		session, err := restoreSession(record, opts)
+		if err != nil {
+			expired = append(expired, record.ID)
+			return true
+		}
+		if _, ok := session.expired(now); ok {
+			expired = append(expired, record.ID)
+			return true
+		}
+		restored = append(restored, session)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range expired {
+		if err := store.Delete(id); err != nil {
+			return nil, err
+		}
+	}
+	return restored, nil
+}
+
+// restore adds a session of the store, it is handed out by Accept like a new one. The session is
+// written back first, so that a second crash does not restore the package numbers it is about to use.
+func (s *Server) restore(session *Session) {
+	if s.opts.OnStateChange != nil {
+		session.OnStateChange(s.opts.OnStateChange)
+	}
+	if err := s.sessions.Persist(session); err != nil {
+		s.counters.storeErrors.Add(1)
+		return
+	}
+	if err := s.sessions.AddSession(session); err != nil {
+		return
+	}
+	session.transition(HSK)
+	session.transition(ALI)
+	s.amplification.validate(session.remoteAddr)
+	s.accepted <- newServerConnection(s, session)
+	s.counters.sessionsRestored.Add(1)
+}
+
+// persist writes an established session to the store.
+func (s *Server) persist(session *Session) {
+	if err := s.sessions.Persist(session); err != nil {
+		s.counters.storeErrors.Add(1)
+	}
+}
+
+func (s *Server) Sessions() *SessionHandler {
+	return s.sessions
+}
+
+// Stats returns a snapshot of the server counters.
+func (s *Server) Stats() Stats {
+	return s.counters.snapshot()
+}
+
+// Serve reads and handles packages until the connection is closed.
+func (s *Server) Serve() error {
+	buf := make([]byte, maxPackageSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.receive(buf[:n], addr)
+	}
+}
+
+// Accept waits for the next session that completed the handshake.
+func (s *Server) Accept() (*DTPConnection, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.sessions.StopReaper()
+		// The sessions stay in the store, a server started with it later on continues them.
+		if err := s.sessions.Checkpoint(true); err != nil {
+			s.counters.storeErrors.Add(1)
+		}
+		close(s.closed)
+	})
+	return s.conn.Close()
+}
+
+// receive rate limits and decodes a datagram. Bytes from addresses that are not validated yet
+// are credited to their amplification budget.
+func (s *Server) receive(b []byte, addr net.Addr) {
+	s.counters.packetsReceived.Add(1)
+	s.counters.bytesReceived.Add(uint64(len(b)))
+	limited := !s.sources.allow(addr, len(b))
+	if limited {
+		s.counters.sourceRateLimited.Add(1)
+	}
+	p, err := codec.Decode(b)
+	if err != nil || limited {
+		// A client whose REQ is limited is told so, the answer counts against its amplification budget.
+		if limited && err == nil && p.MSgCode == codec.REQ {
+			s.amplification.received(addr, len(b))
+			s.reject(p, RejectRateLimited, addr)
+		}
+		return
+	}
+	session, ok := s.sessions.GetSession(p.SessionID)
+	if !ok && p.MSgCode != codec.REQ {
+		s.counters.unknownSessions.Add(1)
+		return
+	}
+	if ok && session.limiter != nil && !session.limiter.allow(len(b), s.opts.Clock.Now()) {
+		s.counters.sessionRateLimited.Add(1)
+		return
+	}
+	if ok {
+		session.received(len(b))
+	}
+	if !ok || !session.validated || !sameAddr(session.RemoteAddr(), addr) {
+		s.amplification.received(addr, len(b))
+	}
+	s.handle(p, addr)
+}
+
+func (s *Server) handle(p Package, addr net.Addr) {
+	switch p.MSgCode {
+	case codec.REQ:
+		s.handleRequest(p, addr)
+	case codec.ACK:
+		session, ok := s.sessions.GetSession(p.SessionID)
+		if !ok || !sameAddr(session.RemoteAddr(), addr) {
+			return
+		}
+		session.touch(s.opts.Clock.Now())
+		if session.State() == OPN {
+			if opened, ok := session.EnteredAt(OPN); ok {
+				session.sampleRTT(s.opts.Clock.Now().Sub(opened))
+			}
+			// The ACK echoes our session, so the client receives at addr.
+			session.validated = true
+			s.amplification.validate(addr)
+			select {
+			case s.accepted <- newServerConnection(s, session):
+				session.transition(ALI)
+				s.persist(session)
+			default:
+				s.fail(session, p, RejectTooManySessions, addr)
+				return
+			}
+		}
+		if session.State() == ALI {
+			s.reply(session, p, codec.ALI, nil, addr)
+			if !session.ticketIssued {
+				session.ticketIssued = true
+				s.issueTicket(session)
+			}
+		}
+	case codec.ALI, codec.CLD:
+		session, ok := s.sessions.GetSession(p.SessionID)
+		if !ok {
+			return
+		}
+		// Sealed data is opened here and only once, a replayed package is dropped before it reaches the
+		// connection or moves the session.
+		sealed := p.MSgCode == codec.ALI && len(p.Payload) > 0 && session.keys != nil
+		if sealed {
+			data, ok := authenticated(session, p)
+			if !ok {
+				return
+			}
+			p.Payload, p.PayloadLength = data, len(data)
+		}
+		// Only sealed data may come from a new address, it starts the validation of the path.
+		if !sameAddr(session.RemoteAddr(), addr) && (!sealed || !s.probe(session, addr)) {
+			return
+		}
+		session.touch(s.opts.Clock.Now())
+		if c := session.connection(); c != nil {
+			c.deliver(p)
+		}
+		if p.MSgCode == codec.CLD {
+			session.transition(CLD)
+			s.sessions.RemoveSession(p.SessionID)
+		}
+	case codec.PCH, codec.PRS:
+		if session, ok := s.sessions.GetSession(p.SessionID); ok {
+			s.handlePath(session, p, addr)
+		}
+	}
+}
+
+// handleRequest creates a session for a REQ. If a retry is required the REQ has to echo a valid
+// retry token first; until then the server answers with RTY and keeps no state at all.
+func (s *Server) handleRequest(p Package, addr net.Addr) {
+	if session, ok := s.handshake(handshakeKey{initialID: p.SessionID, addr: addr.String()}); ok {
+		// A repeated REQ means our OPN, or the ALI of a resumption, got lost.
+		hello := handshakeParams{KeyShare: session.keyShare, ConnectionID: session.id}.encode()
+		if state := session.State(); state == OPN {
+			s.reply(session, p, codec.OPN, hello, addr)
+		} else if state == ALI && session.resumed {
+			s.reply(session, p, codec.ALI, hello, addr)
+		}
+		return
+	}
+
+	params, err := decodeHandshakeParams(p.Payload)
+	if err != nil {
+		return
+	}
+
+	validated := false
+	powRequired := s.powRequired()
+	if powRequired || s.retryRequired() {
+		valid := s.retry.validate(params.Token, addr)
+		if valid && powRequired {
+			valid = verifyPow(powChallenge(params.Token, p.SessionID, params.KeyShare), params.Solution, s.opts.PowDifficulty)
+		}
+		if !valid {
+			challenge := handshakeParams{Token: s.retry.seal(addr)}
+			if powRequired {
+				challenge.Difficulty = s.opts.PowDifficulty
+				s.counters.challengesSent.Add(1)
+			}
+			s.counters.retriesSent.Add(1)
+			s.reply(nil, p, codec.RTY, challenge.encode(), addr)
+			return
+		}
+		validated = true
+	}
+
+	if reason := s.admit(p, addr); reason != RejectNone {
+		s.reject(p, reason, addr)
+		return
+	}
+
+	id, err := s.newID()
+	if err != nil {
+		// The client would wait for its handshake to time out, it is told at once instead.
+		s.reject(p, RejectTooManySessions, addr)
+		return
+	}
+	session := newSession(id, s.opts.Clock)
+	session.initialID = p.SessionID
+	session.remoteAddr = addr
+	session.setLifetime(s.opts.IdleTimeout, s.opts.MaxLifetime)
+	session.setHandshakeTimeout(s.opts.handshakeLifetime())
+	session.validated = validated
+	if s.opts.OnStateChange != nil {
+		session.OnStateChange(s.opts.OnStateChange)
+	}
+	session.transition(HSK)
+	if s.opts.SessionRateLimit.enabled() {
+		session.limiter = newTrafficLimiter(s.opts.SessionRateLimit, session.createdAt)
+	}
+
+	// A ticket is only worth something together with a key share, without one the session has no keys.
+	var resumption *ticketState
+	if len(params.Ticket) > 0 && len(params.KeyShare) > 0 {
+		if ticket, ok := s.tickets.redeem(params.Ticket); ok {
+			resumption = &ticket
+		}
+	}
+	if len(params.KeyShare) > 0 {
+		private, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return
+		}
+		var psk []byte
+		if resumption != nil {
+			psk = resumption.secret
+		}
+		session.keys, err = agreeSessionKeys(private, params.KeyShare, session.initialID, false, s.opts, psk)
+		if err != nil {
+			return
+		}
+		session.keyShare = private.PublicKey().Bytes()
+	}
+	if err := s.sessions.AddSession(session); err != nil {
+		if errors.Is(err, ErrTooManySessions) {
+			s.fail(session, p, RejectTooManySessions, addr)
+		}
+		return
+	}
+	s.trackHandshake(session)
+	s.counters.sessionsAccepted.Add(1)
+	if validated {
+		s.amplification.validate(addr)
+	}
+	if resumption != nil {
+		s.resume(session, p, resumption, params, addr)
+		return
+	}
+	session.transition(OPN)
+	s.reply(session, p, codec.OPN, handshakeParams{KeyShare: session.keyShare, ConnectionID: session.id}.encode(), addr)
+}
+
+// newID issues an id that is not in use. Collisions only matter for short ids or many backend bits,
+// after maxIDAttempts of them it gives up with errIDSpaceExhausted.
+func (s *Server) newID() (int, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := s.opts.IDGenerator.NewID()
+		if err != nil || !s.sessions.HasSession(id) {
+			return id, err
+		}
+	}
+	return 0, errIDSpaceExhausted
+}
+
+// handshakeKey identifies the REQs of one client. The initial id is picked by the client, so it
+// only counts together with the address: another client cannot block a handshake by reusing it.
+type handshakeKey struct {
+	initialID int
+	addr      string
+}
+
+// trackHandshake remembers the initial id and address of a session until it is closed.
+func (s *Server) trackHandshake(session *Session) {
+	key := handshakeKey{initialID: session.initialID, addr: session.RemoteAddr().String()}
+	s.handshakeMux.Lock()
+	s.handshakes[key] = session
+	s.handshakeMux.Unlock()
+	session.OnStateChange(func(session *Session, change StateTransition) {
+		if change.To != CLD {
+			return
+		}
+		defer s.handshakeMux.Unlock()
+		s.handshakeMux.Lock()
+		if s.handshakes[key] == session {
+			delete(s.handshakes, key)
+		}
+	})
+}
+
+func (s *Server) handshake(key handshakeKey) (*Session, bool) {
+	defer s.handshakeMux.Unlock()
+	s.handshakeMux.Lock()
+	session, ok := s.handshakes[key]
+	return session, ok
+}
+
+// resume skips the OPN/ACK round trip for a session with a redeemed ticket: the session is
+// established at once and the early data becomes the first message of the connection.
+func (s *Server) resume(session *Session, p Package, resumption *ticketState, params handshakeParams, addr net.Addr) {
+	session.resumedFrom = resumption.sessionId
+	session.resumed = true
+	c := newServerConnection(s, session)
+	if len(params.EarlyData) > 0 {
+		if data, err := openEarlyData(resumption.secret, session.initialID, params.KeyShare, params.EarlyData); err == nil {
+			c.pending = append(c.pending, &Message{Session: session.id, DataLength: len(data), Data: data})
+		}
+	}
+	select {
+	case s.accepted <- c:
+		session.transition(ALI)
+		s.persist(session)
+	default:
+		s.fail(session, p, RejectTooManySessions, addr)
+		return
+	}
+	s.counters.sessionsResumed.Add(1)
+	s.reply(session, p, codec.ALI, handshakeParams{KeyShare: session.keyShare, ConnectionID: session.id}.encode(), addr)
+	s.issueTicket(session)
+}
+
+// issueTicket sends the client a ticket for resuming the session later on.
+func (s *Server) issueTicket(session *Session) error {
+	if !s.opts.SessionTickets || session.keys == nil {
+		return nil
+	}
+	ticket, err := s.tickets.seal(session.id, session.keys.resumption)
+	if err != nil {
+		return err
+	}
+	payload := handshakeParams{Ticket: ticket, Lifetime: int(s.opts.TicketLifetime / time.Second)}.encode()
+	pn := session.sendSeq.Add(1) - 1
+	sealed, err := session.keys.seal(pn, dataAAD(session.id, pn), payload)
+	if err != nil {
+		return err
+	}
+	res := Package{SessionID: session.id, MSgCode: codec.TKT, PackedID: int(pn), PayloadLength: len(sealed), Payload: sealed}
+	return s.send(session, res, session.RemoteAddr())
+}
+
+// admit runs the session cap and the admission policy for a REQ.
+func (s *Server) admit(p Package, addr net.Addr) RejectReason {
+	size := s.sessions.Size()
+	if s.opts.MaxSessions > 0 && size >= s.opts.MaxSessions {
+		return RejectTooManySessions
+	}
+	if s.opts.Admission == nil {
+		return RejectNone
+	}
+	return s.opts.Admission.Admit(AdmissionRequest{SessionID: p.SessionID, RemoteAddr: addr, Sessions: size})
+}
+
+func (s *Server) reject(p Package, reason RejectReason, addr net.Addr) {
+	s.counters.sessionsRejected.Add(1)
+	s.reply(nil, p, codec.ERR, handshakeParams{Reason: reason}.encode(), addr)
+}
+
+// fail rejects a session that was already created and drops it.
+func (s *Server) fail(session *Session, p Package, reason RejectReason, addr net.Addr) {
+	session.transition(ERR)
+	s.sessions.RemoveSession(session.id)
+	s.reject(p, reason, addr)
+	session.transition(CLD)
+}
+
+// powRequired reports whether the server is loaded enough to ask for proof-of-work.
+// The challenge rides on the retry token, so it implies a retry.
+func (s *Server) powRequired() bool {
+	return s.opts.PowThreshold > 0 && s.sessions.Size() >= s.opts.PowThreshold
+}
+
+func (s *Server) retryRequired() bool {
+	switch s.opts.RetryMode {
+	case RetryAlways:
+		return true
+	case RetryUnderLoad:
+		return s.sessions.Size() >= s.opts.RetryLoadThreshold
+	}
+	return false
+}
+
+// reply answers p. session is nil if the server keeps no state for the answer.
+func (s *Server) reply(session *Session, p Package, msg codec.State, payload []byte, addr net.Addr) error {
+	res := Package{SessionID: p.SessionID, UserID: p.UserID, MSgCode: msg, PayloadLength: len(payload), Payload: payload}
+	return s.send(session, res, addr)
+}
+
+// send is the single path every datagram of the server leaves through. Until the remote address
+// is validated it is subject to the amplification limit, datagrams over the budget are dropped.
+func (s *Server) send(session *Session, p Package, addr net.Addr) error {
+	b := codec.Encode(p)
+	if (session == nil || !session.validated) && !s.amplification.allow(addr, len(b)) {
+		s.counters.amplificationLimited.Add(1)
+		return nil
+	}
+	n, err := s.conn.WriteTo(b, addr)
+	if err != nil {
+		return err
+	}
+	s.counters.packetsSent.Add(1)
+	s.counters.bytesSent.Add(uint64(n))
+	if session != nil {
+		session.sent(n)
+	}
+	return nil
+}
+
+func sameAddr(a, b net.Addr) bool {
+	return a != nil && b != nil && a.String() == b.String()
+}
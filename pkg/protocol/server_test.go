@@ -0,0 +1,345 @@
+package dtp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/capture"
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
+	udpsim "github.com/WhilecodingDoLearn/dtp/pkg/protocol/dev/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func listenClient(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestDialWithRetry(t *testing.T) {
+	server := startServer(t, Options{RetryMode: RetryAlways})
+	client := listenClient(t)
+
+	conn, err := Dial(client, server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, ALI, conn.Session().State())
+
+	session, ok := server.Sessions().GetSession(conn.Session().ID())
+	assert.True(t, ok, "session is created after the token was echoed")
+	assert.Equal(t, client.LocalAddr().String(), session.RemoteAddr().String())
+}
+
+func TestRequestWithoutTokenCreatesNoState(t *testing.T) {
+	server := startServer(t, Options{RetryMode: RetryAlways})
+	client := listenClient(t)
+
+	req := codec.Encode(codec.Package{SessionID: 7, MSgCode: codec.REQ})
+	_, err := client.WriteTo(req, server.conn.LocalAddr())
+	assert.Nil(t, err)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxPackageSize)
+	n, _, err := client.ReadFrom(buf)
+	assert.Nil(t, err)
+	res, err := codec.Decode(buf[:n])
+	assert.Nil(t, err)
+	assert.Equal(t, codec.RTY, res.MSgCode)
+	assert.Equal(t, 0, server.Sessions().Size())
+}
+
+// TestSharedInitialID lets two clients pick the same initial id. Both get a session of their own, and
+// a repeated REQ still gets the first answer again.
+func TestSharedInitialID(t *testing.T) {
+	server := startServer(t, Options{})
+	request := func(client net.PacketConn) codec.Package {
+		req := codec.Encode(codec.Package{SessionID: 7, MSgCode: codec.REQ})
+		_, err := client.WriteTo(req, server.conn.LocalAddr())
+		assert.Nil(t, err)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, maxPackageSize)
+		n, _, err := client.ReadFrom(buf)
+		assert.Nil(t, err)
+		res, err := codec.Decode(buf[:n])
+		assert.Nil(t, err)
+		return res
+	}
+
+	first, second := listenClient(t), listenClient(t)
+	opened := request(first)
+	assert.Equal(t, codec.OPN, opened.MSgCode)
+	assert.Equal(t, codec.OPN, request(second).MSgCode)
+	assert.Equal(t, 2, server.Sessions().Size())
+	assert.Equal(t, opened.Payload, request(first).Payload, "the repeated REQ is answered with the same OPN")
+	assert.Equal(t, 2, server.Sessions().Size())
+}
+
+func TestRetryUnderLoad(t *testing.T) {
+	server := startServer(t, Options{RetryMode: RetryUnderLoad, RetryLoadThreshold: 1})
+	assert.False(t, server.retryRequired(), "no retry below the threshold")
+
+	_, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	assert.True(t, server.retryRequired(), "retry once the threshold is reached")
+
+	_, err = Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, server.Sessions().Size())
+}
+
+func TestAdmission(t *testing.T) {
+	banned := listenClient(t)
+	forbidden := AdmissionFunc(func(req AdmissionRequest) RejectReason {
+		if sameAddr(req.RemoteAddr, banned.LocalAddr()) {
+			return RejectForbidden
+		}
+		return RejectNone
+	})
+	server := startServer(t, Options{MaxSessions: 2, Admission: forbidden})
+
+	tests := []struct {
+		name   string
+		client net.PacketConn
+		reason RejectReason
+	}{
+		{name: "admitted", client: listenClient(t), reason: RejectNone},
+		{name: "rejected by policy", client: banned, reason: RejectForbidden},
+		{name: "admitted up to the cap", client: listenClient(t), reason: RejectNone},
+		{name: "over the session cap", client: listenClient(t), reason: RejectTooManySessions},
+	}
+
+	for _, subTest := range tests {
+		_, err := Dial(subTest.client, server.conn.LocalAddr(), Options{})
+		if subTest.reason == RejectNone {
+			assert.Nil(t, err, subTest.name)
+			continue
+		}
+		var rejectErr *RejectError
+		assert.ErrorAs(t, err, &rejectErr, subTest.name)
+		assert.ErrorIs(t, err, ErrConnectionRefused, subTest.name)
+		assert.Equal(t, subTest.reason, rejectErr.Reason, subTest.name)
+	}
+
+	stats := server.Stats()
+	assert.Equal(t, uint64(2), stats.SessionsAccepted)
+	assert.Equal(t, uint64(2), stats.SessionsRejected)
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	// The clock of the server stands still, so the bucket does not refill however slow the test runs.
+	clock := udpsim.NewVirtualClock(time.Now())
+	server := startServer(t, Options{SourceRateLimit: RateLimit{PacketsPerSecond: 5}, Clock: clock})
+	client := listenClient(t)
+
+	for sid := 0; sid < 20; sid++ {
+		req := codec.Encode(codec.Package{SessionID: sid, MSgCode: codec.REQ})
+		_, err := client.WriteTo(req, server.conn.LocalAddr())
+		assert.Nil(t, err)
+	}
+
+	assert.Eventually(t, func() bool { return server.Stats().PacketsReceived == 20 }, time.Second, 10*time.Millisecond)
+	stats := server.Stats()
+	assert.Equal(t, uint64(5), stats.SessionsAccepted)
+	assert.Equal(t, uint64(15), stats.SourceRateLimited)
+	assert.Eventually(t, func() bool { return server.Stats().SessionsRejected == 15 }, time.Second, 10*time.Millisecond)
+
+	_, err := Dial(client, server.conn.LocalAddr(), Options{})
+	var rejectErr *RejectError
+	if assert.ErrorAs(t, err, &rejectErr, "the limited client is told why") {
+		assert.Equal(t, RejectRateLimited, rejectErr.Reason)
+	}
+}
+
+func TestDialWithProofOfWork(t *testing.T) {
+	server := startServer(t, Options{PowThreshold: 1, PowDifficulty: 8})
+
+	_, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), server.Stats().ChallengesSent, "no challenge below the threshold")
+
+	_, err = Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err, "challenge solved transparently")
+	assert.Equal(t, uint64(1), server.Stats().ChallengesSent)
+
+	_, err = Dial(listenClient(t), server.conn.LocalAddr(), Options{MaxPowDifficulty: 4})
+	var powErr *PowError
+	assert.ErrorAs(t, err, &powErr)
+	assert.ErrorIs(t, err, ErrPowTooHard)
+	assert.Equal(t, 8, powErr.Difficulty)
+	assert.Equal(t, 2, server.Sessions().Size())
+}
+
+// exchange sends p to the server and returns its answer.
+func exchange(t *testing.T, client net.PacketConn, server *Server, p codec.Package) codec.Package {
+	t.Helper()
+	_, err := client.WriteTo(codec.Encode(p), server.conn.LocalAddr())
+	assert.Nil(t, err)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxPackageSize)
+	n, _, err := client.ReadFrom(buf)
+	assert.Nil(t, err)
+	res, err := codec.Decode(buf[:n])
+	assert.Nil(t, err)
+	return res
+}
+
+// TestPowSolutionReplay solves a challenge for one initial id and sends the solution again with
+// another one, it only admits the session it was solved for.
+func TestPowSolutionReplay(t *testing.T) {
+	server := startServer(t, Options{PowThreshold: 1, PowDifficulty: 8})
+	_, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+
+	client := listenClient(t)
+	rty := exchange(t, client, server, codec.Package{SessionID: 7, MSgCode: codec.REQ})
+	assert.Equal(t, codec.RTY, rty.MSgCode)
+	challenge, err := decodeHandshakeParams(rty.Payload)
+	assert.Nil(t, err)
+	solution, ok := solvePow(powChallenge(challenge.Token, 7, nil), challenge.Difficulty, time.Now().Add(time.Second))
+	assert.True(t, ok)
+	solved := handshakeParams{Token: challenge.Token, Solution: solution}.encode()
+
+	tests := []struct {
+		name      string
+		initialID int
+		code      codec.State
+	}{
+		{name: "solved initial id", initialID: 7, code: codec.OPN},
+		{name: "same solution, other initial id", initialID: 8, code: codec.RTY},
+		{name: "same solution, third initial id", initialID: 9, code: codec.RTY},
+	}
+
+	for _, subTest := range tests {
+		res := exchange(t, client, server, codec.Package{SessionID: subTest.initialID, MSgCode: codec.REQ, Payload: solved, PayloadLength: len(solved)})
+		assert.Equal(t, subTest.code, res.MSgCode, subTest.name)
+	}
+	assert.Equal(t, 2, server.Sessions().Size())
+}
+
+// assertPayloadLengths checks that every recorded package announces the length of the payload it
+// carries on the wire, sealed or not.
+func assertPayloadLengths(t *testing.T, records []capture.Record) {
+	t.Helper()
+	assert.NotEmpty(t, records)
+	for _, r := range records {
+		p, err := codec.Decode(r.Data)
+		if assert.Nil(t, err) {
+			assert.Equal(t, len(p.Payload), p.PayloadLength, "payload length of %v", p.MSgCode)
+		}
+	}
+}
+
+func TestSealedPayloadLength(t *testing.T) {
+	server := startServer(t, Options{SessionTickets: true})
+	var recorder capture.Recorder
+	client, err := Dial(capture.Wrap(listenClient(t), recorder.Hook()), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	assert.Nil(t, client.WriteMessage(&Message{Data: []byte("ping")}))
+	_, err = accepted.ReadMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, accepted.WriteMessage(&Message{Data: []byte("pong")}))
+	msg, err := client.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, msg.DataLength)
+	assertPayloadLengths(t, recorder.Records())
+}
+
+func TestMessagesAcrossKeyUpdate(t *testing.T) {
+	server := startServer(t, Options{})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	assert.Equal(t, client.Session().ID(), accepted.Session().ID())
+
+	exchange := func(from, to *DTPConnection, data string) {
+		t.Helper()
+		assert.Nil(t, from.WriteMessage(&Message{Data: []byte(data)}))
+		msg, err := to.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, data, string(msg.Data))
+	}
+
+	exchange(client, accepted, "ping")
+	exchange(accepted, client, "pong")
+
+	assert.Nil(t, client.UpdateKeys())
+	exchange(client, accepted, "ping")
+	assert.Equal(t, uint8(1), accepted.Session().KeyPhase(), "server followed the client")
+	exchange(accepted, client, "pong")
+
+	assert.Nil(t, accepted.UpdateKeys())
+	exchange(accepted, client, "pong")
+	assert.Equal(t, uint8(2), client.Session().KeyPhase(), "client followed the server")
+
+	assert.Nil(t, client.Close())
+	_, err = accepted.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestResumptionWithEarlyData(t *testing.T) {
+	server := startServer(t, Options{SessionTickets: true})
+
+	first, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	assert.Nil(t, accepted.WriteMessage(&Message{Data: []byte("hello")}))
+	_, err = first.ReadMessage()
+	assert.Nil(t, err)
+	ticket := first.Ticket()
+	assert.NotNil(t, ticket, "ticket issued after the handshake")
+	assert.Nil(t, first.Close())
+
+	resumed, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{ResumeTicket: ticket, EarlyData: []byte("early")})
+	assert.Nil(t, err)
+	from, ok := resumed.Session().ResumedFrom()
+	assert.True(t, ok)
+	assert.Equal(t, first.Session().ID(), from)
+
+	accepted, err = server.Accept()
+	assert.Nil(t, err)
+	from, ok = accepted.Session().ResumedFrom()
+	assert.True(t, ok)
+	assert.Equal(t, first.Session().ID(), from)
+	assert.Equal(t, resumed.Session().ID(), accepted.Session().ID())
+	msg, err := accepted.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "early", string(msg.Data))
+	assert.Equal(t, uint64(1), server.Stats().SessionsResumed)
+
+	replayed, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{ResumeTicket: ticket, EarlyData: []byte("early")})
+	assert.Nil(t, err)
+	_, ok = replayed.Session().ResumedFrom()
+	assert.False(t, ok, "a replayed ticket falls back to the full handshake")
+
+	accepted, err = server.Accept()
+	assert.Nil(t, err)
+	msg, err = accepted.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "early", string(msg.Data), "early data is sent again after the full handshake")
+	assert.Equal(t, uint64(1), server.Stats().SessionsResumed)
+}
@@ -2,38 +2,112 @@ package dtp
 
 import (
 	"fmt"
+	"net"
 	"time"
 )
 
+// Validate checks that the session can be handed to a SessionHandler.
 func (sh *Session) Validate() error {
+	if !isSessionState(sh.State()) {
+		return fmt.Errorf("session %v: %v is no session state", sh.id, sh.State())
+	}
 	return nil
 }
 
 func (sh *Session) State() State {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
 	return sh.state
 }
 
+func (sh *Session) ID() int {
+	return sh.id
+}
+
+// RemoteAddr returns the address of the peer. On the server it changes when the client migrates.
+func (sh *Session) RemoteAddr() net.Addr {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return sh.remoteAddr
+}
+
+func (sh *Session) setConn(c *DTPConnection) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	sh.conn = c
+}
+
+// connection returns the connection of an established session, or nil.
+func (sh *Session) connection() *DTPConnection {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return sh.conn
+}
+
+// ResumedFrom returns the id of the session whose ticket resumed this session. The second
+// result is false if the session went through the full handshake.
+func (sh *Session) ResumedFrom() (int, bool) {
+	return sh.resumedFrom, sh.resumed
+}
+
+// KeyPhase returns the key phase the session currently seals with.
+func (sh *Session) KeyPhase() uint8 {
+	if sh.keys == nil {
+		return 0
+	}
+	return sh.keys.currentPhase()
+}
+
 // Creates a new session
 func NewSession(sessionId int) *Session {
-	newSession := Session{id: sessionId, createdAt: time.Now(), state: REQ}
-	return &newSession
+	return newSession(sessionId, wallClock{})
+}
+
+// newSession creates a session whose timestamps are taken from clock.
+func newSession(sessionId int, clock Clock) *Session {
+	return &Session{id: sessionId, createdAt: clock.Now(), state: REQ, clock: clock}
+}
+
+// now returns the time on the clock of the session.
+func (sh *Session) now() time.Time {
+	if sh.clock == nil {
+		return time.Now()
+	}
+	return sh.clock.Now()
 }
 
 func NewSessionHandler() *SessionHandler {
-	return &SessionHandler{sessionCache: map[int]*Session{}}
+	sh := &SessionHandler{store: NewMemoryStore(), clock: wallClock{}}
+	for i := range sh.shards {
+		sh.shards[i].sessions = map[int]*Session{}
+	}
+	return sh
 }
 
 const idLength = 4
 
+// SetMaxSessions caps the number of sessions AddSession accepts, zero removes the cap.
+func (sh *SessionHandler) SetMaxSessions(max int) {
+	sh.maxSessions.Store(int64(max))
+}
+
+// shard returns the shard of a session id. The ids are mixed first, so that consecutive ids
+// spread over all shards.
+func (sh *SessionHandler) shard(sessionId int) *sessionShard {
+	h := uint64(sessionId) * 0x9e3779b97f4a7c15
+	return &sh.shards[h>>(64-sessionShardBits)]
+}
+
 func (sh *SessionHandler) HasSession(sessionId int) bool {
-	_, ok := sh.sessionCache[sessionId]
+	_, ok := sh.GetSession(sessionId)
 	return ok
 }
 
 func (sh *SessionHandler) GetSession(sessionId int) (*Session, bool) {
-	defer sh.mux.Unlock()
-	sh.mux.Lock()
-	session, ok := sh.sessionCache[sessionId]
+	shard := sh.shard(sessionId)
+	defer shard.mux.RUnlock()
+	shard.mux.RLock()
+	session, ok := shard.sessions[sessionId]
 	return session, ok
 }
 
@@ -43,30 +117,60 @@ func (sh *SessionHandler) AddSession(session *Session) error {
 		return err
 	}
 
-	defer sh.mux.Unlock()
-	sh.mux.Lock()
+	// The slot is taken before the shard is locked, so that the cap holds across shards.
+	size := sh.size.Add(1)
+	if max := sh.maxSessions.Load(); max > 0 && size > max {
+		sh.size.Add(-1)
+		return ErrTooManySessions
+	}
 
-	_, ok := sh.sessionCache[session.id]
+	shard := sh.shard(session.id)
+	defer shard.mux.Unlock()
+	shard.mux.Lock()
+
+	_, ok := shard.sessions[session.id]
 	if ok {
-		return fmt.Errorf("sessionHandler - StartSession, sessionId %v already exists", &session.id)
+		sh.size.Add(-1)
+		return fmt.Errorf("sessionHandler - StartSession, sessionId %v already exists", session.id)
 	}
 
-	sh.sessionCache[session.id] = session
+	shard.sessions[session.id] = session
 
 	return nil
 }
 
 func (sh *SessionHandler) RemoveSession(sessionId int) error {
-	defer sh.mux.Unlock()
-	sh.mux.Lock()
-	_, ok := sh.sessionCache[sessionId]
+	shard := sh.shard(sessionId)
+	shard.mux.Lock()
+	_, ok := shard.sessions[sessionId]
 	if ok {
-		delete(sh.sessionCache, sessionId)
-		return nil
+		delete(shard.sessions, sessionId)
+		sh.size.Add(-1)
+	}
+	shard.mux.Unlock()
+	if ok {
+		return sh.Store().Delete(sessionId)
 	}
 	return fmt.Errorf("Session not found %v", sessionId)
 }
 
 func (sh *SessionHandler) Size() int {
-	return len(sh.sessionCache)
+	return int(sh.size.Load())
+}
+
+// Range calls f for every session until f returns false. Every shard is read locked while it is
+// visited, so f must not add or remove sessions. Sessions added or removed meanwhile in other
+// shards may or may not be visited.
+func (sh *SessionHandler) Range(f func(session *Session) bool) {
+	for i := range sh.shards {
+		shard := &sh.shards[i]
+		shard.mux.RLock()
+		for _, session := range shard.sessions {
+			if !f(session) {
+				shard.mux.RUnlock()
+				return
+			}
+		}
+		shard.mux.RUnlock()
+	}
 }
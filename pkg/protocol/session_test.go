@@ -0,0 +1,126 @@
+package dtp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int
+		add   []int
+		fails []int
+		size  int
+	}{
+		{name: "unlimited", add: []int{1, 2, 3}, size: 3},
+		{name: "duplicate id", add: []int{1, 1, 2}, fails: []int{1}, size: 2},
+		{name: "over the cap", max: 2, add: []int{1, 2, 3}, fails: []int{2}, size: 2},
+		{name: "duplicate does not use up the cap", max: 2, add: []int{1, 1, 2}, fails: []int{1}, size: 2},
+	}
+
+	for _, subTest := range tests {
+		handler := NewSessionHandler()
+		handler.SetMaxSessions(subTest.max)
+		var fails []int
+		for i, sid := range subTest.add {
+			if err := handler.AddSession(NewSession(sid)); err != nil {
+				fails = append(fails, i)
+			}
+		}
+		assert.Equal(t, subTest.fails, fails, subTest.name)
+		assert.Equal(t, subTest.size, handler.Size(), subTest.name)
+	}
+}
+
+func TestSessionHandlerRange(t *testing.T) {
+	handler := NewSessionHandler()
+	for sid := 0; sid < 1000; sid++ {
+		assert.Nil(t, handler.AddSession(NewSession(sid)))
+	}
+	assert.Nil(t, handler.RemoveSession(500))
+	assert.NotNil(t, handler.RemoveSession(500))
+
+	seen := map[int]bool{}
+	handler.Range(func(session *Session) bool {
+		seen[session.ID()] = true
+		return true
+	})
+	assert.Len(t, seen, 999)
+	assert.False(t, seen[500])
+
+	visited := 0
+	handler.Range(func(*Session) bool {
+		visited++
+		return visited < 10
+	})
+	assert.Equal(t, 10, visited, "range stops once f returns false")
+}
+
+func TestSessionHandlerConcurrent(t *testing.T) {
+	handler := NewSessionHandler()
+	handler.SetMaxSessions(500)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				sid := worker*1000 + i
+				handler.AddSession(NewSession(sid))
+				handler.HasSession(sid)
+				handler.Size()
+				if i%2 == 0 {
+					handler.RemoveSession(sid)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	count := 0
+	handler.Range(func(*Session) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, count, handler.Size())
+	assert.LessOrEqual(t, count, 500)
+}
+
+const benchmarkSessions = 100000
+
+func BenchmarkGetSession(b *testing.B) {
+	handler := NewSessionHandler()
+	for sid := 0; sid < benchmarkSessions; sid++ {
+		handler.AddSession(NewSession(sid))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		sid := 0
+		for pb.Next() {
+			handler.GetSession(sid % benchmarkSessions)
+			sid += 7919
+		}
+	})
+}
+
+func BenchmarkAddRemoveSession(b *testing.B) {
+	handler := NewSessionHandler()
+	var next sync.Mutex
+	worker := 0
+	b.RunParallel(func(pb *testing.PB) {
+		next.Lock()
+		base := worker * benchmarkSessions
+		worker++
+		next.Unlock()
+		i := 0
+		for pb.Next() {
+			sid := base + i%benchmarkSessions
+			handler.AddSession(NewSession(sid))
+			handler.RemoveSession(sid)
+			i++
+		}
+	})
+}
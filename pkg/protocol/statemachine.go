@@ -0,0 +1,98 @@
+package dtp
+
+import "time"
+
+// The life of a session:
+//
+//	REQ → HSK → OPN → ALI → CLS → CLD
+//
+// REQ is the request that started it, HSK the handshake (retry, proof-of-work, key agreement), OPN the
+// opened session waiting for the ACK of the client, ALI the established session and CLS the local
+// close that is still being announced. A resumed session goes from HSK straight to ALI. Every state
+// but CLD may fail into ERR, and every state may be left for CLD when the peer closes or the session expires.
+var transitions = map[State][]State{
+	REQ: {HSK, ERR, CLD},
+	HSK: {OPN, ALI, ERR, CLD},
+	OPN: {ALI, CLS, ERR, CLD},
+	ALI: {CLS, ERR, CLD},
+	CLS: {ERR, CLD},
+	ERR: {CLD},
+	CLD: {},
+}
+
+// StateTransition records a single change of the session state.
+type StateTransition struct {
+	From State
+	To   State
+	At   time.Time
+}
+
+// StateChangeFunc is called after every transition of a session, outside of the session lock.
+type StateChangeFunc func(session *Session, transition StateTransition)
+
+func isSessionState(state State) bool {
+	_, ok := transitions[state]
+	return ok
+}
+
+func allowedTransition(from, to State) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the session to state to. Transitions not in the table fail with a *TransitionError.
+// Entering CLD clears the attributes of the session.
+func (sh *Session) transition(to State) error {
+	sh.mux.Lock()
+	from := sh.state
+	if !allowedTransition(from, to) {
+		sh.mux.Unlock()
+		return &TransitionError{From: from, To: to}
+	}
+	change := StateTransition{From: from, To: to, At: sh.now()}
+	sh.state = to
+	sh.transitions = append(sh.transitions, change)
+	callbacks := sh.onStateChange
+	sh.mux.Unlock()
+
+	for _, callback := range callbacks {
+		callback(sh, change)
+	}
+	if to == CLD {
+		sh.attrs.clear()
+	}
+	return nil
+}
+
+// OnStateChange registers a callback for all further transitions of the session.
+func (sh *Session) OnStateChange(callback StateChangeFunc) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	sh.onStateChange = append(sh.onStateChange, callback)
+}
+
+// Transitions returns the transitions of the session so far, oldest first.
+func (sh *Session) Transitions() []StateTransition {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return append([]StateTransition(nil), sh.transitions...)
+}
+
+// EnteredAt returns the time the session last entered state.
+func (sh *Session) EnteredAt(state State) (time.Time, bool) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	if state == REQ {
+		return sh.createdAt, true
+	}
+	for i := len(sh.transitions) - 1; i >= 0; i-- {
+		if sh.transitions[i].To == state {
+			return sh.transitions[i].At, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,106 @@
+package dtp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  []State
+		to    State
+		valid bool
+	}{
+		{name: "handshake starts", to: HSK, valid: true},
+		{name: "open after handshake", path: []State{HSK}, to: OPN, valid: true},
+		{name: "resumed session", path: []State{HSK}, to: ALI, valid: true},
+		{name: "established", path: []State{HSK, OPN}, to: ALI, valid: true},
+		{name: "closing", path: []State{HSK, OPN, ALI}, to: CLS, valid: true},
+		{name: "closed by peer", path: []State{HSK, OPN, ALI}, to: CLD, valid: true},
+		{name: "failed handshake", path: []State{HSK}, to: ERR, valid: true},
+		{name: "open without handshake", to: OPN},
+		{name: "back to handshake", path: []State{HSK, OPN}, to: HSK},
+		{name: "revived after close", path: []State{CLD}, to: ALI},
+		{name: "error after close", path: []State{CLD}, to: ERR},
+		{name: "no session state", path: []State{HSK}, to: State(42)},
+	}
+
+	for _, subTest := range tests {
+		session := NewSession(1)
+		for _, state := range subTest.path {
+			assert.Nil(t, session.transition(state), subTest.name)
+		}
+		from := session.State()
+		err := session.transition(subTest.to)
+		if subTest.valid {
+			assert.Nil(t, err, subTest.name)
+			assert.Equal(t, subTest.to, session.State(), subTest.name)
+			continue
+		}
+		var transitionErr *TransitionError
+		assert.ErrorAs(t, err, &transitionErr, subTest.name)
+		assert.ErrorIs(t, err, ErrIllegalTransition, subTest.name)
+		assert.Equal(t, from, transitionErr.From, subTest.name)
+		assert.Equal(t, subTest.to, transitionErr.To, subTest.name)
+		assert.Equal(t, from, session.State(), "state unchanged: "+subTest.name)
+	}
+}
+
+func TestTransitionTimestamps(t *testing.T) {
+	session := NewSession(1)
+	var seen []StateTransition
+	session.OnStateChange(func(s *Session, change StateTransition) {
+		assert.Equal(t, change.To, s.State(), "callback runs after the change")
+		seen = append(seen, change)
+	})
+
+	for _, state := range []State{HSK, OPN, ALI} {
+		assert.Nil(t, session.transition(state))
+	}
+	assert.NotNil(t, session.transition(REQ))
+
+	transitions := session.Transitions()
+	assert.Equal(t, seen, transitions)
+	assert.Len(t, transitions, 3)
+	assert.Equal(t, REQ, transitions[0].From)
+	assert.Equal(t, ALI, transitions[2].To)
+	assert.False(t, transitions[2].At.Before(transitions[0].At))
+
+	at, ok := session.EnteredAt(OPN)
+	assert.True(t, ok)
+	assert.Equal(t, transitions[1].At, at)
+	_, ok = session.EnteredAt(CLD)
+	assert.False(t, ok)
+}
+
+func TestServerStateChanges(t *testing.T) {
+	var mux sync.Mutex
+	var states []State
+	server := startServer(t, Options{OnStateChange: func(_ *Session, change StateTransition) {
+		defer mux.Unlock()
+		mux.Lock()
+		states = append(states, change.To)
+	}})
+	client, err := Dial(listenClient(t), server.conn.LocalAddr(), Options{})
+	assert.Nil(t, err)
+	_, err = server.Accept()
+	assert.Nil(t, err)
+	assert.Nil(t, client.Close())
+
+	assert.Eventually(t, func() bool {
+		defer mux.Unlock()
+		mux.Lock()
+		return len(states) == 4
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []State{HSK, OPN, ALI, CLD}, states)
+
+	var clientStates []State
+	for _, change := range client.Session().Transitions() {
+		clientStates = append(clientStates, change.To)
+	}
+	assert.Equal(t, []State{HSK, OPN, ALI, CLS, CLD}, clientStates)
+}
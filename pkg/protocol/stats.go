@@ -0,0 +1,74 @@
+package dtp
+
+import "sync/atomic"
+
+// Stats is a snapshot of the server counters.
+type Stats struct {
+	PacketsReceived uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	BytesSent       uint64
+	// SourceRateLimited counts datagrams dropped by the per source limit.
+	SourceRateLimited uint64
+	// SessionRateLimited counts datagrams dropped by the per session limit.
+	SessionRateLimited uint64
+	// AmplificationLimited counts datagrams that were not sent to an unvalidated address.
+	AmplificationLimited uint64
+	RetriesSent          uint64
+	ChallengesSent       uint64
+	SessionsAccepted     uint64
+	SessionsRejected     uint64
+	SessionsResumed      uint64
+	// UnknownSessions counts packages for session ids the server does not know, guessed ids among them.
+	UnknownSessions uint64
+	// Migrations counts sessions that moved to a new, validated client address.
+	Migrations uint64
+	// SessionsRestored counts sessions read from the SessionStore at start.
+	SessionsRestored uint64
+	// StoreErrors counts failed writes to the SessionStore.
+	StoreErrors uint64
+	// SessionsExpired counts sessions the reaper closed after their idle timeout or lifetime.
+	SessionsExpired uint64
+}
+
+type counters struct {
+	packetsReceived      atomic.Uint64
+	bytesReceived        atomic.Uint64
+	packetsSent          atomic.Uint64
+	bytesSent            atomic.Uint64
+	sourceRateLimited    atomic.Uint64
+	sessionRateLimited   atomic.Uint64
+	amplificationLimited atomic.Uint64
+	retriesSent          atomic.Uint64
+	challengesSent       atomic.Uint64
+	sessionsAccepted     atomic.Uint64
+	sessionsRejected     atomic.Uint64
+	sessionsResumed      atomic.Uint64
+	unknownSessions      atomic.Uint64
+	migrations           atomic.Uint64
+	sessionsRestored     atomic.Uint64
+	storeErrors          atomic.Uint64
+	sessionsExpired      atomic.Uint64
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		PacketsReceived:      c.packetsReceived.Load(),
+		BytesReceived:        c.bytesReceived.Load(),
+		PacketsSent:          c.packetsSent.Load(),
+		BytesSent:            c.bytesSent.Load(),
+		SourceRateLimited:    c.sourceRateLimited.Load(),
+		SessionRateLimited:   c.sessionRateLimited.Load(),
+		AmplificationLimited: c.amplificationLimited.Load(),
+		RetriesSent:          c.retriesSent.Load(),
+		ChallengesSent:       c.challengesSent.Load(),
+		SessionsAccepted:     c.sessionsAccepted.Load(),
+		SessionsRejected:     c.sessionsRejected.Load(),
+		SessionsResumed:      c.sessionsResumed.Load(),
+		UnknownSessions:      c.unknownSessions.Load(),
+		Migrations:           c.migrations.Load(),
+		SessionsRestored:     c.sessionsRestored.Load(),
+		StoreErrors:          c.storeErrors.Load(),
+		SessionsExpired:      c.sessionsExpired.Load(),
+	}
+}
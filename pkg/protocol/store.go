@@ -0,0 +1,220 @@
+package dtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// The live sessions of a server are held by the SessionHandler, established sessions are also written
+// to a SessionStore: when they reach ALI, when they migrate, when their keys moved to another phase
+// (checked by the reaper) and when the server is closed. A server created with a store that holds
+// records restores them, its clients carry on as if nothing happened.
+//
+// After a crash the stored package number may lag behind the last one sent. A restored session
+// therefore continues restoreSeqGap numbers later and is written back at once, so that no nonce is
+// used twice, not even after another crash.
+const restoreSeqGap = 1 << 32
+
+// SessionStore persists the resumable state of established sessions.
+type SessionStore interface {
+	Get(id int) (SessionRecord, bool, error)
+	Put(record SessionRecord) error
+	// Delete removes a record, removing an unknown id is no error.
+	Delete(id int) error
+	// Scan calls f for every record until f returns false.
+	Scan(f func(record SessionRecord) bool) error
+}
+
+// SessionRecord is the state a session can be restored from. Secret and Resumption are key material,
+// stores writing records somewhere must protect them.
+type SessionRecord struct {
+	ID           int
+	InitialID    int
+	Network      string
+	RemoteAddr   string
+	CreatedAt    time.Time
+	LastActivity time.Time
+	ExpiresAt    time.Time
+	IdleTimeout  time.Duration
+	ResumedFrom  int
+	Resumed      bool
+	// KeyPhase and Secret are the current key phase of the session and its secret.
+	KeyPhase   uint8
+	Secret     []byte
+	Resumption []byte
+	SendSeq    uint64
+}
+
+// MemoryStore is the default SessionStore, it lives as long as the process.
+type MemoryStore struct {
+	records map[int]SessionRecord
+	mux     sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[int]SessionRecord{}}
+}
+
+func (ms *MemoryStore) Get(id int) (SessionRecord, bool, error) {
+	defer ms.mux.RUnlock()
+	ms.mux.RLock()
+	record, ok := ms.records[id]
+	return record, ok, nil
+}
+
+func (ms *MemoryStore) Put(record SessionRecord) error {
+	defer ms.mux.Unlock()
+	ms.mux.Lock()
+	ms.records[record.ID] = record
+	return nil
+}
+
+func (ms *MemoryStore) Delete(id int) error {
+	defer ms.mux.Unlock()
+	ms.mux.Lock()
+	delete(ms.records, id)
+	return nil
+}
+
+func (ms *MemoryStore) Scan(f func(record SessionRecord) bool) error {
+	ms.mux.RLock()
+	records := make([]SessionRecord, 0, len(ms.records))
+	for _, record := range ms.records {
+		records = append(records, record)
+	}
+	ms.mux.RUnlock()
+	for _, record := range records {
+		if !f(record) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// SetStore replaces the store established sessions are written to.
+func (sh *SessionHandler) SetStore(store SessionStore) {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	sh.store = store
+}
+
+func (sh *SessionHandler) Store() SessionStore {
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return sh.store
+}
+
+// Persist writes the record of an established session to the store.
+func (sh *SessionHandler) Persist(session *Session) error {
+	record, ok := session.record()
+	if !ok {
+		return nil
+	}
+	if err := sh.Store().Put(record); err != nil {
+		return err
+	}
+	session.mux.Lock()
+	session.persisted = true
+	session.persistedPhase = record.KeyPhase
+	session.mux.Unlock()
+	return nil
+}
+
+// Checkpoint persists every established session whose keys changed since it was written last,
+// or all of them if full is set.
+func (sh *SessionHandler) Checkpoint(full bool) error {
+	var changed []*Session
+	sh.Range(func(session *Session) bool {
+		if session.State() == ALI && (full || session.keysChanged()) {
+			changed = append(changed, session)
+		}
+		return true
+	})
+	var err error
+	for _, session := range changed {
+		if perr := sh.Persist(session); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func (sh *Session) keysChanged() bool {
+	if sh.keys == nil {
+		return false
+	}
+	phase := sh.keys.currentPhase()
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return !sh.persisted || sh.persistedPhase != phase
+}
+
+// record returns the record of an established session, sessions without keys cannot be restored.
+func (sh *Session) record() (SessionRecord, bool) {
+	if sh.keys == nil {
+		return SessionRecord{}, false
+	}
+	phase, secret, resumption := sh.keys.snapshot()
+	defer sh.mux.Unlock()
+	sh.mux.Lock()
+	return SessionRecord{
+		ID:           sh.id,
+		InitialID:    sh.initialID,
+		Network:      sh.remoteAddr.Network(),
+		RemoteAddr:   sh.remoteAddr.String(),
+		CreatedAt:    sh.createdAt,
+		LastActivity: sh.lastReceived,
+		ExpiresAt:    sh.expiresAt,
+		IdleTimeout:  sh.idleTimeout,
+		ResumedFrom:  sh.resumedFrom,
+		Resumed:      sh.resumed,
+		KeyPhase:     phase,
+		Secret:       secret,
+		Resumption:   resumption,
+		SendSeq:      sh.sendSeq.Load(),
+	}, true
+}
+
+// restoreSession rebuilds an established server session from its record.
+func restoreSession(record SessionRecord, opts Options) (*Session, error) {
+	keys, err := restoreSessionKeys(record.Secret, record.KeyPhase, record.Resumption, false, opts)
+	if err != nil {
+		return nil, err
+	}
+	session := newSession(record.ID, opts.Clock)
+	session.initialID = record.InitialID
+	session.remoteAddr = restoreAddr(record.Network, record.RemoteAddr)
+	session.createdAt = record.CreatedAt
+	session.lastReceived = record.LastActivity
+	session.expiresAt = record.ExpiresAt
+	session.idleTimeout = record.IdleTimeout
+	session.resumedFrom = record.ResumedFrom
+	session.resumed = record.Resumed
+	session.validated = true
+	session.ticketIssued = true
+	session.keys = keys
+	session.sendSeq.Store(record.SendSeq + restoreSeqGap)
+	session.persisted = true
+	session.persistedPhase = record.KeyPhase
+	return session, nil
+}
+
+// storedAddr stands in for addresses of networks that cannot be resolved again.
+type storedAddr struct {
+	network string
+	address string
+}
+
+func (a storedAddr) Network() string { return a.network }
+func (a storedAddr) String() string  { return a.address }
+
+func restoreAddr(network, address string) net.Addr {
+	switch network {
+	case "udp", "udp4", "udp6":
+		if addr, err := net.ResolveUDPAddr(network, address); err == nil {
+			return addr
+		}
+	}
+	return storedAddr{network: network, address: address}
+}
@@ -0,0 +1,161 @@
+package dtp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// A session ticket is self-contained: the server seals the id of the session, its resumption secret
+// and the expiry with the ticket key and keeps nothing. The client stores the ticket together with the
+// resumption secret it derived on its own and presents the ticket in the REQ of a later session.
+//
+//	ticket    = nonce (12 byte) | AES-256-GCM(ticketKey, plaintext)
+//	plaintext = session id (8 byte) | expiry (8 byte, unix nano) | resumption secret (32 byte)
+//
+// Early data sent with a ticket can be replayed by anybody who captured the REQ. The server therefore
+// redeems every ticket only once, but the cache lives in the memory of one server: servers sharing a
+// ticket key do not share it. Early data must be safe to process twice.
+const (
+	ticketPlaintextSize = 8 + 8 + secretLength
+	// maxRedeemedTickets bounds the single use cache, resumption falls back to a full handshake beyond.
+	maxRedeemedTickets = 65536
+)
+
+// SessionTicket lets a client resume a session with a single round trip and send early data in its
+// first flight. It is issued by the server during the session and at close, see DTPConnection.Ticket.
+//
+// A ticket is good for one resumption. Do not reuse it, not even to retry a resumption that timed
+// out: the server may have redeemed it already and answers the second REQ with a full handshake,
+// and an observer can link the two attempts. Take the ticket of the resumed session for the next one.
+type SessionTicket struct {
+	// SessionID is the id of the session the ticket was issued for.
+	SessionID int
+	// Ticket is opaque to the client.
+	Ticket []byte
+	// Secret is the resumption secret of the session, it never leaves the client.
+	Secret    []byte
+	ExpiresAt time.Time
+}
+
+type ticketState struct {
+	sessionId int
+	secret    []byte
+}
+
+type ticketSealer struct {
+	aead     cipher.AEAD
+	lifetime time.Duration
+	redeemed map[[sha256.Size]byte]time.Time
+	now      func() time.Time
+	mux      sync.Mutex
+}
+
+func newTicketSealer(opts Options) (*ticketSealer, error) {
+	key := opts.TicketKey
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &ticketSealer{aead: aead, lifetime: opts.TicketLifetime, redeemed: map[[sha256.Size]byte]time.Time{}, now: nowFunc(opts.Clock)}, nil
+}
+
+func (ts *ticketSealer) seal(sessionId int, secret []byte) ([]byte, error) {
+	plaintext := make([]byte, 16, ticketPlaintextSize)
+	binary.BigEndian.PutUint64(plaintext, uint64(sessionId))
+	binary.BigEndian.PutUint64(plaintext[8:], uint64(ts.now().Add(ts.lifetime).UnixNano()))
+	plaintext = append(plaintext, secret...)
+
+	nonce := make([]byte, ts.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return ts.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// redeem opens a ticket and marks it as used. It fails for tickets that are forged, expired or
+// were redeemed before.
+func (ts *ticketSealer) redeem(ticket []byte) (ticketState, bool) {
+	nonceSize := ts.aead.NonceSize()
+	if len(ticket) < nonceSize {
+		return ticketState{}, false
+	}
+	plaintext, err := ts.aead.Open(nil, ticket[:nonceSize], ticket[nonceSize:], nil)
+	if err != nil || len(plaintext) != ticketPlaintextSize {
+		return ticketState{}, false
+	}
+	expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(plaintext[8:])))
+	now := ts.now()
+	if now.After(expiresAt) {
+		return ticketState{}, false
+	}
+
+	defer ts.mux.Unlock()
+	ts.mux.Lock()
+	id := sha256.Sum256(ticket)
+	if _, ok := ts.redeemed[id]; ok {
+		return ticketState{}, false
+	}
+	if len(ts.redeemed) >= maxRedeemedTickets {
+		for key, until := range ts.redeemed {
+			if now.After(until) {
+				delete(ts.redeemed, key)
+			}
+		}
+		if len(ts.redeemed) >= maxRedeemedTickets {
+			return ticketState{}, false
+		}
+	}
+	// Expired tickets are refused anyway, so the entry is only needed until then.
+	ts.redeemed[id] = expiresAt
+	return ticketState{sessionId: int(binary.BigEndian.Uint64(plaintext)), secret: plaintext[16:]}, true
+}
+
+// earlyKeys derives the keys early data is sealed with from the resumption secret and the initial id
+// and key share of the REQ. Both are fresh for every Dial, so two first flights with the same ticket
+// never seal under the same key and nonce.
+func earlyKeys(resumption []byte, initialID int, keyShare []byte) (directionKeys, error) {
+	info := binary.BigEndian.AppendUint64([]byte("dtp early data"), uint64(initialID))
+	info = append(info, keyShare...)
+	secret, err := hkdf.Expand(sha256.New, resumption, string(info), secretLength)
+	if err != nil {
+		return directionKeys{}, err
+	}
+	return deriveDirectionKeys(secret, "c2s")
+}
+
+func sealEarlyData(resumption []byte, initialID int, keyShare, data []byte) ([]byte, error) {
+	keys, err := earlyKeys(resumption, initialID, keyShare)
+	if err != nil {
+		return nil, err
+	}
+	return keys.aead.Seal(nil, keys.nonce(0), data, dataAAD(initialID, 0)), nil
+}
+
+func openEarlyData(resumption []byte, initialID int, keyShare, sealed []byte) ([]byte, error) {
+	keys, err := earlyKeys(resumption, initialID, keyShare)
+	if err != nil {
+		return nil, err
+	}
+	data, err := keys.aead.Open(nil, keys.nonce(0), sealed, dataAAD(initialID, 0))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return data, nil
+}
@@ -0,0 +1,84 @@
+package dtp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTicketRedeem(t *testing.T) {
+	sealer, err := newTicketSealer(Options{TicketKey: []byte("ticket key")}.withDefaults())
+	assert.Nil(t, err)
+	secret := make([]byte, secretLength)
+	secret[0] = 7
+
+	ticket, err := sealer.seal(42, secret)
+	assert.Nil(t, err)
+
+	state, ok := sealer.redeem(ticket)
+	assert.True(t, ok)
+	assert.Equal(t, 42, state.sessionId)
+	assert.Equal(t, secret, state.secret)
+
+	_, ok = sealer.redeem(ticket)
+	assert.False(t, ok, "a ticket is redeemed only once")
+
+	forged, err := sealer.seal(43, secret)
+	assert.Nil(t, err)
+	forged[len(forged)-1] ^= 1
+	_, ok = sealer.redeem(forged)
+	assert.False(t, ok, "forged ticket")
+
+	other, err := newTicketSealer(Options{TicketKey: []byte("other key")}.withDefaults())
+	assert.Nil(t, err)
+	foreign, err := other.seal(44, secret)
+	assert.Nil(t, err)
+	_, ok = sealer.redeem(foreign)
+	assert.False(t, ok, "ticket of another key")
+
+	expiring, err := newTicketSealer(Options{TicketKey: []byte("ticket key"), TicketLifetime: time.Nanosecond}.withDefaults())
+	assert.Nil(t, err)
+	expired, err := expiring.seal(45, secret)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond)
+	_, ok = sealer.redeem(expired)
+	assert.False(t, ok, "expired ticket")
+}
+
+// TestEarlyDataKeys seals early data with one ticket for several first flights. A key and nonce used
+// twice would show in the XOR of the ciphertexts, which would equal the XOR of the plaintexts.
+func TestEarlyDataKeys(t *testing.T) {
+	secret := make([]byte, secretLength)
+	first, second := []byte("transfer 10 EUR"), []byte("transfer 99 EUR")
+	share, otherShare := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	tests := []struct {
+		name      string
+		initialID int
+		keyShare  []byte
+	}{
+		{name: "new initial id and key share", initialID: 8, keyShare: otherShare},
+		{name: "same initial id, new key share", initialID: 7, keyShare: otherShare},
+		{name: "new initial id, same key share", initialID: 8, keyShare: share},
+	}
+
+	sealed, err := sealEarlyData(secret, 7, share, first)
+	assert.Nil(t, err)
+	for _, subTest := range tests {
+		again, err := sealEarlyData(secret, subTest.initialID, subTest.keyShare, second)
+		assert.Nil(t, err, subTest.name)
+		xor := make([]byte, len(first))
+		for i := range xor {
+			xor[i] = sealed[i] ^ again[i] ^ first[i] ^ second[i]
+		}
+		assert.NotEqual(t, make([]byte, len(first)), xor, subTest.name)
+
+		data, err := openEarlyData(secret, subTest.initialID, subTest.keyShare, again)
+		assert.Nil(t, err, subTest.name)
+		assert.Equal(t, second, data, subTest.name)
+		_, err = openEarlyData(secret, 7, share, again)
+		assert.ErrorIs(t, err, ErrDecrypt, "keys of another flight: "+subTest.name)
+	}
+}
@@ -1,23 +1,42 @@
 package dtp
 
 import (
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/WhilecodingDoLearn/dtp/pkg/protocol/codec"
 )
 
+// State is the state of a session, see transitions. The message codes of the packages are
+// codec.State, some states are named after the message that leads to them.
 type State int
 
 const (
 	REQ State = iota
+	HSK
 	OPN
 	ALI
-	CLD
-	ACK
-	RTY
+	CLS
 	ERR
+	CLD
 )
 
+var stateNames = map[State]string{REQ: "REQ", HSK: "HSK", OPN: "OPN", ALI: "ALI", CLS: "CLS", ERR: "ERR", CLD: "CLD"}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 type Message struct {
 	Session    int
 	Ip         *net.UDPAddr
@@ -25,17 +44,12 @@ type Message struct {
 	DataType   string
 	DataLength int
 	Data       []byte
+	// attrs are the attributes of the session the message belongs to.
+	attrs *Attributes
 }
 
-type Package struct {
-	Sid int
-	Msg State
-	Pid int
-	Bid int
-	Lid int
-	Pyl []byte
-	Rma *net.UDPAddr
-}
+// Package is a datagram as codec.Encode and codec.Decode see it, the wire format is only defined there.
+type Package = codec.Package
 
 type PackageReader interface {
 	Read() Package
@@ -47,15 +61,7 @@ type Frame struct {
 }
 
 type PacketCache struct {
-	cache []struct {
-		Sid int
-		Msg int
-		Pid int
-		Bid int
-		Lid int
-		Pyl []byte
-		Rma *net.UDPAddr
-	}
+	cache    []Package
 	received int
 }
 
@@ -67,33 +73,68 @@ type Buffer struct {
 }
 
 type Session struct {
-	id              int
-	state           State
-	expiration      time.Time
-	remoteAddr      *net.UDPAddr
-	createdAt       time.Time
-	lastReceived    time.Time
-	lastSend        time.Time
-	expiresAt       time.Time
-	expectedSeq     uint32
-	lastAckedSeq    uint32
-	retransmitQueue []struct {
-		Sid int
-		Msg int
-		Pid int
-		Bid int
-		Lid int
-		Pyl []byte
-		Rma *net.UDPAddr
-	}
+	id int
+	// initialID is the id the client picked for the REQ, the session keys are bound to it.
+	initialID    int
+	state        State
+	idleTimeout  time.Duration
+	remoteAddr   net.Addr
+	validated    bool
+	limiter      *trafficLimiter
+	createdAt    time.Time
+	lastReceived time.Time
+	lastSend     time.Time
+	expiresAt    time.Time
+	// handshakeDeadline is when a session that is not established yet expires.
+	handshakeDeadline time.Time
+	expectedSeq       uint32
+	lastAckedSeq      uint32
 
-	ackTimeout    time.Duration
-	authToken     string
-	encryptionKey []byte
-	customData    map[string]interface{}
+	ackTimeout time.Duration
+	authToken  string
+	// keyShare is our public X25519 share, the server repeats it with every OPN.
+	keyShare []byte
+	keys     *sessionKeys
+	sendSeq  atomic.Uint64
+	conn     *DTPConnection
+	// resumedFrom is the id of the session whose ticket resumed this one.
+	resumedFrom int
+	resumed     bool
+	// ticketIssued is set once the server sent a ticket after the handshake.
+	ticketIssued bool
+	// persisted is set once the session was written to the store, with the key phase it had then.
+	persisted      bool
+	persistedPhase uint8
+	// challenge is the pending validation of a new path of the client.
+	challenge *pathChallenge
+	rtt       time.Duration
+	traffic   sessionTraffic
+	clock     Clock
+	// attrs are the attributes the application attached to the session.
+	attrs Attributes
+
+	transitions   []StateTransition
+	onStateChange []StateChangeFunc
+	mux           sync.Mutex
 }
 
+// sessionShardBits is the log2 of the number of shards the session table is split into.
+const sessionShardBits = 6
+
+// SessionHandler is the session table of a server. It is split into shards with a lock each, so
+// that packages of different sessions rarely wait for each other.
 type SessionHandler struct {
-	sessionCache map[int]*Session
-	mux          sync.Mutex
+	shards      [1 << sessionShardBits]sessionShard
+	size        atomic.Int64
+	maxSessions atomic.Int64
+	// mux guards reaper, store and clock.
+	reaper *reaper
+	store  SessionStore
+	clock  Clock
+	mux    sync.Mutex
+}
+
+type sessionShard struct {
+	sessions map[int]*Session
+	mux      sync.RWMutex
 }